@@ -0,0 +1,132 @@
+package bootmanager
+
+import (
+	"log"
+	"time"
+
+	"pifigo/internal/config"
+	"pifigo/internal/network"
+	"pifigo/internal/probe"
+	"pifigo/internal/profiles"
+	"pifigo/internal/scan"
+	"pifigo/internal/state"
+)
+
+// SavedNetworks returns the saved networks with autoconnect set, highest
+// priority first, for backends that keep them in their own configuration.
+func SavedNetworks() ([]network.ClientConfig, error) {
+	list, err := profiles.NewStore(SavedNetworksDir).List()
+	if err != nil {
+		return nil, err
+	}
+	var saved []network.ClientConfig
+	for _, p := range profiles.Candidates(list, nil) {
+		saved = append(saved, p.ClientConfig())
+	}
+	return saved, nil
+}
+
+// AutoConnect scans for networks and tries the saved profiles in range, by
+// priority and then signal strength, until one connects. With no saved
+// network in range the device is left as it is. If none connects, a device
+// that was on a client network goes back to its last-good network, and
+// otherwise the hotspot is brought back: as Fallback after client mode was
+// abandoned, as Hotspot otherwise. It reports whether a new network was
+// joined.
+func AutoConnect(cfg *config.Config, backend network.NetworkBackend, machine *state.Machine, reason string) bool {
+	release, err := machine.Acquire("auto-connect")
+	if err != nil {
+		log.Printf("Auto-connect: %v. Skipping.", err)
+		return false
+	}
+	defer release()
+	current := machine.Current()
+	wasClient := current.IsClient()
+	store := profiles.NewStore(SavedNetworksDir)
+	candidates, err := candidates(cfg, store, !wasClient)
+	if err != nil {
+		log.Printf("ERROR: Auto-connect could not read saved networks: %v", err)
+	}
+	if len(candidates) == 0 {
+		log.Println("Auto-connect: no saved network is in range.")
+		return false
+	}
+	if err := machine.Transition(state.Connecting, reason); err != nil {
+		log.Printf("ERROR: Auto-connect: %v", err)
+		return false
+	}
+	opts := probe.TryOptions(cfg)
+	opts.NoRollback = true
+	for _, p := range candidates {
+		log.Printf("Auto-connect: trying %s (priority %d).", p.SSID, p.Priority)
+		_ = machine.RecordAttempt(p.ID)
+		if err := network.TryConnect(backend, p.ClientConfig(), nil, opts); err != nil {
+			log.Printf("Auto-connect: could not connect to %s: %v", p.SSID, err)
+			_ = machine.RecordFailure(p.ID, state.Failure{SSID: p.SSID, Stage: network.FailureStage(err), Reason: err.Error(), Time: time.Now()})
+			continue
+		}
+		_ = store.MarkUsed(p.ID)
+		_ = machine.RecordSuccess(p.ID)
+		_ = machine.Transition(state.Client, "auto-connected to "+p.SSID)
+		return true
+	}
+	if wasClient && restore(store, backend, machine) {
+		return false
+	}
+	giveUp(backend, machine, wasClient || current == state.Fallback, "no saved network could be joined")
+	return false
+}
+
+// restore reconnects the last-good network after every candidate failed,
+// leaving the device where it was before auto-connect. It reports whether
+// the network was applied.
+func restore(store *profiles.Store, backend network.NetworkBackend, machine *state.Machine) bool {
+	lastGood := machine.LastGood()
+	if lastGood == "" {
+		return false
+	}
+	p, err := store.Get(lastGood)
+	if err != nil {
+		return false
+	}
+	if err := backend.Connect(p.ClientConfig()); err != nil {
+		log.Printf("ERROR: Auto-connect could not restore %s: %v", p.SSID, err)
+		return false
+	}
+	_ = machine.Transition(state.Client, "restored "+p.SSID+" after no other network could be joined")
+	return true
+}
+
+// candidates scans and returns the saved profiles to try. If the scan fails,
+// every autoconnect profile is tried.
+func candidates(cfg *config.Config, store *profiles.Store, apForce bool) ([]profiles.Profile, error) {
+	list, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	var signal map[string]float64
+	networks, err := scan.Scan(cfg.Network.WirelessInterface, apForce)
+	if err != nil {
+		log.Printf("WARNING: Auto-connect could not scan: %v. Trying every saved network.", err)
+	} else {
+		signal = make(map[string]float64, len(networks))
+		for _, n := range networks {
+			signal[n.SSID] = n.Signal
+		}
+	}
+	return profiles.Candidates(list, signal), nil
+}
+
+// giveUp brings the hotspot back after auto-connect found nothing to join,
+// as Fallback if the device had been on a client network.
+func giveUp(backend network.NetworkBackend, machine *state.Machine, fallback bool, reason string) {
+	log.Printf("Auto-connect: %s. Starting the hotspot.", reason)
+	// ForceHotspotMode logs its own errors. The state still has to leave
+	// Connecting, and the hotspot is the only mode left to report.
+	_ = ForceHotspotMode(backend)
+	if fallback {
+		_ = machine.Transition(state.Fallback, reason)
+	} else {
+		_ = machine.Transition(state.Hotspot, reason)
+	}
+}
@@ -2,38 +2,45 @@ package bootmanager
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"strings"
 	"text/template"
 	"time"
 
 	"pifigo/internal/config"
+	"pifigo/internal/network"
+	"pifigo/internal/profiles"
+	"pifigo/internal/state"
 )
 
 // Exported variables to allow for mocking during tests.
 var (
-	ExecCommand       = exec.Command
 	HotspotConfigFile = "/etc/netplan/00-pifigo-hotspot-ip.yaml"
 	HostapdConfigFile = "/etc/hostapd/hostapd.conf"
 	DnsmasqConfigFile = "/etc/dnsmasq.d/99-pifigo-hotspot"
+	SavedNetworksDir  = "/etc/pifigo/saved_networks"
 )
 
-const (
-	lastGoodSymlink    = "/etc/pifigo/last-good-wifi.yaml"
-	activeClientConfig = "/etc/netplan/99-pifigo-client.yaml"
-)
-
-// SyncHotspotConfig now generates hostapd and dnsmasq configs directly.
-func SyncHotspotConfig(cfg *config.Config) error {
+// SyncHotspotConfig generates hostapd and dnsmasq configs directly, unless
+// the backend provisions the hotspot itself.
+func SyncHotspotConfig(cfg *config.Config, backend network.NetworkBackend) error {
 	log.Println("Syncing hotspot configuration...")
 
 	if err := validateHotspotConfig(cfg); err != nil {
 		return fmt.Errorf("invalid hotspot configuration: %w", err)
 	}
 
+	if hc, ok := backend.(network.HotspotConfigurer); ok {
+		if err := hc.ConfigureHotspot(); err != nil {
+			return fmt.Errorf("failed to configure %s hotspot: %w", backend.Name(), err)
+		}
+		log.Printf("Successfully synced %s hotspot connection.", backend.Name())
+		return nil
+	}
+
 	// 1. Generate the hostapd.conf content
 	hostapdTemplate := `interface={{.Network.WirelessInterface}}
 driver=nl80211
@@ -75,7 +82,12 @@ dhcp-range={{ipWithoutCidr .Network.ApIpAddress}},{{ipWithoutCidr .Network.ApIpA
 		return err
 	}
 
-	// 3. Generate a minimal netplan config JUST for the static IP
+	// 3. Generate a minimal netplan config JUST for the static IP. Other
+	// backends assign the hotspot address themselves.
+	if backend.Name() != network.BackendNetplan {
+		log.Println("Successfully synced all hotspot configuration files.")
+		return nil
+	}
 	netplanTemplate := `network:
   version: 2
   renderer: networkd
@@ -132,47 +144,74 @@ func validateHotspotConfig(cfg *config.Config) error {
 	return nil
 }
 
-func Start(cfg *config.Config, stopSignal <-chan bool) {
+// Start waits for the user to pick a network. If no other transition
+// happens before the timeout, it connects to a saved network in range. It
+// returns early when ctx is done.
+func Start(ctx context.Context, cfg *config.Config, backend network.NetworkBackend, machine *state.Machine) {
+	events, cancel := machine.Subscribe()
+	defer cancel()
 	timeout := time.NewTimer(time.Duration(cfg.BootManager.TimeoutSeconds) * time.Second)
 	defer timeout.Stop()
+	if !machine.Current().IsHotspot() {
+		log.Printf("Boot manager: device is in %s mode. Nothing to do.", machine.Current())
+		return
+	}
 	log.Printf("Boot manager started. Waiting %d seconds for user configuration...", cfg.BootManager.TimeoutSeconds)
 	select {
-	case <-stopSignal:
-		log.Println("Boot manager received stop signal. Exiting.")
+	case ev := <-events:
+		log.Printf("Boot manager: state changed to %s. Exiting.", ev.To)
+		return
+	case <-ctx.Done():
 		return
 	case <-timeout.C:
-		log.Println("Boot manager timeout reached. Attempting to connect to last known WiFi network.")
-		revertToLastGoodConfig()
+		log.Println("Boot manager timeout reached. Trying saved networks in range.")
+		AutoConnect(cfg, backend, machine, "boot manager timeout")
 	}
 }
 
-func revertToLastGoodConfig() {
-	if _, err := os.Lstat(lastGoodSymlink); os.IsNotExist(err) { log.Println("No last-good WiFi configuration symlink found. Remaining in hotspot mode."); return }
-	stopCmd := ExecCommand("sh", "-c", "systemctl stop hostapd dnsmasq pifigo")
-	if output, err := stopCmd.CombinedOutput(); err != nil { log.Printf("ERROR: Boot manager failed to stop hotspot services: %v\nOutput: %s", err, string(output)) }
-	copyCmd := ExecCommand("cp", lastGoodSymlink, activeClientConfig)
-	if err := copyCmd.Run(); err != nil { log.Printf("ERROR: Boot manager failed to copy last-good config: %v", err); return }
-	applyCmd := ExecCommand("netplan", "apply")
-	if err := applyCmd.Run(); err != nil { log.Printf("ERROR: Boot manager failed to apply last-good WiFi config: %v", err) }
+// MigrateProfiles converts the saved networks written by earlier versions,
+// rewrites them with the configured storage settings and points the
+// last-good network, which used to be recorded by SSID, at the migrated
+// profile.
+func MigrateProfiles(cfg *config.Config, machine *state.Machine) {
+	store := profiles.NewStore(SavedNetworksDir)
+	if _, err := store.MigrateLegacy(); err != nil {
+		log.Printf("WARNING: Could not migrate saved networks: %v", err)
+	}
+	if err := store.Secure(cfg.Network.EncryptProfiles); err != nil {
+		log.Printf("WARNING: Could not secure saved networks: %v", err)
+	}
+	lastGood := machine.LastGood()
+	if lastGood == "" {
+		return
+	}
+	if p, err := store.Resolve(lastGood); err == nil && p.ID != lastGood {
+		_ = machine.SetLastGood(p.ID)
+	}
 }
 
-func ForceHotspotMode() error {
-	// When forcing hotspot, we remove the client configs and restart services.
-	// The pifigo service, on next start, will re-sync the correct hotspot configs.
-	if err := os.Remove(activeClientConfig); err != nil && !os.IsNotExist(err) {
-		log.Printf("Warning: Could not remove active client config: %v", err)
-	}
-	
-	// Re-apply netplan. With the client config gone, it will use the static IP config.
-	applyCmd := ExecCommand("netplan", "apply")
-	if output, err := applyCmd.CombinedOutput(); err != nil {
-		log.Printf("ERROR: Failed to apply hotspot config: %v\nOutput: %s", err, string(output))
-		return err
+// SyncState reconciles the persisted state with the mode the backend reports,
+// for example after a crash mid-connect or a change made while pifigo was
+// not running.
+func SyncState(backend network.NetworkBackend, machine *state.Machine) {
+	st, err := backend.Status()
+	if err != nil {
+		log.Printf("WARNING: Could not read network status: %v", err)
+		return
+	}
+	current := machine.Current()
+	switch {
+	case st.Mode == network.ModeClient && !current.IsClient():
+		_ = machine.Force(state.Client, "client configuration found at startup")
+	case st.Mode == network.ModeHotspot && !current.IsHotspot():
+		_ = machine.Force(state.Hotspot, "no client configuration found at startup")
 	}
-	// Restart the services that depend on the static IP.
-	restartCmd := ExecCommand("sh", "-c", "systemctl restart hostapd dnsmasq")
-	if output, err := restartCmd.CombinedOutput(); err != nil {
-		log.Printf("ERROR: Failed to restart hotspot services: %v\nOutput: %s", err, string(output))
+}
+
+// ForceHotspotMode drops any client configuration and restarts the hotspot.
+func ForceHotspotMode(backend network.NetworkBackend) error {
+	if err := backend.StartHotspot(); err != nil {
+		log.Printf("ERROR: Failed to force hotspot mode: %v", err)
 		return err
 	}
 	return nil
@@ -1,9 +1,17 @@
 package bootmanager
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"pifigo/internal/config"
+	"pifigo/internal/network"
+	"pifigo/internal/profiles"
+	"pifigo/internal/scan"
+	"pifigo/internal/state"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -11,17 +19,6 @@ import (
 	"time"
 )
 
-// mockExecCommand replaces the real ExecCommand with a harmless one for testing.
-func mockExecCommand(t *testing.T) func() {
-	originalExec := ExecCommand
-	ExecCommand = func(name string, arg ...string) *exec.Cmd {
-		return exec.Command("/bin/true")
-	}
-	return func() {
-		ExecCommand = originalExec
-	}
-}
-
 // TestSyncHotspotConfig verifies that all three hotspot config files are generated correctly.
 func TestSyncHotspotConfig(t *testing.T) {
 	// Create a temporary directory to act as the root for our config files.
@@ -50,7 +47,7 @@ func TestSyncHotspotConfig(t *testing.T) {
 	cfg.Network.WifiCountry = "US"
 
 	// Run the sync function.
-	err := SyncHotspotConfig(cfg)
+	err := SyncHotspotConfig(cfg, network.NewNetplan(cfg))
 	if err != nil {
 		t.Fatalf("SyncHotspotConfig failed: %v", err)
 	}
@@ -83,42 +80,82 @@ func TestSyncHotspotConfig(t *testing.T) {
 	}
 }
 
-// TestBootManager_StopSignal remains the same
-func TestBootManager_StopSignal(t *testing.T) {
+// TestBootManager_StopsOnTransition verifies that the boot manager exits as
+// soon as something else, such as the portal, changes the connection state.
+func TestBootManager_StopsOnTransition(t *testing.T) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	cfg := &config.Config{}
+	cfg.BootManager.TimeoutSeconds = 10
+	machine := state.New(filepath.Join(t.TempDir(), "state.json"))
+	started := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		close(started)
+		Start(context.Background(), cfg, network.NewFake(), machine)
+	}()
+	<-started
+	time.Sleep(10 * time.Millisecond)
+	machine.Transition(state.Connecting, "user picked a network")
+	if waitTimeout(&wg, 100*time.Millisecond) {
+		t.Errorf("Boot manager did not stop immediately after the state changed")
+	}
+}
+
+// TestBootManager_StopsOnCancel verifies that the boot manager exits when
+// the daemon shuts down.
+func TestBootManager_StopsOnCancel(t *testing.T) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	cfg := &config.Config{}
 	cfg.BootManager.TimeoutSeconds = 10
-	stopSignal := make(chan bool, 1)
+	machine := state.New(filepath.Join(t.TempDir(), "state.json"))
+	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
 		defer wg.Done()
-		Start(cfg, stopSignal)
+		Start(ctx, cfg, network.NewFake(), machine)
 	}()
-	stopSignal <- true
+	cancel()
 	if waitTimeout(&wg, 100*time.Millisecond) {
-		t.Errorf("Boot manager did not stop immediately after receiving the stop signal")
+		t.Errorf("Boot manager did not stop after its context was cancelled")
 	}
 }
 
 // TestBootManager_Timeout remains the same
 func TestBootManager_Timeout(t *testing.T) {
-	cleanupExec := mockExecCommand(t)
-	defer cleanupExec()
 	var wg sync.WaitGroup
 	wg.Add(1)
 	cfg := &config.Config{}
 	cfg.BootManager.TimeoutSeconds = 0
-	stopSignal := make(chan bool, 1)
+	machine := state.New(filepath.Join(t.TempDir(), "state.json"))
 	go func() {
 		defer wg.Done()
 		time.Sleep(50 * time.Millisecond)
-		Start(cfg, stopSignal)
+		Start(context.Background(), cfg, network.NewFake(), machine)
 	}()
 	if waitTimeout(&wg, 100*time.Millisecond) {
 		// This is expected to fail to wait because the goroutine should finish quickly.
 	}
 }
 
+// TestSyncState verifies the persisted state is reconciled with the backend.
+func TestSyncState(t *testing.T) {
+	backend := network.NewFake()
+	machine := state.New(filepath.Join(t.TempDir(), "state.json"))
+	machine.Force(state.Connecting, "interrupted by a crash")
+
+	SyncState(backend, machine)
+	if machine.Current() != state.Hotspot {
+		t.Errorf("Expected hotspot after a crash with no client config, got %s", machine.Current())
+	}
+
+	backend.Connect(network.ClientConfig{SSID: "HomeWiFi"})
+	SyncState(backend, machine)
+	if machine.Current() != state.Client {
+		t.Errorf("Expected client when the backend reports client mode, got %s", machine.Current())
+	}
+}
+
 // waitTimeout helper function remains the same
 func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
 	c := make(chan struct{})
@@ -133,3 +170,144 @@ func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
 		return true
 	}
 }
+
+// TestForceHotspotMode verifies the boot manager delegates to the backend.
+func TestForceHotspotMode(t *testing.T) {
+	backend := network.NewFake()
+	if err := ForceHotspotMode(backend); err != nil {
+		t.Fatalf("ForceHotspotMode failed: %v", err)
+	}
+	if calls := backend.Calls(); len(calls) != 1 || calls[0] != "StartHotspot" {
+		t.Errorf("Expected a single StartHotspot call, got %v", calls)
+	}
+}
+
+// hotspotBackend is a fake backend that provisions its own hotspot.
+type hotspotBackend struct {
+	*network.Fake
+	configured bool
+}
+
+func (h *hotspotBackend) ConfigureHotspot() error {
+	h.configured = true
+	return nil
+}
+
+// TestSyncHotspotConfig_Configurer verifies that backends which provision the
+// hotspot themselves replace the hostapd and dnsmasq generation.
+func TestSyncHotspotConfig_Configurer(t *testing.T) {
+	tmpDir := t.TempDir()
+	originalHostapdFile := HostapdConfigFile
+	HostapdConfigFile = filepath.Join(tmpDir, "hostapd.conf")
+	defer func() { HostapdConfigFile = originalHostapdFile }()
+
+	cfg := &config.Config{}
+	cfg.Network.WirelessInterface = "wlan_test"
+	cfg.Network.ApIpAddress = "192.168.100.1/24"
+	cfg.Network.ApSSID = "TestHotspot"
+	cfg.Network.ApPassword = "testpassword"
+
+	backend := &hotspotBackend{Fake: network.NewFake()}
+	if err := SyncHotspotConfig(cfg, backend); err != nil {
+		t.Fatalf("SyncHotspotConfig failed: %v", err)
+	}
+	if !backend.configured {
+		t.Error("Expected the backend to configure its own hotspot")
+	}
+	if _, err := os.Stat(HostapdConfigFile); !os.IsNotExist(err) {
+		t.Error("hostapd config should not be generated for a self-configuring backend")
+	}
+}
+
+// flakyBackend fails to connect to the SSIDs in fail.
+type flakyBackend struct {
+	*network.Fake
+	fail map[string]bool
+}
+
+func (b *flakyBackend) Connect(c network.ClientConfig) error {
+	if b.fail[c.SSID] {
+		return errors.New("no such network")
+	}
+	return b.Fake.Connect(c)
+}
+
+// TestAutoConnect verifies saved networks in range are tried by priority and
+// signal until one connects.
+func TestAutoConnect(t *testing.T) {
+	tmpDir := t.TempDir()
+	originalSavedDir := SavedNetworksDir
+	SavedNetworksDir = filepath.Join(tmpDir, "saved_networks")
+	defer func() { SavedNetworksDir = originalSavedDir }()
+	originalExec := scan.ExecCommand
+	scan.ExecCommand = func(name string, arg ...string) *exec.Cmd {
+		return exec.Command("printf", "%s", "BSS aa:bb:cc:00:00:01(on wlan0)\n\tsignal: -70.00 dBm\n\tSSID: HomeWiFi\nBSS aa:bb:cc:00:00:02(on wlan0)\n\tsignal: -40.00 dBm\n\tSSID: Office\n")
+	}
+	defer func() { scan.ExecCommand = originalExec }()
+
+	online := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer online.Close()
+	cfg := &config.Config{}
+	cfg.Watchdog.CheckURL = online.URL
+	backend := &flakyBackend{Fake: network.NewFake(), fail: map[string]bool{}}
+	machine := state.New(filepath.Join(tmpDir, "state.json"))
+	if AutoConnect(cfg, backend, machine, "test") || len(backend.Calls()) != 0 {
+		t.Errorf("Expected no network changes without saved networks, got %v", backend.Calls())
+	}
+
+	store := profiles.NewStore(SavedNetworksDir)
+	home := profiles.New("HomeWiFi", "secret123")
+	home.Priority = 5
+	store.Save(home)
+	store.Save(profiles.New("Office", ""))
+	store.Save(profiles.New("Elsewhere", "secret123"))
+
+	backend.fail["HomeWiFi"] = true
+	if !AutoConnect(cfg, backend, machine, "test") {
+		t.Fatal("Expected auto-connect to fall through to the next network")
+	}
+	snap := machine.Snapshot()
+	if snap.State != state.Client || snap.ActiveProfile != profiles.ID("Office") {
+		t.Errorf("Expected client mode on Office, got %+v", snap)
+	}
+	if c := snap.Profiles[profiles.ID("HomeWiFi")]; c.Failures != 1 {
+		t.Errorf("Expected the HomeWiFi failure to be counted, got %+v", c)
+	}
+	if _, tried := snap.Profiles[profiles.ID("Elsewhere")]; tried {
+		t.Error("A network out of range should not be tried")
+	}
+
+	// Connectivity lost and nothing works, not even the last-good network:
+	// back to the hotspot as Fallback.
+	machine.Transition(state.Degraded, "connectivity check failed")
+	backend.fail["Office"] = true
+	if AutoConnect(cfg, backend, machine, "connectivity lost") {
+		t.Fatal("Expected auto-connect to fail")
+	}
+	if machine.Current() != state.Fallback {
+		t.Errorf("Expected fallback mode, got %s", machine.Current())
+	}
+	if st, _ := backend.Status(); st.Mode != network.ModeHotspot {
+		t.Errorf("Expected the hotspot to be started, got %s", st.Mode)
+	}
+}
+
+// TestMigrateProfiles verifies a last-good network recorded by SSID follows
+// its profile to the new ID.
+func TestMigrateProfiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	originalSavedDir := SavedNetworksDir
+	SavedNetworksDir = tmpDir
+	defer func() { SavedNetworksDir = originalSavedDir }()
+	legacy := "network:\n  wifis:\n    wlan0:\n      dhcp4: true\n      access-points:\n        \"HomeWiFi\":\n          password: \"secret123\"\n"
+	os.WriteFile(filepath.Join(tmpDir, "HomeWiFi.yaml"), []byte(legacy), 0644)
+
+	machine := state.New(filepath.Join(tmpDir, "state.json"))
+	machine.SetLastGood("HomeWiFi")
+	MigrateProfiles(&config.Config{}, machine)
+	if got := machine.LastGood(); got != profiles.ID("HomeWiFi") {
+		t.Errorf("Expected last-good to point at the migrated profile, got %q", got)
+	}
+}
@@ -1,108 +1,215 @@
 package cli
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"net"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+
+	"pifigo/internal/config"
+	"pifigo/internal/network"
+	"pifigo/internal/probe"
+	"pifigo/internal/profiles"
+	"pifigo/internal/state"
 )
 
 // Use var instead of const to allow them to be modified during testing.
 var (
-	savedNetworksDir   = "/etc/pifigo/saved_networks"
-	lastGoodSymlink    = "/etc/pifigo/last-good-wifi.yaml"
-	activeClientConfig = "/etc/netplan/99-pifigo-client.yaml"
+	savedNetworksDir = "/etc/pifigo/saved_networks"
+	legacySymlink    = state.LegacySymlink
+	stateFile        = state.DefaultPath
 )
 
-// ShowStatus checks and prints the current network state of the device.
-func ShowStatus() error {
-	if _, err := os.Lstat(activeClientConfig); err == nil {
-		// If the client config exists, we are likely in client mode.
-		// We can try to read the SSID from the last-good symlink for more info.
-		ssid, err := os.Readlink(lastGoodSymlink)
+// minAdminPasswordLength is the shortest admin password SetAdminPassword
+// accepts.
+const minAdminPasswordLength = 8
+
+// readPassword prompts for a password. On a terminal the password is not
+// echoed and is asked for twice; otherwise one line is read from stdin, so
+// the password can be piped in. Replaced in tests.
+var readPassword = func() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("could not read the password from stdin: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	var entered [2]string
+	for i, prompt := range []string{"New admin password (empty to turn the login off): ", "Repeat the password: "} {
+		fmt.Print(prompt)
+		b, err := term.ReadPassword(fd)
+		fmt.Println()
 		if err != nil {
+			return "", err
+		}
+		entered[i] = string(b)
+	}
+	if entered[0] != entered[1] {
+		return "", errors.New("the passwords do not match")
+	}
+	return entered[0], nil
+}
+
+// loadState opens the state file, importing the last-good network from the
+// symlink used by earlier versions if it is still there.
+func loadState() (*state.Machine, error) {
+	machine, err := state.Load(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := machine.MigrateSymlink(legacySymlink); err != nil {
+		return nil, err
+	}
+	return machine, nil
+}
+
+// networkName returns the SSID of a saved profile, falling back to the
+// reference itself if the profile is gone.
+func networkName(ref string) string {
+	if p, err := profiles.NewStore(savedNetworksDir).Resolve(ref); err == nil {
+		return p.SSID
+	}
+	return ref
+}
+
+// ShowStatus checks and prints the current network state of the device. In
+// client mode it diagnoses the connection layer by layer with the watchdog's
+// connectivity probes.
+func ShowStatus(cfg *config.Config, backend network.NetworkBackend) error {
+	machine, err := loadState()
+	if err != nil {
+		return err
+	}
+	current := machine.Current()
+	if current.IsClient() {
+		snap := machine.Snapshot()
+		switch {
+		case snap.ActiveProfile == "" && snap.LastGood != "":
+			fmt.Printf("Status: Client Mode (Last configured for: %s)\n", networkName(snap.LastGood))
+		case snap.ActiveProfile == "":
 			fmt.Println("Status: Client Mode (SSID unknown)")
-		} else {
-			// Use filepath.Base to get just the filename from the symlink target.
-			baseName := filepath.Base(ssid)
-			// Use strings.TrimSuffix to remove the .yaml extension.
-			fmt.Printf("Status: Client Mode (Last configured for: %s)\n", strings.TrimSuffix(baseName, ".yaml"))
+		default:
+			fmt.Printf("Status: Client Mode (Connected to: %s since %s)\n", networkName(snap.ActiveProfile), snap.LastConnected.Format(time.RFC1123))
+		}
+		if current == state.Degraded {
+			fmt.Println("Warning: The watchdog has seen connectivity checks fail.")
 		}
 		// Perform a quick internet check.
 		fmt.Println("Checking internet connectivity...")
-		if checkInternet() {
+		st, err := backend.Status()
+		if err != nil {
+			fmt.Printf("Warning: Could not read the interface status: %v\n", err)
+		}
+		report := probe.Diagnose(context.Background(), probe.FromConfig(cfg), st, cfg.Network.WirelessInterface)
+		for _, c := range report.Checks {
+			mark := "[ok]  "
+			switch {
+			case c.Skipped:
+				mark = "[skip]"
+			case !c.OK:
+				mark = "[fail]"
+			}
+			fmt.Printf("  %s %-8s %s: %s\n", mark, c.Layer, c.Name, c.Detail)
+		}
+		if report.Online() {
 			fmt.Println("Result: Internet connection is active.")
 		} else {
-			fmt.Println("Result: No internet connection detected.")
+			fmt.Printf("Result: No internet connection detected (%s).\n", report.Verdict)
 		}
-	} else {
-		// If the client config does not exist, we are in hotspot mode.
+		return nil
+	}
+	since, reason := machine.Since()
+	switch current {
+	case state.Connecting:
+		fmt.Printf("Status: Connecting (%s)\n", reason)
+	case state.Fallback:
+		fmt.Printf("Status: Hotspot Mode (fallback since %s: %s)\n", since.Format(time.RFC1123), reason)
+	default:
 		fmt.Println("Status: Hotspot Mode")
 	}
 	return nil
 }
 
-// ShowLastGood reads the symlink and prints the SSID it points to.
+// ShowLastGood prints the last-known-good network from the state file.
 func ShowLastGood() error {
-	target, err := os.Readlink(lastGoodSymlink)
+	machine, err := loadState()
 	if err != nil {
-		if os.IsNotExist(err) {
-			fmt.Println("No last-known-good network is set.")
-			return nil
-		}
-		return fmt.Errorf("could not read symlink: %w", err)
+		return err
 	}
-	// Extract the filename without the extension to show just the SSID.
-	ssid := strings.TrimSuffix(filepath.Base(target), ".yaml")
-	fmt.Printf("Last Good Network: %s\n", ssid)
+	lastGood := machine.LastGood()
+	if lastGood == "" {
+		fmt.Println("No last-known-good network is set.")
+		return nil
+	}
+	fmt.Printf("Last Good Network: %s\n", networkName(lastGood))
 	return nil
 }
 
-// ListSavedNetworks reads the contents of the saved networks directory.
+// ListSavedNetworks prints the saved network profiles.
 func ListSavedNetworks() error {
-	files, err := ioutil.ReadDir(savedNetworksDir)
+	saved, err := profiles.NewStore(savedNetworksDir).List()
 	if err != nil {
-		if os.IsNotExist(err) {
-			fmt.Println("No networks have been saved yet.")
-			return nil
-		}
-		return fmt.Errorf("could not read saved networks directory: %w", err)
+		return err
 	}
 
-	if len(files) == 0 {
+	if len(saved) == 0 {
 		fmt.Println("No networks have been saved yet.")
 		return nil
 	}
 
 	fmt.Println("Saved Networks:")
-	for _, file := range files {
-		if !file.IsDir() && filepath.Ext(file.Name()) == ".yaml" {
-			ssid := strings.TrimSuffix(file.Name(), ".yaml")
-			fmt.Printf("- %s\n", ssid)
-		}
+	for _, p := range saved {
+		fmt.Printf("- %s (priority %d)\n", p.SSID, p.Priority)
 	}
 	return nil
 }
 
-// SetLastGood updates the symlink to point to a different saved network profile.
-func SetLastGood(ssid string) error {
-	profilePath := filepath.Join(savedNetworksDir, ssid+".yaml")
+// SetPriority sets the auto-connect priority of a saved network. arg is
+// SSID=PRIORITY; the SSID may itself contain '='.
+func SetPriority(arg string) error {
+	i := strings.LastIndex(arg, "=")
+	if i < 0 {
+		return fmt.Errorf("expected SSID=PRIORITY, got %q", arg)
+	}
+	ssid := arg[:i]
+	priority, err := strconv.Atoi(arg[i+1:])
+	if err != nil {
+		return fmt.Errorf("priority must be a whole number, got %q", arg[i+1:])
+	}
+	profile, err := findProfile(ssid)
+	if err != nil {
+		return err
+	}
+	if err := profiles.NewStore(savedNetworksDir).SetPriority(profile.ID, priority); err != nil {
+		return err
+	}
+	fmt.Printf("Set the priority of %s to %d.\n", profile.SSID, priority)
+	return nil
+}
 
+// SetLastGood makes a different saved network profile the last-known-good one.
+func SetLastGood(ssid string) error {
 	// Check if the target profile actually exists.
-	if _, err := os.Stat(profilePath); os.IsNotExist(err) {
-		return fmt.Errorf("network profile for SSID '%s' does not exist", ssid)
+	profile, err := findProfile(ssid)
+	if err != nil {
+		return err
 	}
 
-	// Remove the old symlink if it exists.
-	_ = os.Remove(lastGoodSymlink)
-
-	// Create the new symlink.
-	if err := os.Symlink(profilePath, lastGoodSymlink); err != nil {
-		return fmt.Errorf("failed to create symlink: %w", err)
+	machine, err := loadState()
+	if err != nil {
+		return err
+	}
+	if err := machine.SetLastGood(profile.ID); err != nil {
+		return fmt.Errorf("failed to update state: %w", err)
 	}
 
 	fmt.Printf("Successfully set last-known-good network to: %s\n", ssid)
@@ -111,41 +218,67 @@ func SetLastGood(ssid string) error {
 
 // ForgetNetwork deletes a saved network profile.
 func ForgetNetwork(ssid string) error {
-	profilePath := filepath.Join(savedNetworksDir, ssid+".yaml")
-
-	// Check if we are about to delete the currently linked "last-good" network.
-	currentTarget, err := os.Readlink(lastGoodSymlink)
-	if err == nil && currentTarget == profilePath {
-		fmt.Println("Warning: This is the current last-known-good network. Removing symlink.")
-		if err := os.Remove(lastGoodSymlink); err != nil {
-			return fmt.Errorf("could not remove symlink: %w", err)
-		}
+	profile, err := findProfile(ssid)
+	if err != nil {
+		return err
+	}
+	machine, err := loadState()
+	if err != nil {
+		return err
+	}
+	// Check if we are about to delete the current "last-good" network.
+	if machine.LastGood() == profile.ID {
+		fmt.Println("Warning: This is the current last-known-good network. Clearing it.")
 	}
 
 	// Delete the profile file.
-	if err := os.Remove(profilePath); err != nil {
-		if os.IsNotExist(err) {
-			return fmt.Errorf("network profile for SSID '%s' does not exist", ssid)
-		}
-		return fmt.Errorf("failed to delete profile: %w", err)
+	if err := profiles.NewStore(savedNetworksDir).Delete(profile.ID); err != nil {
+		return err
+	}
+	if err := machine.ForgetProfile(profile.ID); err != nil {
+		return fmt.Errorf("failed to update state: %w", err)
 	}
 
 	fmt.Printf("Successfully forgot network: %s\n", ssid)
 	return nil
 }
 
-// checkInternet performs a simple DNS lookup to verify connectivity.
-func checkInternet() bool {
-	// Use a short timeout to avoid long waits.
-	resolver := net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			d := net.Dialer{
-				Timeout: 3 * time.Second,
-			}
-			return d.DialContext(ctx, "udp", "8.8.8.8:53")
-		},
+// findProfile looks up a saved network by SSID or profile ID.
+func findProfile(ssid string) (profiles.Profile, error) {
+	profile, err := profiles.NewStore(savedNetworksDir).Resolve(ssid)
+	if errors.Is(err, profiles.ErrNotFound) {
+		return profile, fmt.Errorf("network profile for SSID '%s' does not exist", ssid)
+	}
+	return profile, err
+}
+
+// SetAdminPassword sets the admin password that protects the portal and the
+// API, storing its bcrypt hash in the config file. An empty password turns
+// the login off. pifigo reads the hash at startup, so it must be restarted.
+func SetAdminPassword(configPath string) error {
+	password, err := readPassword()
+	if err != nil {
+		return err
 	}
-	_, err := resolver.LookupHost(context.Background(), "www.google.com")
-	return err == nil
+	hash := ""
+	if password != "" {
+		if len(password) < minAdminPasswordLength {
+			return fmt.Errorf("the password must be at least %d characters long", minAdminPasswordLength)
+		}
+		b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		hash = string(b)
+	}
+	if err := config.SetAdminPasswordHash(configPath, hash); err != nil {
+		return fmt.Errorf("could not update %s: %w", configPath, err)
+	}
+	if hash == "" {
+		fmt.Println("Admin password removed. The portal and the API are open to anyone on the hotspot.")
+	} else {
+		fmt.Println("Admin password set.")
+	}
+	fmt.Println("Restart pifigo for the change to take effect: sudo systemctl restart pifigo")
+	return nil
 }
@@ -4,10 +4,19 @@ import (
 	"bytes"
 	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"pifigo/internal/config"
+	"pifigo/internal/network"
+	"pifigo/internal/profiles"
+	"pifigo/internal/state"
 )
 
 // setupTestFS creates a temporary directory structure to simulate the real filesystem
@@ -16,12 +25,12 @@ func setupTestFS(t *testing.T) (string, func()) {
 	tmpDir := t.TempDir()
 	// Override the constants for the duration of the test
 	origSavedDir := savedNetworksDir
-	origSymlink := lastGoodSymlink
-	origActiveConfig := activeClientConfig
+	origSymlink := legacySymlink
+	origStateFile := stateFile
 
 	testSavedDir := filepath.Join(tmpDir, "saved_networks")
 	testSymlink := filepath.Join(tmpDir, "last-good-wifi.yaml")
-	testActiveConfig := filepath.Join(tmpDir, "99-pifigo-client.yaml")
+	testStateFile := filepath.Join(tmpDir, "state.json")
 
 	// Create the saved networks directory for tests
 	if err := os.MkdirAll(testSavedDir, 0755); err != nil {
@@ -30,13 +39,13 @@ func setupTestFS(t *testing.T) (string, func()) {
 
 	// Monkey-patch the global constants
 	savedNetworksDir = testSavedDir
-	lastGoodSymlink = testSymlink
-	activeClientConfig = testActiveConfig
+	legacySymlink = testSymlink
+	stateFile = testStateFile
 
 	cleanup := func() {
 		savedNetworksDir = origSavedDir
-		lastGoodSymlink = origSymlink
-		activeClientConfig = origActiveConfig
+		legacySymlink = origSymlink
+		stateFile = origStateFile
 	}
 
 	return tmpDir, cleanup
@@ -73,8 +82,9 @@ func TestCliFunctions(t *testing.T) {
 		}
 
 		// Add some networks
-		os.WriteFile(filepath.Join(savedNetworksDir, "HomeWiFi.yaml"), []byte("..."), 0644)
-		os.WriteFile(filepath.Join(savedNetworksDir, "OfficeWiFi.yaml"), []byte("..."), 0644)
+		store := profiles.NewStore(savedNetworksDir)
+		store.Save(profiles.New("HomeWiFi", "secret123"))
+		store.Save(profiles.New("OfficeWiFi", "secret456"))
 
 		output = captureOutput(func() {
 			if err := ListSavedNetworks(); err != nil {
@@ -86,6 +96,23 @@ func TestCliFunctions(t *testing.T) {
 		}
 	})
 
+	t.Run("SetPriority", func(t *testing.T) {
+		if err := SetPriority("HomeWiFi"); err == nil {
+			t.Error("Expected an error without a priority")
+		}
+		if err := SetPriority("GuestWiFi=5"); err == nil {
+			t.Error("Expected an error for a network that is not saved")
+		}
+		output := captureOutput(func() {
+			if err := SetPriority("HomeWiFi=10"); err != nil {
+				t.Fatalf("SetPriority failed: %v", err)
+			}
+		})
+		if p, _ := profiles.NewStore(savedNetworksDir).Find("HomeWiFi"); p.Priority != 10 {
+			t.Errorf("Expected priority 10 to be saved, got %d (output: %s)", p.Priority, output)
+		}
+	})
+
 	t.Run("SetAndShowLastGood", func(t *testing.T) {
 		// Test setting a non-existent network
 		err := SetLastGood("GuestWiFi")
@@ -99,10 +126,9 @@ func TestCliFunctions(t *testing.T) {
 			t.Fatalf("SetLastGood failed: %v", err)
 		}
 
-		// Check if the symlink is correct
-		target, _ := os.Readlink(lastGoodSymlink)
-		if filepath.Base(target) != "HomeWiFi.yaml" {
-			t.Errorf("Symlink points to wrong file: %s", target)
+		// Check that the state file was updated
+		if machine, _ := state.Load(stateFile); machine.LastGood() != profiles.ID("HomeWiFi") {
+			t.Errorf("State records the wrong last-good network: %s", machine.LastGood())
 		}
 
 		// Check the output of ShowLastGood
@@ -122,8 +148,8 @@ func TestCliFunctions(t *testing.T) {
 		if err != nil {
 			t.Fatalf("ForgetNetwork failed: %v", err)
 		}
-		if _, err := os.Stat(filepath.Join(savedNetworksDir, "OfficeWiFi.yaml")); !os.IsNotExist(err) {
-			t.Error("OfficeWiFi.yaml was not deleted")
+		if _, err := os.Stat(filepath.Join(savedNetworksDir, profiles.ID("OfficeWiFi")+".yaml")); !os.IsNotExist(err) {
+			t.Error("The OfficeWiFi profile was not deleted")
 		}
 
 		// Forget the network that IS the last-good
@@ -131,18 +157,44 @@ func TestCliFunctions(t *testing.T) {
 		if err != nil {
 			t.Fatalf("ForgetNetwork failed: %v", err)
 		}
-		if _, err := os.Stat(filepath.Join(savedNetworksDir, "HomeWiFi.yaml")); !os.IsNotExist(err) {
-			t.Error("HomeWiFi.yaml was not deleted")
+		if _, err := os.Stat(filepath.Join(savedNetworksDir, profiles.ID("HomeWiFi")+".yaml")); !os.IsNotExist(err) {
+			t.Error("The HomeWiFi profile was not deleted")
 		}
-		if _, err := os.Lstat(lastGoodSymlink); !os.IsNotExist(err) {
-			t.Error("Symlink was not deleted when its target was forgotten")
+		if machine, _ := state.Load(stateFile); machine.LastGood() != "" {
+			t.Error("Last-good network was not cleared when it was forgotten")
+		}
+	})
+
+	t.Run("MigrateSymlink", func(t *testing.T) {
+		os.Remove(stateFile)
+		profile := filepath.Join(savedNetworksDir, "OldWiFi.yaml")
+		os.WriteFile(profile, []byte("..."), 0644)
+		os.Symlink(profile, legacySymlink)
+
+		output := captureOutput(func() {
+			if err := ShowLastGood(); err != nil {
+				t.Fatalf("ShowLastGood failed: %v", err)
+			}
+		})
+		if !strings.Contains(output, "Last Good Network: OldWiFi") {
+			t.Errorf("Expected the symlink to be migrated, got: %s", output)
+		}
+		if _, err := os.Lstat(legacySymlink); !os.IsNotExist(err) {
+			t.Error("The legacy symlink should be removed after migration")
 		}
 	})
 
 	t.Run("ShowStatus", func(t *testing.T) {
+		online := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer online.Close()
+		cfg := &config.Config{}
+		cfg.Watchdog.Probes = []config.ProbeConfig{{Type: "http", Target: online.URL}, {Type: "tcp", Target: "127.0.0.1:1"}}
+
 		// Test hotspot mode status
 		output := captureOutput(func() {
-			if err := ShowStatus(); err != nil {
+			if err := ShowStatus(cfg, network.NewFake()); err != nil {
 				log.Fatalf("ShowStatus failed: %v", err)
 			}
 		})
@@ -151,15 +203,52 @@ func TestCliFunctions(t *testing.T) {
 		}
 
 		// Test client mode status
-		os.WriteFile(activeClientConfig, []byte("..."), 0644)
+		machine, _ := state.Load(stateFile)
+		machine.Force(state.Client, "test")
 		output = captureOutput(func() {
-			if err := ShowStatus(); err != nil {
+			if err := ShowStatus(cfg, network.NewFake()); err != nil {
 				log.Fatalf("ShowStatus failed: %v", err)
 			}
 		})
 		if !strings.Contains(output, "Status: Client Mode") {
 			t.Errorf("Expected 'Client Mode', got: %s", output)
 		}
-		os.Remove(activeClientConfig)
+		// One passing probe is enough in the default mode.
+		if !strings.Contains(output, "[ok]   internet http "+online.URL) || !strings.Contains(output, "[fail] internet tcp 127.0.0.1:1") || !strings.Contains(output, "[fail] link     associated") || !strings.Contains(output, "Internet connection is active") {
+			t.Errorf("Expected the probe results, got: %s", output)
+		}
+		os.Remove(stateFile)
+	})
+	t.Run("SetAdminPassword", func(t *testing.T) {
+		configPath := filepath.Join(t.TempDir(), "config.yaml")
+		os.WriteFile(configPath, []byte("language: en\n"), 0644)
+		origRead := readPassword
+		defer func() { readPassword = origRead }()
+		setPassword := func(password string) error {
+			readPassword = func() (string, error) { return password, nil }
+			var err error
+			captureOutput(func() { err = SetAdminPassword(configPath) })
+			return err
+		}
+		loadHash := func() string {
+			cfg, err := config.LoadConfig(configPath)
+			if err != nil {
+				t.Fatalf("Failed to load the config: %v", err)
+			}
+			return cfg.Admin.PasswordHash
+		}
+
+		if err := setPassword("short"); err == nil || loadHash() != "" {
+			t.Error("Expected a short password to be refused")
+		}
+		if err := setPassword("correct horse"); err != nil {
+			t.Fatalf("SetAdminPassword failed: %v", err)
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(loadHash()), []byte("correct horse")); err != nil {
+			t.Errorf("Stored hash does not match the password: %v", err)
+		}
+		if err := setPassword(""); err != nil || loadHash() != "" {
+			t.Errorf("Expected an empty password to remove the hash, got %v", err)
+		}
 	})
 }
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SetAdminPasswordHash writes admin.password_hash to the YAML file at path.
+// Only that value is changed, so the layout and comments of a hand-edited
+// file are kept.
+func SetAdminPasswordHash(path, hash string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s is not a YAML mapping", path)
+	}
+
+	quoted := strconv.Quote(hash) // bcrypt hashes need no escaping.
+	admin := mappingValue(root, "admin")
+	value := mappingValue(admin, "password_hash")
+	switch {
+	case admin == nil:
+		// No admin section yet: add one at the end.
+		if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+			data = append(data, '\n')
+		}
+		data = append(data, "\nadmin:\n  password_hash: "+quoted+"\n"...)
+	case value != nil && value.Kind == yaml.ScalarNode && admin.Style&yaml.FlowStyle == 0:
+		// Replace the value on its line, keeping any comment after it.
+		lines := strings.SplitAfter(string(data), "\n")
+		line := lines[value.Line-1]
+		replaced := line[:value.Column-1] + quoted
+		if value.LineComment != "" {
+			replaced += " " + value.LineComment
+		}
+		if strings.HasSuffix(line, "\n") {
+			replaced += "\n"
+		}
+		lines[value.Line-1] = replaced
+		data = []byte(strings.Join(lines, ""))
+	default:
+		// An unusual layout: rewrite the whole document.
+		if admin.Kind != yaml.MappingNode {
+			*admin = yaml.Node{Kind: yaml.MappingNode}
+		}
+		if value == nil {
+			admin.Content = append(admin.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "password_hash"}, &yaml.Node{Kind: yaml.ScalarNode})
+			value = admin.Content[len(admin.Content)-1]
+		}
+		*value = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: hash, Style: yaml.DoubleQuotedStyle}
+		var out bytes.Buffer
+		enc := yaml.NewEncoder(&out)
+		enc.SetIndent(2)
+		if err := enc.Encode(&doc); err != nil {
+			return err
+		}
+		enc.Close()
+		data = out.Bytes()
+	}
+	return replaceFile(path, data)
+}
+
+// mappingValue returns the value of key in a mapping node, or nil.
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// replaceFile atomically replaces the file at path, keeping its mode, so a
+// crash cannot leave half a config.
+func replaceFile(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".config-*.yaml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
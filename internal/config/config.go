@@ -18,11 +18,27 @@ type Config struct {
 		CheckIntervalSeconds int    `yaml:"check_interval_seconds"`
 		FailureThreshold     int    `yaml:"failure_threshold"`
 		CheckURL             string `yaml:"check_url"`
+		// Escalation lists the recovery steps taken, in order, once the
+		// failure threshold is reached. Empty means the default ladder.
+		Escalation          []string `yaml:"escalation"`
+		BackoffMaxSeconds   int      `yaml:"backoff_max_seconds"`
+		HotspotRetrySeconds int      `yaml:"hotspot_retry_seconds"` // 0 disables retrying client mode from the hotspot.
+		PortalIdleSeconds   int      `yaml:"portal_idle_seconds"`
+		// Probes decide whether the device is online; ProbeMode combines
+		// them. Without probes, check_url is probed over HTTP.
+		Probes      []ProbeConfig `yaml:"probes"`
+		ProbeMode   string        `yaml:"probe_mode"`   // any, all or quorum; defaults to any.
+		ProbeQuorum int           `yaml:"probe_quorum"` // Passing probes needed in quorum mode; defaults to a majority.
 	} `yaml:"watchdog"`
 
+	// Scan holds settings for the background Wi-Fi scanner.
+	Scan struct {
+		IntervalSeconds int `yaml:"interval_seconds"`
+	} `yaml:"scan"`
+
 	// Paths specifies the file system locations for web assets and locales.
 	Paths struct {
-		WebRoot    string `yaml:"web_root"`
+		WebRoot    string `yaml:"web_root"` // Overrides the pages built into the binary when set.
 		LocalesDir string `yaml:"locales_dir"`
 	} `yaml:"paths"`
 
@@ -35,8 +51,9 @@ type Config struct {
 
 	// Network contains settings for the Wi-Fi hotspot and device hostname.
 	Network struct {
+		Backend           string   `yaml:"backend"`
 		ApSSID            string   `yaml:"ap_ssid"`
-		ApPassword        string   `yaml:"ap_password"`
+		ApPassword        string   `yaml:"ap_password" json:"-"` // Secret; never served.
 		ApChannel         int      `yaml:"ap_channel"`
 		ApIpAddress       string   `yaml:"ap_ip_address"`
 		WifiCountry       string   `yaml:"wifi_country"`
@@ -46,12 +63,35 @@ type Config struct {
 		StaticIP          string   `yaml:"static_ip"`
 		Gateway           string   `yaml:"gateway"`
 		DNSServers        []string `yaml:"dns_servers"`
+
+		ConnectTimeoutSeconds int  `yaml:"connect_timeout_seconds"`
+		ValidateCredentials   bool `yaml:"validate_credentials"`
+		EncryptProfiles       bool `yaml:"encrypt_profiles"`
 	} `yaml:"network"`
 
+	// Admin protects the portal and the API with a password. Without a
+	// password hash both are open to anyone on the hotspot.
+	Admin struct {
+		PasswordHash   string `yaml:"password_hash" json:"-"` // bcrypt hash, set with 'pifigo passwd'; never served.
+		SessionMinutes int    `yaml:"session_minutes"`        // How long a login lasts; defaults to 60.
+	} `yaml:"admin"`
+
 	// Language sets the default language for the web interface.
 	Language string `yaml:"language"`
 }
 
+// ProbeConfig describes one connectivity probe. Target is the URL for http,
+// the name to resolve for dns, host:port for tcp and the host for icmp; the
+// gateway probe pings the default gateway and needs no target.
+type ProbeConfig struct {
+	Type           string `yaml:"type"`
+	Target         string `yaml:"target"`
+	Server         string `yaml:"server"`        // dns: resolver to ask; the system resolver if empty.
+	ExpectStatus   int    `yaml:"expect_status"` // http: required status; any 2xx if 0.
+	ExpectBody     string `yaml:"expect_body"`   // http: text the response body must contain.
+	TimeoutSeconds int    `yaml:"timeout_seconds"`
+}
+
 // LoadConfig reads and parses the YAML configuration file from a given path.
 func LoadConfig(path string) (*Config, error) {
 	var cfg Config
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -59,3 +60,38 @@ network:
 		t.Errorf("LoadConfig succeeded with a non-existent file, but an error was expected")
 	}
 }
+
+func TestSetAdminPasswordHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	original := `# Top comment.
+network:
+  ap_ssid: "PiFigoSetup" # Hotspot name.
+language: "en"
+`
+	os.WriteFile(path, []byte(original), 0600)
+
+	if err := SetAdminPasswordHash(path, "$2a$10$abc"); err != nil {
+		t.Fatalf("SetAdminPasswordHash failed: %v", err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Config no longer loads: %v", err)
+	}
+	if cfg.Admin.PasswordHash != "$2a$10$abc" || cfg.Network.ApSSID != "PiFigoSetup" || cfg.Language != "en" {
+		t.Errorf("Unexpected config after setting the hash: %+v", cfg)
+	}
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), "# Top comment.") || !strings.Contains(string(data), "# Hotspot name.") {
+		t.Errorf("Expected comments to be kept, got:\n%s", data)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the file mode to be kept, got %v", info.Mode().Perm())
+	}
+
+	// An existing hash is replaced rather than duplicated.
+	SetAdminPasswordHash(path, "")
+	data, _ = os.ReadFile(path)
+	if cfg, _ := LoadConfig(path); cfg.Admin.PasswordHash != "" || strings.Count(string(data), "password_hash") != 1 {
+		t.Errorf("Expected the hash to be cleared in place, got:\n%s", data)
+	}
+}
@@ -0,0 +1,78 @@
+// Package daemon runs pifigo's long-lived services (the boot manager, the
+// watchdog and the web portal) and stops them together, so the daemon can
+// shut down cleanly on a signal and tests can run it in-process.
+package daemon
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"pifigo/internal/bootmanager"
+	"pifigo/internal/config"
+	"pifigo/internal/network"
+	"pifigo/internal/state"
+	"pifigo/internal/watchdog"
+	"pifigo/server"
+)
+
+// Use var instead of const to allow them to be modified during testing.
+var (
+	StatePath     = state.DefaultPath
+	LegacySymlink = state.LegacySymlink
+	ListenAddr    = server.DefaultAddr
+)
+
+// Run prepares the device and runs every service until ctx is done, then
+// waits for them all to stop. It returns an error if the web server could
+// not start or failed.
+func Run(ctx context.Context, cfg *config.Config, backend network.NetworkBackend) error {
+	// Sync the hotspot configuration on every start.
+	if err := bootmanager.SyncHotspotConfig(cfg, backend); err != nil {
+		// Not fatal: the service can continue with the old config.
+		log.Printf("WARNING: Could not sync hotspot configuration: %v", err)
+	}
+
+	// The state machine is the single source of truth for the connection
+	// mode. Reconcile it with the backend in case the network changed while
+	// pifigo was not running.
+	machine, err := state.Load(StatePath)
+	if err != nil {
+		log.Printf("WARNING: %v. Starting from hotspot mode.", err)
+		machine = state.New(StatePath)
+	}
+	if err := machine.MigrateSymlink(LegacySymlink); err != nil {
+		log.Printf("WARNING: Could not migrate the last-good network: %v", err)
+	}
+	bootmanager.MigrateProfiles(cfg, machine)
+	bootmanager.SyncState(backend, machine)
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	// If the web server stops, the other services are stopped with it.
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	goService := func(run func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run()
+		}()
+	}
+
+	// The web server is created first, so the watchdog can tell when the
+	// portal is in use.
+	srv := server.NewServer(cfg, backend, machine)
+	srv.Addr = ListenAddr
+
+	goService(func() { bootmanager.Start(ctx, cfg, backend, machine) })
+	if cfg.Watchdog.Enabled {
+		goService(func() { watchdog.Start(ctx, cfg, backend, machine, srv.PortalIdle) })
+	} else {
+		log.Println("Watchdog is disabled in the configuration.")
+	}
+
+	return srv.Start(ctx)
+}
@@ -0,0 +1,142 @@
+package daemon
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"pifigo/internal/bootmanager"
+	"pifigo/internal/config"
+	"pifigo/internal/network"
+	"pifigo/internal/scan"
+)
+
+// setupDaemon points every path the daemon touches at a temporary directory,
+// stubs out scanning and returns a config that starts all services.
+func setupDaemon(t *testing.T) *config.Config {
+	tmpDir := t.TempDir()
+	originals := []*string{&StatePath, &LegacySymlink, &ListenAddr, &bootmanager.HotspotConfigFile, &bootmanager.HostapdConfigFile, &bootmanager.DnsmasqConfigFile, &bootmanager.SavedNetworksDir}
+	saved := make([]string, len(originals))
+	for i, p := range originals {
+		saved[i] = *p
+	}
+	t.Cleanup(func() {
+		for i, p := range originals {
+			*p = saved[i]
+		}
+	})
+	StatePath = filepath.Join(tmpDir, "state.json")
+	LegacySymlink = filepath.Join(tmpDir, "last-good-wifi.yaml")
+	ListenAddr = freeAddr(t)
+	bootmanager.HotspotConfigFile = filepath.Join(tmpDir, "hotspot.yaml")
+	bootmanager.HostapdConfigFile = filepath.Join(tmpDir, "hostapd.conf")
+	bootmanager.DnsmasqConfigFile = filepath.Join(tmpDir, "dnsmasq.conf")
+	bootmanager.SavedNetworksDir = filepath.Join(tmpDir, "saved_networks")
+
+	originalExec := scan.ExecCommand
+	scan.ExecCommand = func(string, ...string) *exec.Cmd { return exec.Command("/bin/true") }
+	t.Cleanup(func() { scan.ExecCommand = originalExec })
+
+	webRoot := filepath.Join(tmpDir, "www")
+	os.MkdirAll(webRoot, 0755)
+	os.WriteFile(filepath.Join(webRoot, "index.html"), []byte("<html>pifigo</html>"), 0644)
+
+	cfg := &config.Config{}
+	cfg.Paths.WebRoot = webRoot
+	cfg.Network.WirelessInterface = "wlan_test"
+	cfg.Network.ApSSID = "TestHotspot"
+	cfg.Network.ApPassword = "testpassword"
+	cfg.Network.ApIpAddress = "192.168.100.1/24"
+	cfg.BootManager.TimeoutSeconds = 3600
+	cfg.Watchdog.Enabled = true
+	return cfg
+}
+
+// freeAddr returns a loopback address that was free a moment ago.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// get fetches a path from the daemon, retrying while it starts up.
+func get(t *testing.T, path string) (int, string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get("http://" + ListenAddr + path)
+		if err == nil {
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			return resp.StatusCode, string(body)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Daemon did not answer: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestRun verifies the daemon serves the portal and that cancelling its
+// context stops every service.
+func TestRun(t *testing.T) {
+	cfg := setupDaemon(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- Run(ctx, cfg, network.NewFake()) }()
+
+	if code, body := get(t, "/"); code != http.StatusOK || !strings.Contains(body, "pifigo") {
+		t.Errorf("Unexpected index: %d %s", code, body)
+	}
+	if code, body := get(t, "/api/v1/health"); code != http.StatusOK || !strings.Contains(body, `"state":"hotspot"`) {
+		t.Errorf("Unexpected health: %d %s", code, body)
+	}
+	if _, err := os.Stat(bootmanager.HostapdConfigFile); err != nil {
+		t.Errorf("Expected the hotspot config to be synced: %v", err)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run returned an error on shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Daemon did not stop after its context was cancelled")
+	}
+	if _, err := net.Dial("tcp", ListenAddr); err == nil {
+		t.Error("Expected the web server to stop listening")
+	}
+}
+
+// TestRunListenError verifies a port that is already taken is reported
+// instead of ending the process.
+func TestRunListenError(t *testing.T) {
+	cfg := setupDaemon(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	ListenAddr = ln.Addr().String()
+
+	done := make(chan error, 1)
+	go func() { done <- Run(context.Background(), cfg, network.NewFake()) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected an error for a port in use")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after failing to listen")
+	}
+}
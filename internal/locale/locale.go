@@ -25,6 +25,47 @@ type LanguageStrings struct {
 	SavedConnectionsLabel     string `yaml:"saved_connections_label"`
 	ReconnectButtonText       string `yaml:"reconnect_button_text"`
 	NoSavedConnectionsMessage string `yaml:"no_saved_connections_message"`
+
+	// Shown when the last connection attempt was rolled back
+	LastFailureMessage string `yaml:"last_failure_message"`
+
+	// Shown next to the checkbox for networks that do not broadcast their SSID
+	HiddenNetworkLabel string `yaml:"hidden_network_label"`
+
+	// Heading and states of the connection health card
+	HealthLabel      string `yaml:"health_label"`
+	HealthOnline     string `yaml:"health_online"`
+	HealthOffline    string `yaml:"health_offline"`
+	HealthConnecting string `yaml:"health_connecting"`
+	HealthHotspot    string `yaml:"health_hotspot"`
+
+	// Per-network IP settings on the connect form
+	IpSettingsLabel string `yaml:"ip_settings_label"`
+	IpModeDefault   string `yaml:"ip_mode_default"`
+	IpModeDhcp      string `yaml:"ip_mode_dhcp"`
+	IpModeStatic    string `yaml:"ip_mode_static"`
+	StaticIpLabel   string `yaml:"static_ip_label"`
+	GatewayLabel    string `yaml:"gateway_label"`
+	DnsLabel        string `yaml:"dns_label"`
+
+	// Enterprise (802.1X) settings on the connect form
+	SecurityLabel          string `yaml:"security_label"`
+	SecurityPersonal       string `yaml:"security_personal"`
+	SecurityEnterprise     string `yaml:"security_enterprise"`
+	EapMethodLabel         string `yaml:"eap_method_label"`
+	IdentityLabel          string `yaml:"identity_label"`
+	AnonymousIdentityLabel string `yaml:"anonymous_identity_label"`
+	Phase2Label            string `yaml:"phase2_label"`
+	CaCertLabel            string `yaml:"ca_cert_label"`
+	ClientCertLabel        string `yaml:"client_cert_label"`
+	ClientKeyLabel         string `yaml:"client_key_label"`
+	ClientKeyPasswordLabel string `yaml:"client_key_password_label"`
+
+	// Admin login page and logout button
+	LoginHeading       string `yaml:"login_heading"`
+	AdminPasswordLabel string `yaml:"admin_password_label"`
+	LoginButtonText    string `yaml:"login_button_text"`
+	LogoutButtonText   string `yaml:"logout_button_text"`
 }
 
 // LoadLanguageStrings loads the specified language file from a given path.
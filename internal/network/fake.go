@@ -0,0 +1,119 @@
+package network
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Fake is an in-memory NetworkBackend for tests. It records every call and
+// never touches the host.
+type Fake struct {
+	mu     sync.Mutex
+	calls  []string
+	config ClientConfig
+	mode   Mode
+
+	// Err, when set, is returned by every mutating call.
+	Err error
+	// NoAssociation and NoLease make client mode report a link that never
+	// associates, or associates without an IP address.
+	NoAssociation bool
+	NoLease       bool
+}
+
+// NewFake returns a Fake that starts in hotspot mode.
+func NewFake() *Fake {
+	return &Fake{mode: ModeHotspot}
+}
+
+// Name implements NetworkBackend.
+func (f *Fake) Name() string { return "fake" }
+
+// Render returns a trivial profile that embeds the SSID.
+func (f *Fake) Render(c ClientConfig) ([]byte, error) {
+	f.record("Render")
+	return []byte(fmt.Sprintf("ssid: %s\n", c.SSID)), nil
+}
+
+// Connect records the network and switches to client mode.
+func (f *Fake) Connect(c ClientConfig) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "Connect")
+	if f.Err != nil {
+		return f.Err
+	}
+	f.config = c
+	f.mode = ModeClient
+	return nil
+}
+
+// Disconnect implements NetworkBackend.
+func (f *Fake) Disconnect() error { return f.setMode("Disconnect", ModeHotspot) }
+
+// StartHotspot implements NetworkBackend.
+func (f *Fake) StartHotspot() error { return f.setMode("StartHotspot", ModeHotspot) }
+
+// StopHotspot implements NetworkBackend.
+func (f *Fake) StopHotspot() error {
+	f.record("StopHotspot")
+	return f.Err
+}
+
+// Reassociate implements Recoverer.
+func (f *Fake) Reassociate() error {
+	f.record("Reassociate")
+	return f.Err
+}
+
+// Restart implements Recoverer.
+func (f *Fake) Restart() error {
+	f.record("Restart")
+	return f.Err
+}
+
+// Status implements NetworkBackend. In client mode the link is associated
+// and leased unless NoAssociation or NoLease is set.
+func (f *Fake) Status() (Status, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st := Status{Backend: "fake", Mode: f.mode}
+	if f.mode == ModeClient {
+		st.Associated = !f.NoAssociation
+		if st.Associated && !f.NoLease {
+			st.IPAddress = "192.0.2.10"
+		}
+	}
+	return st, nil
+}
+
+// Calls returns the names of the methods called so far, in order.
+func (f *Fake) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// Config returns the network passed to the most recent successful Connect.
+func (f *Fake) Config() ClientConfig {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.config
+}
+
+func (f *Fake) setMode(call string, mode Mode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+	if f.Err != nil {
+		return f.Err
+	}
+	f.mode = mode
+	return nil
+}
+
+func (f *Fake) record(call string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+}
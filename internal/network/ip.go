@@ -0,0 +1,104 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"pifigo/internal/config"
+)
+
+// IP modes for a client network.
+const (
+	IPModeDHCP   = "dhcp"
+	IPModeStatic = "static"
+)
+
+// maxDNSServers is the number of name servers the resolver will use.
+const maxDNSServers = 3
+
+// IPConfig is the addressing used on a client network. An empty Mode means
+// the backend's default, taken from network.connection_mode in config.yaml.
+type IPConfig struct {
+	Mode    string
+	Address string // IPv4 address with prefix length, e.g. 192.168.1.150/24.
+	Gateway string
+	DNS     []string
+}
+
+// DefaultIP returns the addressing configured in config.yaml, used for
+// networks that do not set their own. Its DNS servers are kept in DHCP mode
+// too, for static networks that set none.
+func DefaultIP(cfg *config.Config) IPConfig {
+	if cfg.Network.ConnectionMode != IPModeStatic {
+		return IPConfig{Mode: IPModeDHCP, DNS: cfg.Network.DNSServers}
+	}
+	return IPConfig{
+		Mode:    IPModeStatic,
+		Address: cfg.Network.StaticIP,
+		Gateway: cfg.Network.Gateway,
+		DNS:     cfg.Network.DNSServers,
+	}
+}
+
+// Or returns ip, or def if ip does not set a mode. Static settings without
+// DNS servers use those of def.
+func (ip IPConfig) Or(def IPConfig) IPConfig {
+	if ip.Mode == "" {
+		return def
+	}
+	if ip.Mode == IPModeStatic && len(ip.DNS) == 0 {
+		ip.DNS = def.DNS
+	}
+	return ip
+}
+
+// Validate checks that the settings can be applied. Only static settings are
+// checked; DHCP ignores them.
+func (ip IPConfig) Validate() error {
+	switch ip.Mode {
+	case "", IPModeDHCP:
+		return nil
+	case IPModeStatic:
+	default:
+		return fmt.Errorf("unknown IP mode %q", ip.Mode)
+	}
+	prefix, err := netip.ParsePrefix(ip.Address)
+	if err != nil || !prefix.Addr().Is4() {
+		return fmt.Errorf("static address %q must be an IPv4 address with a prefix length, such as 192.168.1.150/24", ip.Address)
+	}
+	if prefix.Bits() == 0 || prefix.Bits() > 30 {
+		return fmt.Errorf("prefix length /%d leaves no room for a gateway", prefix.Bits())
+	}
+	if prefix.Addr() == prefix.Masked().Addr() || prefix.Addr() == broadcast(prefix) {
+		return fmt.Errorf("static address %s is the network or broadcast address", prefix.Addr())
+	}
+	gateway, err := netip.ParseAddr(ip.Gateway)
+	if err != nil || !gateway.Is4() {
+		return fmt.Errorf("gateway %q must be an IPv4 address", ip.Gateway)
+	}
+	if !prefix.Contains(gateway) {
+		return fmt.Errorf("gateway %s is not on the %s network", gateway, prefix.Masked())
+	}
+	if gateway == prefix.Addr() {
+		return errors.New("gateway cannot be the device's own address")
+	}
+	if len(ip.DNS) > maxDNSServers {
+		return fmt.Errorf("at most %d DNS servers can be used", maxDNSServers)
+	}
+	for _, server := range ip.DNS {
+		if _, err := netip.ParseAddr(server); err != nil {
+			return fmt.Errorf("DNS server %q is not an IP address", server)
+		}
+	}
+	return nil
+}
+
+// broadcast returns the last address of an IPv4 prefix.
+func broadcast(p netip.Prefix) netip.Addr {
+	a := p.Masked().Addr().As4()
+	n := binary.BigEndian.Uint32(a[:]) | (1<<(32-p.Bits()) - 1)
+	binary.BigEndian.PutUint32(a[:], n)
+	return netip.AddrFrom4(a)
+}
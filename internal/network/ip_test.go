@@ -0,0 +1,67 @@
+package network
+
+import (
+	"testing"
+
+	"pifigo/internal/config"
+)
+
+func TestIPConfigValidate(t *testing.T) {
+	static := func(address, gateway string, dns ...string) IPConfig {
+		return IPConfig{Mode: IPModeStatic, Address: address, Gateway: gateway, DNS: dns}
+	}
+	tests := []struct {
+		name string
+		ip   IPConfig
+		ok   bool
+	}{
+		{"dhcp", IPConfig{Mode: IPModeDHCP}, true},
+		{"default", IPConfig{}, true},
+		{"static", static("192.168.1.150/24", "192.168.1.1", "8.8.8.8", "1.1.1.1"), true},
+		{"unknown mode", IPConfig{Mode: "bootp"}, false},
+		{"no prefix", static("192.168.1.150", "192.168.1.1"), false},
+		{"ipv6", static("fd00::2/64", "fd00::1"), false},
+		{"network address", static("192.168.1.0/24", "192.168.1.1"), false},
+		{"broadcast address", static("192.168.1.255/24", "192.168.1.1"), false},
+		{"gateway off subnet", static("192.168.1.150/24", "10.0.0.1"), false},
+		{"gateway is self", static("192.168.1.150/24", "192.168.1.150"), false},
+		{"missing gateway", static("192.168.1.150/24", ""), false},
+		{"bad dns", static("192.168.1.150/24", "192.168.1.1", "dns.google"), false},
+		{"too many dns", static("192.168.1.150/24", "192.168.1.1", "1.1.1.1", "1.0.0.1", "8.8.8.8", "8.8.4.4"), false},
+	}
+	for _, tc := range tests {
+		if err := tc.ip.Validate(); (err == nil) != tc.ok {
+			t.Errorf("%s: Validate() = %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestDefaultIP(t *testing.T) {
+	cfg := &config.Config{}
+	if ip := DefaultIP(cfg); ip.Mode != IPModeDHCP {
+		t.Errorf("Expected DHCP when no connection mode is set, got %+v", ip)
+	}
+	cfg.Network.ConnectionMode = IPModeStatic
+	cfg.Network.StaticIP = "192.168.1.150/24"
+	cfg.Network.Gateway = "192.168.1.1"
+	def := DefaultIP(cfg)
+	if got := (IPConfig{}).Or(def); got.Address != "192.168.1.150/24" {
+		t.Errorf("Expected a network without settings to use the default, got %+v", got)
+	}
+	if got := (IPConfig{Mode: IPModeDHCP}).Or(def); got.Mode != IPModeDHCP {
+		t.Errorf("Expected a network's own settings to win, got %+v", got)
+	}
+
+	// A static network without DNS servers uses the configured ones, also
+	// when the device defaults to DHCP.
+	cfg.Network.ConnectionMode = IPModeDHCP
+	cfg.Network.DNSServers = []string{"1.1.1.1"}
+	static := IPConfig{Mode: IPModeStatic, Address: "10.0.0.5/24", Gateway: "10.0.0.1"}
+	if got := static.Or(DefaultIP(cfg)); len(got.DNS) != 1 || got.DNS[0] != "1.1.1.1" || got.Address != static.Address {
+		t.Errorf("Expected the configured DNS servers, got %+v", got)
+	}
+	static.DNS = []string{"8.8.8.8"}
+	if got := static.Or(DefaultIP(cfg)); got.DNS[0] != "8.8.8.8" {
+		t.Errorf("Expected the network's own DNS servers to win, got %+v", got)
+	}
+}
@@ -0,0 +1,170 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+
+	"pifigo/internal/config"
+)
+
+// Default locations used by the netplan backend.
+const (
+	NetplanTemplate     = "/etc/pifigo/netplan.tpl"
+	NetplanClientConfig = "/etc/netplan/99-pifigo-client.yaml"
+)
+
+// Netplan drives the network through netplan, with hostapd and dnsmasq
+// providing the hotspot.
+type Netplan struct {
+	Interface    string
+	TemplatePath string
+	ClientConfig string
+	DefaultIP    IPConfig
+}
+
+// NewNetplan returns a netplan backend using the standard file locations.
+func NewNetplan(cfg *config.Config) *Netplan {
+	return &Netplan{
+		Interface:    cfg.Network.WirelessInterface,
+		TemplatePath: NetplanTemplate,
+		ClientConfig: NetplanClientConfig,
+		DefaultIP:    DefaultIP(cfg),
+	}
+}
+
+// Name implements NetworkBackend.
+func (n *Netplan) Name() string { return BackendNetplan }
+
+// Render executes the netplan template for the given network. The template
+// sees the addressing under the config.yaml names it has always used.
+func (n *Netplan) Render(c ClientConfig) ([]byte, error) {
+	ip := c.IP.Or(n.DefaultIP)
+	if err := ip.Validate(); err != nil {
+		return nil, err
+	}
+	security, err := c.security()
+	if err != nil {
+		return nil, err
+	}
+	var phase2 string
+	if c.EAP != nil {
+		phase2 = c.EAP.phase2()
+	}
+	tmpl, err := template.New(filepath.Base(n.TemplatePath)).Funcs(template.FuncMap{"quote": strconv.Quote}).ParseFiles(n.TemplatePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse netplan template: %w", err)
+	}
+	data := struct {
+		SSID, Password, WirelessInterface string
+		Security                          string
+		Hidden                            bool
+		ConnectionMode, StaticIP, Gateway string
+		DNSServers                        []string
+		EAP                               *EAPConfig
+		Phase2                            string
+	}{c.SSID, c.Password, n.Interface, security, c.Hidden, ip.Mode, ip.Address, ip.Gateway, ip.DNS, c.EAP, phase2}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to execute netplan template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Connect renders the client network and applies it.
+func (n *Netplan) Connect(c ClientConfig) error {
+	profile, err := n.Render(c)
+	if err != nil {
+		return err
+	}
+	return n.apply(profile)
+}
+
+// apply writes the profile as the active client config and applies it.
+func (n *Netplan) apply(profile []byte) error {
+	// The config holds the Wi-Fi password, and netplan warns about
+	// configs other users can read.
+	if err := os.WriteFile(n.ClientConfig, profile, 0600); err != nil {
+		return fmt.Errorf("failed to write active netplan config: %w", err)
+	}
+	if err := os.Chmod(n.ClientConfig, 0600); err != nil {
+		return fmt.Errorf("failed to restrict active netplan config: %w", err)
+	}
+	if err := n.StopHotspot(); err != nil {
+		return err
+	}
+	return run("netplan", "apply")
+}
+
+// Disconnect removes the client config and re-applies netplan, which leaves
+// only the static hotspot address on the interface.
+func (n *Netplan) Disconnect() error {
+	if err := os.Remove(n.ClientConfig); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove active netplan config: %w", err)
+	}
+	return run("netplan", "apply")
+}
+
+// StartHotspot disconnects from any client network and restarts the
+// services that depend on the static hotspot address.
+func (n *Netplan) StartHotspot() error {
+	if err := n.Disconnect(); err != nil {
+		return err
+	}
+	return run("systemctl", "restart", "hostapd", "dnsmasq")
+}
+
+// StopHotspot stops hostapd and dnsmasq.
+func (n *Netplan) StopHotspot() error {
+	return run("systemctl", "stop", "hostapd", "dnsmasq")
+}
+
+// Reassociate re-applies the client config, which makes the renderer rejoin
+// the network.
+func (n *Netplan) Reassociate() error {
+	return run("netplan", "apply")
+}
+
+// Restart restarts the service of the renderer the client config names and
+// re-applies netplan so the restarted service picks the network up again.
+func (n *Netplan) Restart() error {
+	if err := run("systemctl", "restart", n.rendererService()); err != nil {
+		return err
+	}
+	return run("netplan", "apply")
+}
+
+// rendererService returns the systemd unit of the renderer declared in the
+// client config, defaulting to networkd as netplan itself does.
+func (n *Netplan) rendererService() string {
+	var doc struct {
+		Network struct {
+			Renderer string `yaml:"renderer"`
+		} `yaml:"network"`
+	}
+	if data, err := os.ReadFile(n.ClientConfig); err == nil {
+		yaml.Unmarshal(data, &doc)
+	}
+	if doc.Network.Renderer == "NetworkManager" {
+		return "NetworkManager"
+	}
+	return "systemd-networkd"
+}
+
+// Status infers the mode from the presence of the active client config and
+// reads the link state while in client mode.
+func (n *Netplan) Status() (Status, error) {
+	st := Status{Backend: n.Name(), Interface: n.Interface, Mode: ModeHotspot}
+	if _, err := os.Stat(n.ClientConfig); err == nil {
+		st.Mode = ModeClient
+		fillLinkStatus(&st)
+	} else if !os.IsNotExist(err) {
+		return st, err
+	}
+	return st, nil
+}
@@ -0,0 +1,255 @@
+package network
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+
+	"pifigo/internal/config"
+)
+
+// recordExecCommand replaces ExecCommand with '/bin/true' and records each
+// command line it was asked to run.
+func recordExecCommand(t *testing.T) *[]string {
+	var calls []string
+	originalExec := ExecCommand
+	ExecCommand = func(name string, arg ...string) *exec.Cmd {
+		calls = append(calls, strings.Join(append([]string{name}, arg...), " "))
+		return exec.Command("/bin/true")
+	}
+	t.Cleanup(func() { ExecCommand = originalExec })
+	return &calls
+}
+
+func newTestNetplan(t *testing.T) *Netplan {
+	tmpDir := t.TempDir()
+	cfg := &config.Config{}
+	cfg.Network.WirelessInterface = "wlan_test"
+	n := NewNetplan(cfg)
+	n.TemplatePath = filepath.Join(tmpDir, "netplan.tpl")
+	n.ClientConfig = filepath.Join(tmpDir, "99-pifigo-client.yaml")
+	os.WriteFile(n.TemplatePath, []byte("{{.WirelessInterface}}: {{.SSID}}/{{.Password}}"), 0644)
+	return n
+}
+
+func TestNew(t *testing.T) {
+	cfg := &config.Config{}
+	b, err := New(cfg)
+	if err != nil || b.Name() != BackendNetplan {
+		t.Errorf("Expected netplan backend by default, got %v (err: %v)", b, err)
+	}
+	cfg.Network.Backend = "carrier-pigeon"
+	if _, err := New(cfg); err == nil {
+		t.Error("Expected an error for an unknown backend")
+	}
+}
+
+func TestNetplanConnectAndHotspot(t *testing.T) {
+	calls := recordExecCommand(t)
+	n := newTestNetplan(t)
+
+	profile, err := n.Render(ClientConfig{SSID: "HomeWiFi", Password: "secret123"})
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	if string(profile) != "wlan_test: HomeWiFi/secret123" {
+		t.Errorf("Unexpected rendered profile: %s", profile)
+	}
+
+	if err := n.Connect(ClientConfig{SSID: "HomeWiFi", Password: "secret123"}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if content, _ := os.ReadFile(n.ClientConfig); string(content) != string(profile) {
+		t.Errorf("Active config was not written, got: %s", content)
+	}
+	if st, _ := n.Status(); st.Mode != ModeClient {
+		t.Errorf("Expected client mode after Connect, got %s", st.Mode)
+	}
+
+	if err := n.StartHotspot(); err != nil {
+		t.Fatalf("StartHotspot failed: %v", err)
+	}
+	if _, err := os.Stat(n.ClientConfig); !os.IsNotExist(err) {
+		t.Error("Active config was not removed by StartHotspot")
+	}
+	if st, _ := n.Status(); st.Mode != ModeHotspot {
+		t.Errorf("Expected hotspot mode after StartHotspot, got %s", st.Mode)
+	}
+
+	expected := []string{
+		"systemctl stop hostapd dnsmasq",
+		"netplan apply",
+		"iw dev wlan_test link",
+		"netplan apply",
+		"systemctl restart hostapd dnsmasq",
+	}
+	if strings.Join(*calls, "|") != strings.Join(expected, "|") {
+		t.Errorf("Unexpected commands:\n got: %v\nwant: %v", *calls, expected)
+	}
+}
+
+func TestNetplanRestart(t *testing.T) {
+	tests := map[string]string{
+		"network:\n  renderer: NetworkManager\n": "systemctl restart NetworkManager",
+		"network:\n  renderer: networkd\n":       "systemctl restart systemd-networkd",
+		"network:\n  version: 2\n":               "systemctl restart systemd-networkd",
+	}
+	for content, want := range tests {
+		calls := recordExecCommand(t)
+		n := newTestNetplan(t)
+		os.WriteFile(n.ClientConfig, []byte(content), 0600)
+		if err := n.Restart(); err != nil {
+			t.Fatalf("Restart failed: %v", err)
+		}
+		if expected := []string{want, "netplan apply"}; strings.Join(*calls, "|") != strings.Join(expected, "|") {
+			t.Errorf("Unexpected commands for %q:\n got: %v\nwant: %v", content, *calls, expected)
+		}
+	}
+}
+
+func TestNetplanRenderStatic(t *testing.T) {
+	n := newTestNetplan(t)
+	n.TemplatePath = filepath.Join("..", "..", "packaging", "etc", "pifigo", "netplan.tpl")
+
+	ip := IPConfig{Mode: IPModeStatic, Address: "192.168.1.150/24", Gateway: "192.168.1.1", DNS: []string{"1.1.1.1"}}
+	profile, err := n.Render(ClientConfig{SSID: "HomeWiFi", Password: "secret123", IP: ip})
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	for _, want := range []string{"dhcp4: no", "- 192.168.1.150/24", "via: 192.168.1.1", "- 1.1.1.1"} {
+		if !strings.Contains(string(profile), want) {
+			t.Errorf("Expected %q in the rendered profile:\n%s", want, profile)
+		}
+	}
+
+	// Without DNS servers the nameservers section is left out, since netplan
+	// refuses an empty address list.
+	noDNS := IPConfig{Mode: IPModeStatic, Address: "192.168.1.150/24", Gateway: "192.168.1.1"}
+	profile, err = n.Render(ClientConfig{SSID: "HomeWiFi", Password: "secret123", IP: noDNS})
+	if err != nil || strings.Contains(string(profile), "nameservers") {
+		t.Errorf("Expected no nameservers without DNS servers, got:\n%s (err: %v)", profile, err)
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal(profile, &doc); err != nil {
+		t.Errorf("Rendered profile is not valid YAML: %v", err)
+	}
+
+	// The DNS servers of config.yaml are used when the network sets none.
+	n.DefaultIP.DNS = []string{"9.9.9.9"}
+	profile, err = n.Render(ClientConfig{SSID: "HomeWiFi", Password: "secret123", IP: noDNS})
+	if err != nil || !strings.Contains(string(profile), "- 9.9.9.9") {
+		t.Errorf("Expected the default DNS servers, got:\n%s (err: %v)", profile, err)
+	}
+
+	profile, err = n.Render(ClientConfig{SSID: "HomeWiFi", Password: "secret123"})
+	if err != nil || !strings.Contains(string(profile), "dhcp4: true") {
+		t.Errorf("Expected DHCP by default, got:\n%s (err: %v)", profile, err)
+	}
+
+	ip.Gateway = "10.0.0.1"
+	if _, err := n.Render(ClientConfig{SSID: "HomeWiFi", IP: ip}); err == nil {
+		t.Error("Expected invalid static settings to be rejected")
+	}
+}
+
+func TestNetplanRenderEAP(t *testing.T) {
+	n := newTestNetplan(t)
+	n.TemplatePath = filepath.Join("..", "..", "packaging", "etc", "pifigo", "netplan.tpl")
+
+	eap := &EAPConfig{Method: EAPPEAP, Identity: "alice@example.edu", AnonymousIdentity: "anonymous@example.edu", Password: `p"ss`, CACert: "/etc/pifigo/certs/ca.pem"}
+	if _, err := n.Render(ClientConfig{SSID: "eduroam", EAP: eap}); err == nil {
+		t.Error("Expected a quote in an EAP password to be rejected")
+	}
+	eap.Password = "s3cret:#1"
+	profile, err := n.Render(ClientConfig{SSID: "eduroam", EAP: eap})
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	var doc struct {
+		Network struct {
+			Wifis map[string]struct {
+				AccessPoints map[string]struct {
+					Auth map[string]string `yaml:"auth"`
+				} `yaml:"access-points"`
+			} `yaml:"wifis"`
+		} `yaml:"network"`
+	}
+	if err := yaml.Unmarshal(profile, &doc); err != nil {
+		t.Fatalf("Rendered profile is not valid YAML: %v\n%s", err, profile)
+	}
+	auth := doc.Network.Wifis["wlan_test"].AccessPoints["eduroam"].Auth
+	want := map[string]string{
+		"key-management": "eap", "method": "peap", "identity": "alice@example.edu", "anonymous-identity": "anonymous@example.edu",
+		"password": "s3cret:#1", "phase2-auth": "mschapv2", "ca-certificate": "/etc/pifigo/certs/ca.pem",
+	}
+	for k, v := range want {
+		if auth[k] != v {
+			t.Errorf("Expected auth %s=%q, got %q\n%s", k, v, auth[k], profile)
+		}
+	}
+}
+
+func TestNetplanRenderSecurity(t *testing.T) {
+	n := newTestNetplan(t)
+	n.TemplatePath = filepath.Join("..", "..", "packaging", "etc", "pifigo", "netplan.tpl")
+
+	type accessPoint struct {
+		Password string            `yaml:"password"`
+		Hidden   bool              `yaml:"hidden"`
+		Auth     map[string]string `yaml:"auth"`
+	}
+	render := func(c ClientConfig) accessPoint {
+		t.Helper()
+		profile, err := n.Render(c)
+		if err != nil {
+			t.Fatalf("Render failed: %v", err)
+		}
+		var doc struct {
+			Network struct {
+				Wifis map[string]struct {
+					AccessPoints map[string]*accessPoint `yaml:"access-points"`
+				} `yaml:"wifis"`
+			} `yaml:"network"`
+		}
+		if err := yaml.Unmarshal(profile, &doc); err != nil {
+			t.Fatalf("Rendered profile is not valid YAML: %v\n%s", err, profile)
+		}
+		ap, ok := doc.Network.Wifis["wlan_test"].AccessPoints[c.SSID]
+		if !ok {
+			t.Fatalf("Access point %q missing from:\n%s", c.SSID, profile)
+		}
+		if ap == nil {
+			return accessPoint{}
+		}
+		return *ap
+	}
+
+	if ap := render(ClientConfig{SSID: "CoffeeShop"}); ap.Password != "" || ap.Auth != nil || ap.Hidden {
+		t.Errorf("Expected an open network without credentials, got %+v", ap)
+	}
+	if ap := render(ClientConfig{SSID: "Secret", Hidden: true}); !ap.Hidden {
+		t.Errorf("Expected a hidden open network, got %+v", ap)
+	}
+	ap := render(ClientConfig{SSID: "Modern", Password: "correct horse", Security: SecurityWPA3SAE, Hidden: true})
+	if ap.Auth["key-management"] != "sae" || ap.Auth["password"] != "correct horse" || !ap.Hidden {
+		t.Errorf("Expected a hidden WPA3-SAE network, got %+v", ap)
+	}
+	if ap := render(ClientConfig{SSID: "Mixed", Password: "secret123", Security: SecurityWPA3Transition}); ap.Password != "secret123" {
+		t.Errorf("Expected a transition mode network to use the password, got %+v", ap)
+	}
+
+	for _, c := range []ClientConfig{
+		{SSID: "Modern", Security: SecurityWPA3SAE, Password: strings.Repeat("ab", 32)},
+		{SSID: "HomeWiFi", Security: SecurityWPA2PSK},
+		{SSID: "CoffeeShop", Security: SecurityOpen, Password: "secret123"},
+		{SSID: "OldRouter", Security: SecurityWEP, Password: "12345"},
+	} {
+		if _, err := n.Render(c); err == nil {
+			t.Errorf("Expected %+v to be rejected", c)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Package network is the single seam between pifigo and the host's network
+// stack. Everything that changes the state of the wireless interface goes
+// through a NetworkBackend, so the rest of pifigo never builds shell commands.
+package network
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"pifigo/internal/config"
+)
+
+// Names of the supported backends, as used by network.backend in config.yaml.
+const (
+	BackendNetplan        = "netplan"
+	BackendNetworkManager = "networkmanager"
+	BackendWpaSupplicant  = "wpa_supplicant"
+)
+
+// ExecCommand is exported so tests can replace it with a harmless command.
+var ExecCommand = exec.Command
+
+// Mode describes the role the wireless interface is currently playing.
+type Mode string
+
+const (
+	ModeHotspot Mode = "hotspot"
+	ModeClient  Mode = "client"
+)
+
+// ClientConfig holds the values a backend needs to join a Wi-Fi network.
+type ClientConfig struct {
+	SSID     string
+	Password string
+	Security string // One of the Security constants; inferred from the credentials if empty.
+	Hidden   bool   // The network does not broadcast its SSID and must be probed for.
+	IP       IPConfig
+	EAP      *EAPConfig // Set for WPA2/WPA3-Enterprise networks; Password is then unused.
+	Priority int        // Higher is preferred by backends that choose between saved networks.
+}
+
+// Status is a snapshot of the backend's view of the wireless interface.
+// SSID, Associated and IPAddress are only filled in while in client mode.
+type Status struct {
+	Backend    string
+	Interface  string
+	Mode       Mode
+	SSID       string
+	Associated bool
+	IPAddress  string
+}
+
+// NetworkBackend switches the device between hotspot and client mode.
+type NetworkBackend interface {
+	// Name returns the backend identifier used in config.yaml.
+	Name() string
+	// Render produces the backend's on-disk profile for a client network.
+	Render(c ClientConfig) ([]byte, error)
+	// Connect stops the hotspot, renders the client network and applies it.
+	Connect(c ClientConfig) error
+	// Disconnect removes the active client configuration.
+	Disconnect() error
+	// StartHotspot drops any client configuration and brings the hotspot up.
+	StartHotspot() error
+	// StopHotspot takes the hotspot down without touching client configuration.
+	StopHotspot() error
+	// Status reports the current mode of the wireless interface.
+	Status() (Status, error)
+}
+
+// HotspotConfigurer is implemented by backends that provision the hotspot
+// themselves instead of relying on the hostapd and dnsmasq configs that the
+// boot manager generates.
+type HotspotConfigurer interface {
+	ConfigureHotspot() error
+}
+
+// Recoverer is implemented by backends that can try to repair a client
+// connection in place, which the watchdog does before giving up on it.
+type Recoverer interface {
+	// Reassociate makes the interface drop and rejoin the current network.
+	Reassociate() error
+	// Restart restarts the service that manages the client connection.
+	Restart() error
+}
+
+// New returns the backend selected by network.backend, defaulting to netplan.
+func New(cfg *config.Config) (NetworkBackend, error) {
+	switch cfg.Network.Backend {
+	case "", BackendNetplan:
+		return NewNetplan(cfg), nil
+	case BackendNetworkManager:
+		return NewNetworkManager(cfg), nil
+	case BackendWpaSupplicant:
+		return NewWpaSupplicant(cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown network backend %q", cfg.Network.Backend)
+	}
+}
+
+// run executes a command and folds its combined output into the error.
+func run(name string, args ...string) error {
+	output, err := ExecCommand(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %w (output: %s)", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// fillLinkStatus reads the association state from 'iw dev <iface> link' and
+// the IPv4 address from the interface.
+func fillLinkStatus(st *Status) {
+	if output, err := ExecCommand("iw", "dev", st.Interface, "link").Output(); err == nil {
+		for _, line := range strings.Split(string(output), "\n") {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "Connected to ") {
+				st.Associated = true
+			} else if ssid, ok := strings.CutPrefix(line, "SSID: "); ok {
+				st.SSID = ssid
+			}
+		}
+	}
+	st.IPAddress = InterfaceIPv4(st.Interface)
+}
+
+// InterfaceIPv4 returns the first IPv4 address of the interface, or "" if it
+// has none. It is a variable so tests can stub it.
+var InterfaceIPv4 = func(name string) string {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return ""
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet.IP.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,323 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"pifigo/internal/config"
+)
+
+// Default locations and connection names used by the NetworkManager backend.
+const (
+	NMConnectionsDir = "/etc/NetworkManager/system-connections"
+	nmClientID       = "pifigo-client"
+	nmHotspotID      = "pifigo-hotspot"
+)
+
+// NetworkManager drives the network through nmcli. Client and hotspot
+// connections are written as keyfiles and loaded into NetworkManager, and the
+// hotspot is a mode=ap connection with ipv4.method=shared, so hostapd and
+// dnsmasq are not needed.
+type NetworkManager struct {
+	Interface      string
+	ConnectionsDir string
+	cfg            *config.Config
+}
+
+// NewNetworkManager returns a NetworkManager backend using the standard
+// keyfile directory.
+func NewNetworkManager(cfg *config.Config) *NetworkManager {
+	return &NetworkManager{
+		Interface:      cfg.Network.WirelessInterface,
+		ConnectionsDir: NMConnectionsDir,
+		cfg:            cfg,
+	}
+}
+
+const nmClientTemplate = `[connection]
+id={{.ID}}
+type=wifi
+interface-name={{.Interface}}
+autoconnect=true
+
+[wifi]
+mode=infrastructure
+ssid={{keyfile .SSID}}
+{{- if .Hidden}}
+hidden=true
+{{- end}}
+{{- if eq .Security "eap"}}
+
+[wifi-security]
+key-mgmt=wpa-eap
+
+[802-1x]
+eap={{.EAP.Method}};
+identity={{keyfile .EAP.Identity}}
+{{- if .EAP.AnonymousIdentity}}
+anonymous-identity={{keyfile .EAP.AnonymousIdentity}}
+{{- end}}
+{{- if .EAP.Password}}
+password={{keyfile .EAP.Password}}
+{{- end}}
+{{- if .Phase2}}
+phase2-auth={{.Phase2}}
+{{- end}}
+{{- if .EAP.CACert}}
+ca-cert={{keyfile .EAP.CACert}}
+{{- end}}
+{{- if .EAP.ClientCert}}
+client-cert={{keyfile .EAP.ClientCert}}
+private-key={{keyfile .EAP.ClientKey}}
+{{- end}}
+{{- if .EAP.ClientKeyPassword}}
+private-key-password={{keyfile .EAP.ClientKeyPassword}}
+{{- end}}
+{{- else if eq .Security "wpa3-sae"}}
+
+[wifi-security]
+key-mgmt=sae
+psk={{keyfile .Password}}
+{{- else if .Password}}
+
+[wifi-security]
+key-mgmt=wpa-psk
+psk={{keyfile .Password}}
+{{- end}}
+
+[ipv4]
+{{- if eq .IP.Mode "static"}}
+method=manual
+address1={{.IP.Address}},{{.IP.Gateway}}
+{{- if .IP.DNS}}
+dns={{range .IP.DNS}}{{.}};{{end}}
+ignore-auto-dns=true
+{{- end}}
+{{- else}}
+method=auto
+{{- end}}
+
+[ipv6]
+method=auto
+`
+
+const nmHotspotTemplate = `[connection]
+id={{.ID}}
+type=wifi
+interface-name={{.Interface}}
+autoconnect=false
+
+[wifi]
+mode=ap
+ssid={{keyfile .Network.ApSSID}}
+band=bg
+channel={{.Network.ApChannel}}
+
+[wifi-security]
+key-mgmt=wpa-psk
+proto=rsn
+pairwise=ccmp
+group=ccmp
+psk={{keyfile .Network.ApPassword}}
+
+[ipv4]
+method=shared
+address1={{.Network.ApIpAddress}}
+
+[ipv6]
+method=disabled
+`
+
+// Name implements NetworkBackend.
+func (n *NetworkManager) Name() string { return BackendNetworkManager }
+
+// Render produces a keyfile for the client connection.
+func (n *NetworkManager) Render(c ClientConfig) ([]byte, error) {
+	c.IP = c.IP.Or(DefaultIP(n.cfg))
+	if err := c.IP.Validate(); err != nil {
+		return nil, err
+	}
+	security, err := c.security()
+	if err != nil {
+		return nil, err
+	}
+	c.Security = security
+	var phase2 string
+	if c.EAP != nil {
+		phase2 = c.EAP.phase2()
+	}
+	data := struct {
+		ClientConfig
+		ID, Interface, Phase2 string
+	}{c, nmClientID, n.Interface, phase2}
+	return renderKeyfile("client", nmClientTemplate, data)
+}
+
+// Connect renders the client keyfile and activates it.
+func (n *NetworkManager) Connect(c ClientConfig) error {
+	profile, err := n.Render(c)
+	if err != nil {
+		return err
+	}
+	return n.apply(profile)
+}
+
+// apply loads the client keyfile into NetworkManager and activates it.
+func (n *NetworkManager) apply(profile []byte) error {
+	if err := os.MkdirAll(n.ConnectionsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create connections directory: %w", err)
+	}
+	path := n.keyfilePath(nmClientID)
+	// NetworkManager ignores keyfiles that are readable by anyone but root.
+	if err := os.WriteFile(path, profile, 0600); err != nil {
+		return fmt.Errorf("failed to write client connection: %w", err)
+	}
+	if err := n.StopHotspot(); err != nil {
+		return err
+	}
+	if err := run("nmcli", "connection", "load", path); err != nil {
+		return err
+	}
+	return run("nmcli", "connection", "up", "id", nmClientID)
+}
+
+// Reassociate reactivates the client connection.
+func (n *NetworkManager) Reassociate() error {
+	return run("nmcli", "connection", "up", "id", nmClientID)
+}
+
+// Restart restarts NetworkManager, which reactivates the client connection
+// once it is back.
+func (n *NetworkManager) Restart() error {
+	return run("systemctl", "restart", "NetworkManager")
+}
+
+// Disconnect deletes the client connection, which also deactivates it.
+func (n *NetworkManager) Disconnect() error {
+	if _, err := os.Stat(n.keyfilePath(nmClientID)); os.IsNotExist(err) {
+		return nil
+	}
+	return run("nmcli", "connection", "delete", "id", nmClientID)
+}
+
+// StartHotspot drops the client connection and activates the hotspot.
+func (n *NetworkManager) StartHotspot() error {
+	if err := n.Disconnect(); err != nil {
+		return err
+	}
+	if err := n.ConfigureHotspot(); err != nil {
+		return err
+	}
+	return run("nmcli", "connection", "up", "id", nmHotspotID)
+}
+
+// StopHotspot deactivates the hotspot connection if it is up.
+func (n *NetworkManager) StopHotspot() error {
+	active, err := n.activeConnections()
+	if err != nil {
+		return err
+	}
+	for _, name := range active {
+		if name == nmHotspotID {
+			return run("nmcli", "connection", "down", "id", nmHotspotID)
+		}
+	}
+	return nil
+}
+
+// Status reports client mode whenever a client connection is configured, and
+// reads the link state while in client mode.
+func (n *NetworkManager) Status() (Status, error) {
+	st := Status{Backend: n.Name(), Interface: n.Interface, Mode: ModeHotspot}
+	if _, err := os.Stat(n.keyfilePath(nmClientID)); err == nil {
+		st.Mode = ModeClient
+		fillLinkStatus(&st)
+	} else if !os.IsNotExist(err) {
+		return st, err
+	}
+	return st, nil
+}
+
+// ConfigureHotspot writes the hotspot keyfile and loads it when it changed.
+// It implements HotspotConfigurer.
+func (n *NetworkManager) ConfigureHotspot() error {
+	data := struct {
+		*config.Config
+		ID, Interface string
+	}{n.cfg, nmHotspotID, n.Interface}
+	content, err := renderKeyfile("hotspot", nmHotspotTemplate, data)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(n.ConnectionsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create connections directory: %w", err)
+	}
+	path := n.keyfilePath(nmHotspotID)
+	changed, err := writeIfChanged(path, content, 0600)
+	if err != nil || !changed {
+		return err
+	}
+	return run("nmcli", "connection", "load", path)
+}
+
+// activeConnections lists the names of the active NetworkManager connections.
+func (n *NetworkManager) activeConnections() ([]string, error) {
+	output, err := ExecCommand("nmcli", "-t", "-f", "NAME", "connection", "show", "--active").Output()
+	if err != nil {
+		return nil, fmt.Errorf("nmcli connection show failed: %w", err)
+	}
+	var names []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			names = append(names, line)
+		}
+	}
+	return names, nil
+}
+
+func (n *NetworkManager) keyfilePath(id string) string {
+	return filepath.Join(n.ConnectionsDir, id+".nmconnection")
+}
+
+// renderKeyfile executes a keyfile template with string escaping available.
+func renderKeyfile(name, tmplStr string, data any) ([]byte, error) {
+	funcMap := template.FuncMap{"keyfile": keyfileEscape}
+	tmpl, err := template.New(name).Funcs(funcMap).Parse(tmplStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s keyfile template: %w", name, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to execute %s keyfile template: %w", name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// keyfileEscape escapes a value for use in a GKeyFile string entry.
+func keyfileEscape(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	s = r.Replace(s)
+	if strings.HasPrefix(s, " ") {
+		s = `\s` + s[1:]
+	}
+	return s
+}
+
+// writeIfChanged writes content to path unless the file already holds it.
+func writeIfChanged(path string, content []byte, perm os.FileMode) (bool, error) {
+	current, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil && bytes.Equal(current, content) {
+		return false, nil
+	}
+	if err := os.WriteFile(path, content, perm); err != nil {
+		return false, err
+	}
+	return true, nil
+}
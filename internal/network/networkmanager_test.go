@@ -0,0 +1,194 @@
+package network
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"pifigo/internal/config"
+)
+
+// fakeNmcliScript logs its arguments and answers 'connection show --active'
+// with the contents of $NMCLI_ACTIVE.
+const fakeNmcliScript = `#!/bin/sh
+echo "$@" >> "$NMCLI_LOG"
+case "$*" in
+  *"show --active"*) cat "$NMCLI_ACTIVE" 2>/dev/null ;;
+esac
+exit 0
+`
+
+// installFakeNmcli puts a fake nmcli first on PATH and returns the paths of
+// its call log and its list of active connections.
+func installFakeNmcli(t *testing.T) (logPath, activePath string) {
+	binDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(binDir, "nmcli"), []byte(fakeNmcliScript), 0755); err != nil {
+		t.Fatalf("Failed to write fake nmcli: %v", err)
+	}
+	logPath = filepath.Join(binDir, "nmcli.log")
+	activePath = filepath.Join(binDir, "active")
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("NMCLI_LOG", logPath)
+	t.Setenv("NMCLI_ACTIVE", activePath)
+	return logPath, activePath
+}
+
+func readCalls(t *testing.T, logPath string) []string {
+	content, _ := os.ReadFile(logPath)
+	os.Remove(logPath)
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+func newTestNetworkManager(t *testing.T) *NetworkManager {
+	cfg := &config.Config{}
+	cfg.Network.WirelessInterface = "wlan_test"
+	cfg.Network.ApSSID = "TestHotspot"
+	cfg.Network.ApPassword = "testpassword"
+	cfg.Network.ApChannel = 6
+	cfg.Network.ApIpAddress = "192.168.100.1/24"
+	n := NewNetworkManager(cfg)
+	n.ConnectionsDir = t.TempDir()
+	return n
+}
+
+func TestNetworkManagerConnect(t *testing.T) {
+	logPath, activePath := installFakeNmcli(t)
+	n := newTestNetworkManager(t)
+	os.WriteFile(activePath, []byte("pifigo-hotspot\nWired connection 1\n"), 0644)
+
+	profile, err := n.Render(ClientConfig{SSID: "Home WiFi", Password: `pa\ss`})
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	for _, want := range []string{"id=pifigo-client", "interface-name=wlan_test", "ssid=Home WiFi", `psk=pa\\ss`, "key-mgmt=wpa-psk"} {
+		if !strings.Contains(string(profile), want) {
+			t.Errorf("Rendered keyfile is missing %q:\n%s", want, profile)
+		}
+	}
+
+	if err := n.Connect(ClientConfig{SSID: "Home WiFi", Password: `pa\ss`}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	keyfile := filepath.Join(n.ConnectionsDir, "pifigo-client.nmconnection")
+	if info, err := os.Stat(keyfile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected client keyfile with mode 0600, got %v (err: %v)", info, err)
+	}
+	if st, _ := n.Status(); st.Mode != ModeClient {
+		t.Errorf("Expected client mode after Connect, got %s", st.Mode)
+	}
+
+	expected := []string{
+		"-t -f NAME connection show --active",
+		"connection down id pifigo-hotspot",
+		"connection load " + keyfile,
+		"connection up id pifigo-client",
+	}
+	if calls := readCalls(t, logPath); strings.Join(calls, "|") != strings.Join(expected, "|") {
+		t.Errorf("Unexpected nmcli calls:\n got: %v\nwant: %v", calls, expected)
+	}
+}
+
+func TestNetworkManagerOpenNetwork(t *testing.T) {
+	n := newTestNetworkManager(t)
+	profile, err := n.Render(ClientConfig{SSID: "CoffeeShop"})
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	if strings.Contains(string(profile), "[wifi-security]") {
+		t.Errorf("Open network keyfile should not have a security section:\n%s", profile)
+	}
+}
+
+func TestNetworkManagerWPA3Hidden(t *testing.T) {
+	n := newTestNetworkManager(t)
+	profile, err := n.Render(ClientConfig{SSID: "Modern", Password: "correct horse", Security: SecurityWPA3SAE, Hidden: true})
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	for _, want := range []string{"hidden=true", "key-mgmt=sae", "psk=correct horse"} {
+		if !strings.Contains(string(profile), want) {
+			t.Errorf("Rendered keyfile is missing %q:\n%s", want, profile)
+		}
+	}
+}
+
+func TestNetworkManagerStaticIP(t *testing.T) {
+	n := newTestNetworkManager(t)
+	ip := IPConfig{Mode: IPModeStatic, Address: "192.168.1.150/24", Gateway: "192.168.1.1", DNS: []string{"8.8.8.8", "1.1.1.1"}}
+	profile, err := n.Render(ClientConfig{SSID: "Office", Password: "secret123", IP: ip})
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	for _, want := range []string{"method=manual", "address1=192.168.1.150/24,192.168.1.1", "dns=8.8.8.8;1.1.1.1;"} {
+		if !strings.Contains(string(profile), want) {
+			t.Errorf("Rendered keyfile is missing %q:\n%s", want, profile)
+		}
+	}
+}
+
+func TestNetworkManagerEAP(t *testing.T) {
+	n := newTestNetworkManager(t)
+	eap := &EAPConfig{Method: EAPTLS, Identity: "device-42", ClientCert: "/etc/pifigo/certs/client.pem", ClientKey: "/etc/pifigo/certs/client.key", ClientKeyPassword: "keypass"}
+	profile, err := n.Render(ClientConfig{SSID: "Corp", EAP: eap})
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	for _, want := range []string{"key-mgmt=wpa-eap", "[802-1x]", "eap=tls;", "identity=device-42", "client-cert=/etc/pifigo/certs/client.pem", "private-key=/etc/pifigo/certs/client.key", "private-key-password=keypass"} {
+		if !strings.Contains(string(profile), want) {
+			t.Errorf("Rendered keyfile is missing %q:\n%s", want, profile)
+		}
+	}
+	if strings.Contains(string(profile), "phase2-auth") {
+		t.Errorf("EAP-TLS has no inner authentication:\n%s", profile)
+	}
+}
+
+func TestNetworkManagerHotspot(t *testing.T) {
+	logPath, _ := installFakeNmcli(t)
+	n := newTestNetworkManager(t)
+	os.WriteFile(filepath.Join(n.ConnectionsDir, "pifigo-client.nmconnection"), []byte("..."), 0600)
+
+	if err := n.StartHotspot(); err != nil {
+		t.Fatalf("StartHotspot failed: %v", err)
+	}
+	hotspot, err := os.ReadFile(filepath.Join(n.ConnectionsDir, "pifigo-hotspot.nmconnection"))
+	if err != nil {
+		t.Fatalf("Hotspot keyfile was not written: %v", err)
+	}
+	for _, want := range []string{"mode=ap", "ssid=TestHotspot", "channel=6", "method=shared", "address1=192.168.100.1/24"} {
+		if !strings.Contains(string(hotspot), want) {
+			t.Errorf("Hotspot keyfile is missing %q:\n%s", want, hotspot)
+		}
+	}
+
+	hotspotKeyfile := filepath.Join(n.ConnectionsDir, "pifigo-hotspot.nmconnection")
+	expected := []string{
+		"connection delete id pifigo-client",
+		"connection load " + hotspotKeyfile,
+		"connection up id pifigo-hotspot",
+	}
+	if calls := readCalls(t, logPath); strings.Join(calls, "|") != strings.Join(expected, "|") {
+		t.Errorf("Unexpected nmcli calls:\n got: %v\nwant: %v", calls, expected)
+	}
+
+	// An unchanged hotspot connection is not reloaded.
+	if err := n.ConfigureHotspot(); err != nil {
+		t.Fatalf("ConfigureHotspot failed: %v", err)
+	}
+	if content, _ := os.ReadFile(logPath); len(content) != 0 {
+		t.Errorf("Expected no nmcli calls for an unchanged hotspot, got: %s", content)
+	}
+}
+
+func TestNetworkManagerReassociate(t *testing.T) {
+	logPath, _ := installFakeNmcli(t)
+	n := newTestNetworkManager(t)
+
+	if err := n.Reassociate(); err != nil {
+		t.Fatalf("Reassociate failed: %v", err)
+	}
+	if calls := readCalls(t, logPath); len(calls) != 1 || calls[0] != "connection up id pifigo-client" {
+		t.Errorf("Unexpected nmcli calls: %v", calls)
+	}
+}
@@ -0,0 +1,63 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Security types of a client network. They match the values reported by the
+// scan package.
+const (
+	SecurityOpen           = "open"
+	SecurityWEP            = "wep"
+	SecurityWPA2PSK        = "wpa2-psk"
+	SecurityWPA3SAE        = "wpa3-sae"
+	SecurityWPA3Transition = "wpa3-transition" // WPA2-PSK and WPA3-SAE on the same network.
+	SecurityEAP            = "eap"
+)
+
+// security returns the network's security type and checks that the
+// credentials suit it. Without an explicit type it is inferred from the
+// credentials: EAP settings, a password, or neither for an open network.
+func (c ClientConfig) security() (string, error) {
+	sec := c.Security
+	if sec == "" {
+		switch {
+		case c.EAP != nil:
+			sec = SecurityEAP
+		case c.Password == "":
+			sec = SecurityOpen
+		default:
+			sec = SecurityWPA2PSK
+		}
+	}
+	switch sec {
+	case SecurityOpen:
+		if c.Password != "" {
+			return "", errors.New("open networks do not take a password")
+		}
+	case SecurityWPA2PSK, SecurityWPA3Transition:
+		if c.Password == "" {
+			return "", errors.New("a password is required for this network")
+		}
+	case SecurityWPA3SAE:
+		if c.Password == "" {
+			return "", errors.New("a password is required for this network")
+		}
+		if isHexPSK(c.Password) {
+			return "", errors.New("WPA3-SAE needs the passphrase, not a pre-computed key")
+		}
+	case SecurityEAP:
+		if c.EAP == nil {
+			return "", errors.New("enterprise settings are required for this network")
+		}
+		if err := c.EAP.Validate(); err != nil {
+			return "", err
+		}
+	case SecurityWEP:
+		return "", errors.New("WEP networks are not supported")
+	default:
+		return "", fmt.Errorf("unknown security type %q", sec)
+	}
+	return sec, nil
+}
@@ -0,0 +1,132 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Stages of a transactional connect, in the order they are checked.
+// StageAuthentication is only reported by a Validator, before anything is
+// applied.
+const (
+	StageAuthentication = "authentication"
+	StageApply          = "apply"
+	StageAssociation    = "association"
+	StageDHCP           = "dhcp"
+	StageConnectivity   = "connectivity"
+)
+
+var (
+	ErrNotAssociated  = errors.New("did not associate with the network")
+	ErrNoLease        = errors.New("associated but did not get an IP address")
+	ErrNoConnectivity = errors.New("connected but the connectivity check failed")
+)
+
+// ConnectError reports the stage at which a transactional connect failed.
+type ConnectError struct {
+	Stage string
+	Err   error
+}
+
+func (e *ConnectError) Error() string { return e.Err.Error() }
+func (e *ConnectError) Unwrap() error { return e.Err }
+
+// DefaultConnectTimeout is used when network.connect_timeout_seconds is not set.
+const DefaultConnectTimeout = 45 * time.Second
+
+// TryOptions tune TryConnect.
+type TryOptions struct {
+	// Timeout is how long to wait for association, a lease and a working probe.
+	Timeout time.Duration
+	// PollInterval is how often the backend status is checked.
+	PollInterval time.Duration
+	// Online, if set, must report the device online once it has a lease.
+	// probe.TryOptions sets it to the watchdog's probes.
+	Online func(context.Context) bool
+	// NoRollback leaves a failed network configured, for callers that go on
+	// to try another one.
+	NoRollback bool
+	// Undo, if set, is called when the attempt fails, before the previous
+	// network is restored, to remove files written for the failed one.
+	Undo func()
+}
+
+// FailureStage returns the stage at which a connect failed: the stage of a
+// *ConnectError, or StageApply for any other error.
+func FailureStage(err error) string {
+	var connErr *ConnectError
+	if errors.As(err, &connErr) {
+		return connErr.Stage
+	}
+	return StageApply
+}
+
+// TryConnect connects to a client network and waits for the device to
+// associate, obtain an IPv4 lease and pass the connectivity probe. If that
+// does not happen before the timeout, it restores the previous network, or
+// the hotspot when previous is nil, and returns a *ConnectError.
+func TryConnect(b NetworkBackend, c ClientConfig, previous *ClientConfig, opts TryOptions) error {
+	err := tryConnect(b, c, opts)
+	if err == nil {
+		return nil
+	}
+	if opts.Undo != nil {
+		opts.Undo()
+	}
+	if opts.NoRollback {
+		return err
+	}
+	log.Printf("Connection attempt failed (%s): %v. Rolling back.", err.Stage, err.Err)
+	if rbErr := rollback(b, previous); rbErr != nil {
+		log.Printf("ERROR: Rollback failed: %v", rbErr)
+	}
+	return err
+}
+
+func tryConnect(b NetworkBackend, c ClientConfig, opts TryOptions) *ConnectError {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Second
+	}
+	if err := b.Connect(c); err != nil {
+		return &ConnectError{Stage: StageApply, Err: err}
+	}
+	deadline := time.Now().Add(opts.Timeout)
+	last := &ConnectError{Stage: StageAssociation, Err: ErrNotAssociated}
+	for {
+		st, err := b.Status()
+		switch {
+		case err != nil:
+			last = &ConnectError{Stage: StageAssociation, Err: fmt.Errorf("%w: %v", ErrNotAssociated, err)}
+		case !st.Associated:
+			last = &ConnectError{Stage: StageAssociation, Err: ErrNotAssociated}
+		case st.IPAddress == "":
+			last = &ConnectError{Stage: StageDHCP, Err: ErrNoLease}
+		case opts.Online != nil && !online(opts.Online, deadline):
+			last = &ConnectError{Stage: StageConnectivity, Err: ErrNoConnectivity}
+		default:
+			return nil
+		}
+		if time.Now().Add(opts.PollInterval).After(deadline) {
+			return last
+		}
+		time.Sleep(opts.PollInterval)
+	}
+}
+
+// rollback restores the previous client network, or the hotspot.
+func rollback(b NetworkBackend, previous *ClientConfig) error {
+	if previous != nil {
+		return b.Connect(*previous)
+	}
+	return b.StartHotspot()
+}
+
+// online runs the connectivity check, giving up at the connect deadline.
+func online(check func(context.Context) bool, deadline time.Time) bool {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	return check(ctx)
+}
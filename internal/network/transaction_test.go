@@ -0,0 +1,71 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tryOptions(online func(context.Context) bool) TryOptions {
+	return TryOptions{Timeout: 50 * time.Millisecond, PollInterval: 10 * time.Millisecond, Online: online}
+}
+
+// onlineIf returns a connectivity check that reports ok.
+func onlineIf(ok bool) func(context.Context) bool {
+	return func(context.Context) bool { return ok }
+}
+
+func TestTryConnectSuccess(t *testing.T) {
+	b := NewFake()
+	if err := TryConnect(b, ClientConfig{SSID: "new"}, nil, tryOptions(onlineIf(true))); err != nil {
+		t.Fatalf("TryConnect failed: %v", err)
+	}
+	if strings.Join(b.Calls(), ",") != "Connect" || b.Config().SSID != "new" {
+		t.Errorf("Expected a single Connect with the new profile, got %v", b.Calls())
+	}
+}
+
+func TestTryConnectRollback(t *testing.T) {
+	cases := []struct {
+		name     string
+		setup    func(*Fake)
+		online   func(context.Context) bool
+		previous *ClientConfig
+		stage    string
+		err      error
+		calls    string
+	}{
+		{"no association, back to hotspot", func(f *Fake) { f.NoAssociation = true }, nil, nil, StageAssociation, ErrNotAssociated, "Connect,StartHotspot"},
+		{"no lease, back to previous", func(f *Fake) { f.NoLease = true }, nil, &ClientConfig{SSID: "old"}, StageDHCP, ErrNoLease, "Connect,Connect"},
+		{"probe fails", func(f *Fake) {}, onlineIf(false), nil, StageConnectivity, ErrNoConnectivity, "Connect,StartHotspot"},
+		{"apply fails", func(f *Fake) { f.Err = errors.New("boom") }, nil, nil, StageApply, nil, "Connect,StartHotspot"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := NewFake()
+			tc.setup(b)
+			opts := tryOptions(tc.online)
+			undone := false
+			opts.Undo = func() { undone = len(b.Calls()) == 1 }
+			err := TryConnect(b, ClientConfig{SSID: "new"}, tc.previous, opts)
+			if !undone {
+				t.Error("Expected Undo to be called before the rollback")
+			}
+			var connErr *ConnectError
+			if !errors.As(err, &connErr) || connErr.Stage != tc.stage {
+				t.Fatalf("Expected a %s ConnectError, got %v", tc.stage, err)
+			}
+			if tc.err != nil && !errors.Is(err, tc.err) {
+				t.Errorf("Expected %v, got %v", tc.err, err)
+			}
+			if calls := strings.Join(b.Calls(), ","); calls != tc.calls {
+				t.Errorf("Expected calls %s, got %s", tc.calls, calls)
+			}
+			if tc.previous != nil && b.Config().SSID != tc.previous.SSID {
+				t.Errorf("Expected the previous network to be restored, got %+v", b.Config())
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ProbeInterface is the virtual station interface credentials are tested on.
+const ProbeInterface = "pifigo-probe"
+
+// defaultValidateTimeout bounds a credential check when no timeout is set.
+const defaultValidateTimeout = 20 * time.Second
+
+// notFoundScans is how many scans may miss the network before it is reported
+// as not found; a single scan on a busy channel can easily miss a beacon.
+const notFoundScans = 3
+
+var (
+	// ErrWrongPassword means the 4-way handshake (or SAE exchange) failed.
+	ErrWrongPassword = errors.New("wrong password")
+	// ErrEAPFailure means the 802.1X server refused the identity or password.
+	ErrEAPFailure = errors.New("802.1X authentication failed")
+	// ErrServerCertificate means the 802.1X server's certificate did not
+	// verify against the CA certificate.
+	ErrServerCertificate = errors.New("802.1X server certificate rejected")
+	// ErrNetworkNotFound means the network was not seen in repeated scans.
+	ErrNetworkNotFound = errors.New("network not found")
+	// ErrAssociationRejected means the access point refused the association.
+	ErrAssociationRejected = errors.New("access point rejected the association")
+	// ErrValidationTimeout means no verdict was reached in time.
+	ErrValidationTimeout = errors.New("timed out checking the credentials")
+	// ErrValidationUnsupported means the credentials could not be checked
+	// alongside the hotspot, typically because the driver cannot run a
+	// station interface next to an access point.
+	ErrValidationUnsupported = errors.New("credential check not supported")
+)
+
+// CredentialValidator checks credentials without changing the active
+// connection.
+type CredentialValidator interface {
+	Validate(c ClientConfig) error
+}
+
+// Validator tests Wi-Fi credentials with a short-lived wpa_supplicant on a
+// virtual station interface, leaving the hotspot on the physical interface up
+// so the user keeps their portal connection. Only authentication is checked;
+// DHCP is left to the real connection attempt.
+type Validator struct {
+	Interface string        // Physical interface running the hotspot.
+	Probe     string        // Virtual station interface to create.
+	Timeout   time.Duration // Upper bound for one check.
+	WorkDir   string        // Holds the temporary config and control socket; a temp dir when empty.
+
+	ctrlAttempts int
+}
+
+// NewValidator returns a Validator for the given physical interface.
+func NewValidator(iface string, timeout time.Duration) *Validator {
+	if timeout <= 0 {
+		timeout = defaultValidateTimeout
+	}
+	return &Validator{Interface: iface, Probe: ProbeInterface, Timeout: timeout, ctrlAttempts: 20}
+}
+
+// Validate associates with the network described by c and reports whether the
+// credentials were accepted. A nil error means the handshake completed; a
+// rejected handshake is returned as a *ConnectError at StageAuthentication.
+func (v *Validator) Validate(c ClientConfig) error {
+	block, err := renderWpaNetwork(c)
+	if err != nil {
+		return err
+	}
+	dir := v.WorkDir
+	if dir == "" {
+		if dir, err = os.MkdirTemp("", "pifigo-validate-"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+	}
+
+	if err := run("iw", "dev", v.Interface, "interface", "add", v.Probe, "type", "managed"); err != nil {
+		return fmt.Errorf("%w: %v", ErrValidationUnsupported, err)
+	}
+	defer func() {
+		if err := run("iw", "dev", v.Probe, "del"); err != nil {
+			log.Printf("WARNING: Could not remove %s: %v", v.Probe, err)
+		}
+	}()
+
+	confPath := filepath.Join(dir, "wpa_supplicant.conf")
+	conf := fmt.Sprintf("ctrl_interface=DIR=%s\nupdate_config=0\n\n%s", dir, block)
+	if err := os.WriteFile(confPath, []byte(conf), 0600); err != nil {
+		return err
+	}
+
+	cmd := ExecCommand("wpa_supplicant", "-i", v.Probe, "-D", "nl80211", "-c", confPath)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("%w: %v", ErrValidationUnsupported, err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	ctrl, err := waitForCtrl(filepath.Join(dir, v.Probe), v.ctrlAttempts)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrValidationUnsupported, err)
+	}
+	defer ctrl.Close()
+	if err := ctrl.Attach(); err != nil {
+		return fmt.Errorf("%w: %v", ErrValidationUnsupported, err)
+	}
+	if err := watchAuthentication(ctrl, time.Now().Add(v.Timeout)); err != nil {
+		return &ConnectError{Stage: StageAuthentication, Err: err}
+	}
+	return nil
+}
+
+// watchAuthentication reads wpa_supplicant events until one of them settles
+// whether the credentials work, or the deadline passes.
+func watchAuthentication(ctrl *wpaCtrl, deadline time.Time) error {
+	misses := 0
+	for {
+		event, err := ctrl.ReadEvent(deadline)
+		if err != nil {
+			if time.Now().After(deadline) {
+				return ErrValidationTimeout
+			}
+			return err
+		}
+		switch {
+		case strings.HasPrefix(event, "CTRL-EVENT-CONNECTED"):
+			return nil
+		case strings.Contains(event, "reason=WRONG_KEY"),
+			strings.Contains(event, "4-Way Handshake failed"):
+			return ErrWrongPassword
+		case strings.HasPrefix(event, "CTRL-EVENT-EAP-TLS-CERT-ERROR"):
+			return ErrServerCertificate
+		case strings.HasPrefix(event, "CTRL-EVENT-EAP-FAILURE"):
+			return ErrEAPFailure
+		case strings.HasPrefix(event, "CTRL-EVENT-NETWORK-NOT-FOUND"):
+			if misses++; misses >= notFoundScans {
+				return ErrNetworkNotFound
+			}
+		case strings.HasPrefix(event, "CTRL-EVENT-ASSOC-REJECT"),
+			strings.HasPrefix(event, "CTRL-EVENT-AUTH-REJECT"):
+			return ErrAssociationRejected
+		}
+	}
+}
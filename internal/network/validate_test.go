@@ -0,0 +1,86 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startFakeProbe listens on the probe's control socket and, once a client
+// attaches, replays the given events to it.
+func startFakeProbe(t *testing.T, path string, events ...string) {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Failed to listen on fake control socket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFromUnix(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUnix([]byte("OK\n"), addr)
+			if string(buf[:n]) == "ATTACH" {
+				for _, event := range events {
+					conn.WriteToUnix([]byte("<3>"+event), addr)
+				}
+			}
+		}
+	}()
+}
+
+func newTestValidator(t *testing.T) *Validator {
+	v := NewValidator("wlan_test", 500*time.Millisecond)
+	v.WorkDir = t.TempDir()
+	v.ctrlAttempts = 1
+	return v
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []string
+		want   error
+	}{
+		{"connected", []string{"CTRL-EVENT-SCAN-STARTED ", "CTRL-EVENT-CONNECTED - Connection to aa:bb:cc:dd:ee:ff completed [id=0 id_str=]"}, nil},
+		{"wrong key", []string{"CTRL-EVENT-SSID-TEMP-DISABLED id=0 ssid=\"HomeWiFi\" auth_failures=1 duration=10 reason=WRONG_KEY"}, ErrWrongPassword},
+		{"handshake failed", []string{"WPA: 4-Way Handshake failed - pre-shared key may be incorrect"}, ErrWrongPassword},
+		{"not found", []string{"CTRL-EVENT-NETWORK-NOT-FOUND", "CTRL-EVENT-NETWORK-NOT-FOUND", "CTRL-EVENT-NETWORK-NOT-FOUND"}, ErrNetworkNotFound},
+		{"eap failure", []string{"CTRL-EVENT-EAP-STARTED EAP authentication started", "CTRL-EVENT-EAP-FAILURE EAP authentication failed"}, ErrEAPFailure},
+		{"server certificate", []string{"CTRL-EVENT-EAP-TLS-CERT-ERROR reason=1 depth=0 subject='/CN=radius' err='unable to get local issuer certificate'"}, ErrServerCertificate},
+		{"rejected", []string{"CTRL-EVENT-ASSOC-REJECT bssid=aa:bb:cc:dd:ee:ff status_code=17"}, ErrAssociationRejected},
+		{"timeout", []string{"CTRL-EVENT-NETWORK-NOT-FOUND"}, ErrValidationTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := recordExecCommand(t)
+			v := newTestValidator(t)
+			startFakeProbe(t, filepath.Join(v.WorkDir, v.Probe), tt.events...)
+
+			err := v.Validate(ClientConfig{SSID: "HomeWiFi", Password: "secret123"})
+			if !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+				t.Fatalf("Expected %v, got %v", tt.want, err)
+			}
+			last := (*calls)[len(*calls)-1]
+			if last != "iw dev pifigo-probe del" {
+				t.Errorf("Probe interface was not removed, last command: %s", last)
+			}
+		})
+	}
+}
+
+func TestValidateUnsupported(t *testing.T) {
+	originalExec := ExecCommand
+	ExecCommand = func(name string, arg ...string) *exec.Cmd { return exec.Command("/bin/false") }
+	t.Cleanup(func() { ExecCommand = originalExec })
+
+	err := newTestValidator(t).Validate(ClientConfig{SSID: "HomeWiFi", Password: "secret123"})
+	if !errors.Is(err, ErrValidationUnsupported) {
+		t.Errorf("Expected ErrValidationUnsupported, got %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// wpaCtrlTimeout bounds how long a single control request may take.
+var wpaCtrlTimeout = 5 * time.Second
+
+var wpaCtrlSeq atomic.Int64
+
+// wpaCtrl is a client for the wpa_supplicant control interface, speaking the
+// same datagram protocol as wpa_cli.
+type wpaCtrl struct {
+	conn  *net.UnixConn
+	local string
+}
+
+// dialWpaCtrl connects to the control socket at path. The client binds its
+// own socket so wpa_supplicant has an address to reply to.
+func dialWpaCtrl(path string) (*wpaCtrl, error) {
+	local := filepath.Join(os.TempDir(), fmt.Sprintf("pifigo-wpa-%d-%d", os.Getpid(), wpaCtrlSeq.Add(1)))
+	laddr := &net.UnixAddr{Name: local, Net: "unixgram"}
+	raddr := &net.UnixAddr{Name: path, Net: "unixgram"}
+	conn, err := net.DialUnix("unixgram", laddr, raddr)
+	if err != nil {
+		os.Remove(local)
+		return nil, fmt.Errorf("failed to connect to wpa_supplicant at %s: %w", path, err)
+	}
+	return &wpaCtrl{conn: conn, local: local}, nil
+}
+
+// Request sends a command and returns the reply, skipping unsolicited event
+// messages. Replies of FAIL or UNKNOWN COMMAND are returned as errors.
+func (c *wpaCtrl) Request(cmd string) (string, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(wpaCtrlTimeout)); err != nil {
+		return "", err
+	}
+	if _, err := c.conn.Write([]byte(cmd)); err != nil {
+		return "", fmt.Errorf("wpa_supplicant %s: %w", commandName(cmd), err)
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return "", fmt.Errorf("wpa_supplicant %s: %w", commandName(cmd), err)
+		}
+		reply := string(buf[:n])
+		if strings.HasPrefix(reply, "<") {
+			continue
+		}
+		switch strings.TrimSpace(reply) {
+		case "FAIL", "UNKNOWN COMMAND":
+			return "", fmt.Errorf("wpa_supplicant %s: %s", commandName(cmd), strings.TrimSpace(reply))
+		}
+		return reply, nil
+	}
+}
+
+// Attach subscribes this connection to wpa_supplicant's event messages.
+func (c *wpaCtrl) Attach() error {
+	_, err := c.Request("ATTACH")
+	return err
+}
+
+// ReadEvent waits until the deadline for the next event message and returns
+// it without its "<level>" prefix.
+func (c *wpaCtrl) ReadEvent(deadline time.Time) (string, error) {
+	if err := c.conn.SetReadDeadline(deadline); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		msg := string(buf[:n])
+		if !strings.HasPrefix(msg, "<") {
+			continue
+		}
+		if i := strings.IndexByte(msg, '>'); i >= 0 {
+			msg = msg[i+1:]
+		}
+		return strings.TrimSpace(msg), nil
+	}
+}
+
+// Close releases the connection and removes the client socket.
+func (c *wpaCtrl) Close() error {
+	err := c.conn.Close()
+	os.Remove(c.local)
+	return err
+}
+
+// commandName returns the first word of a command, so that secrets passed as
+// arguments never end up in error messages.
+func commandName(cmd string) string {
+	if i := strings.IndexByte(cmd, ' '); i >= 0 {
+		return cmd[:i]
+	}
+	return cmd
+}
+
+// parseKeyValues parses the key=value lines of a STATUS style reply.
+func parseKeyValues(reply string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(reply, "\n") {
+		if key, value, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+			values[key] = value
+		}
+	}
+	return values
+}
@@ -0,0 +1,415 @@
+package network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"pifigo/internal/config"
+)
+
+// Default locations used by the wpa_supplicant backend.
+const (
+	WpaSupplicantDir = "/etc/wpa_supplicant"
+	WpaCtrlDir       = "/var/run/wpa_supplicant"
+	NetworkdDir      = "/etc/systemd/network"
+)
+
+// WpaSupplicant drives the network with wpa_supplicant and systemd-networkd,
+// for minimal images without netplan or NetworkManager. Client networks are
+// written to wpa_supplicant-<iface>.conf and selected over the control socket;
+// addressing is handled by a .network file. The hotspot uses hostapd and
+// dnsmasq, like the netplan backend.
+type WpaSupplicant struct {
+	Interface   string
+	ConfigDir   string
+	CtrlDir     string
+	NetworkdDir string
+	// Saved, if set, lists the saved networks. They are written to the
+	// config file after the one being connected, so wpa_supplicant can
+	// choose between them by priority when it restarts.
+	Saved        func() ([]ClientConfig, error)
+	ctrlAttempts int
+	cfg          *config.Config
+}
+
+// NewWpaSupplicant returns a wpa_supplicant backend using the standard file
+// locations.
+func NewWpaSupplicant(cfg *config.Config) *WpaSupplicant {
+	return &WpaSupplicant{
+		Interface:    cfg.Network.WirelessInterface,
+		ConfigDir:    WpaSupplicantDir,
+		CtrlDir:      WpaCtrlDir,
+		NetworkdDir:  NetworkdDir,
+		ctrlAttempts: 10,
+		cfg:          cfg,
+	}
+}
+
+const wpaHeaderTemplate = `ctrl_interface=DIR={{.CtrlDir}} GROUP=netdev
+update_config=1
+{{- if .Country}}
+country={{.Country}}
+{{- end}}
+
+`
+
+const networkdTemplate = `[Match]
+Name={{.Interface}}
+
+[Network]
+{{- if .Address}}
+Address={{.Address}}
+{{- if .Gateway}}
+Gateway={{.Gateway}}
+{{- end}}
+{{- range .DNS}}
+DNS={{.}}
+{{- end}}
+{{- else}}
+DHCP=yes
+{{- end}}
+`
+
+// Name implements NetworkBackend.
+func (w *WpaSupplicant) Name() string { return BackendWpaSupplicant }
+
+// Render produces a wpa_supplicant network block.
+func (w *WpaSupplicant) Render(c ClientConfig) ([]byte, error) {
+	return renderWpaNetwork(c)
+}
+
+// isHexPSK reports whether password is a raw 256-bit PSK written as 64 hex
+// digits, which wpa_supplicant takes unquoted instead of a passphrase.
+func isHexPSK(password string) bool {
+	if len(password) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(password)
+	return err == nil
+}
+
+// renderWpaNetwork produces a wpa_supplicant network block for the network.
+func renderWpaNetwork(c ClientConfig) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("network={\n")
+	fmt.Fprintf(&buf, "\tssid=%s\n", wpaString(c.SSID))
+	if c.Hidden {
+		buf.WriteString("\tscan_ssid=1\n")
+	}
+	if c.Priority != 0 {
+		fmt.Fprintf(&buf, "\tpriority=%d\n", c.Priority)
+	}
+	security, err := c.security()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case security == SecurityEAP:
+		writeWpaEAP(&buf, c.EAP)
+	case security == SecurityOpen:
+		buf.WriteString("\tkey_mgmt=NONE\n")
+	case isHexPSK(c.Password):
+		// SAE cannot use a pre-computed key, so a transition mode network
+		// is joined with WPA2.
+		buf.WriteString("\tkey_mgmt=WPA-PSK\n")
+		fmt.Fprintf(&buf, "\tpsk=%s\n", c.Password)
+	default:
+		if strings.ContainsAny(c.Password, "\"\n") {
+			return nil, fmt.Errorf("passphrase contains characters wpa_supplicant cannot store")
+		}
+		switch security {
+		case SecurityWPA3SAE:
+			buf.WriteString("\tkey_mgmt=SAE\n\tieee80211w=2\n")
+		case SecurityWPA3Transition:
+			buf.WriteString("\tkey_mgmt=WPA-PSK SAE\n\tieee80211w=1\n")
+		default:
+			buf.WriteString("\tkey_mgmt=WPA-PSK\n")
+		}
+		fmt.Fprintf(&buf, "\tpsk=\"%s\"\n", c.Password)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes(), nil
+}
+
+// Connect renders the network block and applies it.
+func (w *WpaSupplicant) Connect(c ClientConfig) error {
+	ip := c.IP.Or(DefaultIP(w.cfg))
+	if err := ip.Validate(); err != nil {
+		return err
+	}
+	profile, err := w.Render(c)
+	if err != nil {
+		return err
+	}
+	return w.apply(profile, w.savedBlocks(c.SSID), ip)
+}
+
+// savedBlocks renders the network blocks of the saved networks other than
+// ssid. A network that cannot be rendered is left out.
+func (w *WpaSupplicant) savedBlocks(ssid string) []byte {
+	if w.Saved == nil {
+		return nil
+	}
+	saved, err := w.Saved()
+	if err != nil {
+		log.Printf("WARNING: Could not read saved networks for %s: %v", w.configPath(), err)
+	}
+	var blocks []byte
+	for _, c := range saved {
+		if c.SSID == ssid {
+			continue
+		}
+		block, err := renderWpaNetwork(c)
+		if err != nil {
+			log.Printf("WARNING: Leaving %s out of %s: %v", c.SSID, w.configPath(), err)
+			continue
+		}
+		blocks = append(append(blocks, '\n'), block...)
+	}
+	return blocks
+}
+
+// apply writes the network block, followed by the blocks of the other saved
+// networks, and a .network file with the addressing, then selects the
+// network over the control socket.
+func (w *WpaSupplicant) apply(profile, saved []byte, ip IPConfig) error {
+	settings, err := parseNetworkBlock(profile)
+	if err != nil {
+		return err
+	}
+	header, err := w.render("wpa_supplicant", wpaHeaderTemplate, map[string]string{"CtrlDir": w.CtrlDir, "Country": w.cfg.Network.WifiCountry})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(w.ConfigDir, 0755); err != nil {
+		return fmt.Errorf("failed to create wpa_supplicant directory: %w", err)
+	}
+	if err := os.WriteFile(w.configPath(), append(append(header, profile...), saved...), 0600); err != nil {
+		return fmt.Errorf("failed to write wpa_supplicant config: %w", err)
+	}
+	if ip.Mode != IPModeStatic {
+		ip = IPConfig{}
+	}
+	if err := w.writeNetworkFile(ip); err != nil {
+		return err
+	}
+	if err := w.StopHotspot(); err != nil {
+		return err
+	}
+	if err := run("networkctl", "reload"); err != nil {
+		return err
+	}
+	if err := run("systemctl", "start", w.unit()); err != nil {
+		return err
+	}
+	return w.selectNetwork(settings)
+}
+
+// Disconnect removes the client configuration and stops wpa_supplicant.
+func (w *WpaSupplicant) Disconnect() error {
+	for _, path := range []string{w.configPath(), w.networkPath()} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+	return run("systemctl", "stop", w.unit())
+}
+
+// StartHotspot disconnects, gives the interface its static hotspot address
+// and restarts hostapd and dnsmasq.
+func (w *WpaSupplicant) StartHotspot() error {
+	if err := w.Disconnect(); err != nil {
+		return err
+	}
+	if err := w.writeNetworkFile(IPConfig{Address: w.cfg.Network.ApIpAddress}); err != nil {
+		return err
+	}
+	if err := run("networkctl", "reload"); err != nil {
+		return err
+	}
+	return run("systemctl", "restart", "hostapd", "dnsmasq")
+}
+
+// StopHotspot stops hostapd and dnsmasq.
+func (w *WpaSupplicant) StopHotspot() error {
+	return run("systemctl", "stop", "hostapd", "dnsmasq")
+}
+
+// Reassociate asks the running wpa_supplicant to rejoin the network.
+func (w *WpaSupplicant) Reassociate() error {
+	ctrl, err := dialWpaCtrl(w.ctrlPath())
+	if err != nil {
+		return err
+	}
+	defer ctrl.Close()
+	_, err = ctrl.Request("REASSOCIATE")
+	return err
+}
+
+// Restart restarts wpa_supplicant, which rereads its config file.
+func (w *WpaSupplicant) Restart() error {
+	return run("systemctl", "restart", w.unit())
+}
+
+// Status reports client mode when a wpa_supplicant config exists, and reads
+// the association state from the control socket when it is reachable.
+func (w *WpaSupplicant) Status() (Status, error) {
+	st := Status{Backend: w.Name(), Interface: w.Interface, Mode: ModeHotspot}
+	if _, err := os.Stat(w.configPath()); os.IsNotExist(err) {
+		return st, nil
+	} else if err != nil {
+		return st, err
+	}
+	st.Mode = ModeClient
+	st.IPAddress = InterfaceIPv4(w.Interface)
+	ctrl, err := dialWpaCtrl(w.ctrlPath())
+	if err != nil {
+		return st, nil
+	}
+	defer ctrl.Close()
+	reply, err := ctrl.Request("STATUS")
+	if err != nil {
+		return st, nil
+	}
+	values := parseKeyValues(reply)
+	st.SSID = values["ssid"]
+	st.Associated = values["wpa_state"] == "COMPLETED"
+	if ip := values["ip_address"]; ip != "" {
+		st.IPAddress = ip
+	}
+	return st, nil
+}
+
+// selectNetwork replaces the networks known to the running wpa_supplicant
+// with the given settings and selects it.
+func (w *WpaSupplicant) selectNetwork(settings [][2]string) error {
+	ctrl, err := w.waitForCtrl()
+	if err != nil {
+		// wpa_supplicant reads the config file we just wrote when it starts,
+		// so a missing control socket is not fatal.
+		log.Printf("WARNING: %v; relying on %s", err, w.configPath())
+		return nil
+	}
+	defer ctrl.Close()
+	if _, err := ctrl.Request("REMOVE_NETWORK all"); err != nil {
+		return err
+	}
+	reply, err := ctrl.Request("ADD_NETWORK")
+	if err != nil {
+		return err
+	}
+	id := strings.TrimSpace(reply)
+	for _, kv := range settings {
+		if _, err := ctrl.Request(fmt.Sprintf("SET_NETWORK %s %s %s", id, kv[0], kv[1])); err != nil {
+			return err
+		}
+	}
+	_, err = ctrl.Request("SELECT_NETWORK " + id)
+	return err
+}
+
+// waitForCtrl gives a freshly started wpa_supplicant time to create its socket.
+func (w *WpaSupplicant) waitForCtrl() (*wpaCtrl, error) {
+	return waitForCtrl(w.ctrlPath(), w.ctrlAttempts)
+}
+
+// waitForCtrl dials the control socket at path, retrying while it appears.
+func waitForCtrl(path string, attempts int) (*wpaCtrl, error) {
+	var err error
+	for i := 0; i < attempts; i++ {
+		var ctrl *wpaCtrl
+		if ctrl, err = dialWpaCtrl(path); err == nil {
+			return ctrl, nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return nil, err
+}
+
+// writeNetworkFile writes the systemd-networkd file for the interface. An
+// empty address means DHCP.
+func (w *WpaSupplicant) writeNetworkFile(ip IPConfig) error {
+	data := struct {
+		Interface string
+		IPConfig
+	}{w.Interface, ip}
+	content, err := w.render("networkd", networkdTemplate, data)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(w.NetworkdDir, 0755); err != nil {
+		return fmt.Errorf("failed to create networkd directory: %w", err)
+	}
+	if err := os.WriteFile(w.networkPath(), content, 0644); err != nil {
+		return fmt.Errorf("failed to write networkd config: %w", err)
+	}
+	return nil
+}
+
+func (w *WpaSupplicant) render(name, tmplStr string, data any) ([]byte, error) {
+	tmpl, err := template.New(name).Parse(tmplStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s template: %w", name, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to execute %s template: %w", name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (w *WpaSupplicant) unit() string { return "wpa_supplicant@" + w.Interface }
+
+func (w *WpaSupplicant) configPath() string {
+	return filepath.Join(w.ConfigDir, "wpa_supplicant-"+w.Interface+".conf")
+}
+
+func (w *WpaSupplicant) ctrlPath() string { return filepath.Join(w.CtrlDir, w.Interface) }
+
+func (w *WpaSupplicant) networkPath() string {
+	return filepath.Join(w.NetworkdDir, "50-pifigo-"+w.Interface+".network")
+}
+
+// wpaString encodes an SSID for wpa_supplicant: quoted when that is
+// unambiguous, otherwise as unquoted hex.
+func wpaString(s string) string {
+	for _, r := range s {
+		if r < 0x20 || r > 0x7e || r == '"' {
+			return hex.EncodeToString([]byte(s))
+		}
+	}
+	return `"` + s + `"`
+}
+
+// parseNetworkBlock returns the key/value pairs of a rendered network block,
+// in order. Values keep their quoting, which is what SET_NETWORK expects.
+func parseNetworkBlock(profile []byte) ([][2]string, error) {
+	var settings [][2]string
+	inBlock := false
+	for _, line := range strings.Split(string(profile), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "network={":
+			inBlock = true
+		case line == "}":
+			inBlock = false
+		case inBlock && line != "" && !strings.HasPrefix(line, "#"):
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				return nil, fmt.Errorf("malformed line in network block: %q", key)
+			}
+			settings = append(settings, [2]string{key, value})
+		}
+	}
+	if len(settings) == 0 {
+		return nil, fmt.Errorf("profile does not contain a wpa_supplicant network block")
+	}
+	return settings, nil
+}
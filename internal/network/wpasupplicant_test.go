@@ -0,0 +1,272 @@
+package network
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"pifigo/internal/config"
+)
+
+// fakeWpaSupplicant listens on a control socket, records the commands it
+// receives and answers them like wpa_supplicant would.
+type fakeWpaSupplicant struct {
+	mu       sync.Mutex
+	commands []string
+	conn     *net.UnixConn
+}
+
+func startFakeWpaSupplicant(t *testing.T, path string) *fakeWpaSupplicant {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Failed to listen on fake control socket: %v", err)
+	}
+	f := &fakeWpaSupplicant{conn: conn}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFromUnix(buf)
+			if err != nil {
+				return
+			}
+			cmd := string(buf[:n])
+			f.mu.Lock()
+			f.commands = append(f.commands, cmd)
+			f.mu.Unlock()
+			reply := "OK\n"
+			switch {
+			case cmd == "ADD_NETWORK":
+				// An unsolicited event arrives before the reply.
+				conn.WriteToUnix([]byte("<3>CTRL-EVENT-SCAN-STARTED "), addr)
+				reply = "0\n"
+			case cmd == "STATUS":
+				reply = "bssid=aa:bb:cc:dd:ee:ff\nssid=HomeWiFi\nwpa_state=COMPLETED\nip_address=192.168.1.20\n"
+			case strings.HasPrefix(cmd, "SET_NETWORK 0 bogus"):
+				reply = "FAIL\n"
+			}
+			conn.WriteToUnix([]byte(reply), addr)
+		}
+	}()
+	return f
+}
+
+func (f *fakeWpaSupplicant) Commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+func newTestWpaSupplicant(t *testing.T) *WpaSupplicant {
+	tmpDir := t.TempDir()
+	cfg := &config.Config{}
+	cfg.Network.WirelessInterface = "wlan_test"
+	cfg.Network.ApIpAddress = "192.168.100.1/24"
+	cfg.Network.WifiCountry = "US"
+	w := NewWpaSupplicant(cfg)
+	w.ConfigDir = filepath.Join(tmpDir, "wpa_supplicant")
+	w.CtrlDir = tmpDir
+	w.NetworkdDir = filepath.Join(tmpDir, "network")
+	w.ctrlAttempts = 1
+	return w
+}
+
+func TestWpaSupplicantRender(t *testing.T) {
+	w := newTestWpaSupplicant(t)
+	profile, err := w.Render(ClientConfig{SSID: "HomeWiFi", Password: `se\cret`})
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	expected := "network={\n\tssid=\"HomeWiFi\"\n\tkey_mgmt=WPA-PSK\n\tpsk=\"se\\cret\"\n}\n"
+	if string(profile) != expected {
+		t.Errorf("Unexpected network block:\n got: %q\nwant: %q", profile, expected)
+	}
+
+	profile, _ = w.Render(ClientConfig{SSID: `Café "5G"`})
+	if !strings.Contains(string(profile), "ssid=436166c3a92022354722\n") || !strings.Contains(string(profile), "key_mgmt=NONE") {
+		t.Errorf("Expected hex SSID and no key management, got:\n%s", profile)
+	}
+
+	eap := &EAPConfig{Method: EAPTTLS, Identity: "alice", Password: "secret", Phase2: "pap", CACert: "/etc/pifigo/certs/ca.pem"}
+	profile, err = w.Render(ClientConfig{SSID: "eduroam", EAP: eap})
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	for _, want := range []string{"key_mgmt=WPA-EAP WPA-EAP-SHA256", "eap=TTLS", `identity="alice"`, `password="secret"`, `phase2="auth=PAP"`, `ca_cert="/etc/pifigo/certs/ca.pem"`} {
+		if !strings.Contains(string(profile), want) {
+			t.Errorf("Expected %q in the EAP network block:\n%s", want, profile)
+		}
+	}
+	eap.Method = EAPTLS
+	if _, err := w.Render(ClientConfig{SSID: "eduroam", EAP: eap}); err == nil {
+		t.Error("Expected EAP-TLS without a client certificate to be rejected")
+	}
+
+	profile, _ = w.Render(ClientConfig{SSID: "Modern", Password: "correct horse", Security: SecurityWPA3SAE, Hidden: true})
+	if !strings.Contains(string(profile), "\tscan_ssid=1\n\tkey_mgmt=SAE\n\tieee80211w=2\n") {
+		t.Errorf("Expected a hidden WPA3-SAE network block, got:\n%s", profile)
+	}
+	profile, _ = w.Render(ClientConfig{SSID: "Mixed", Password: "secret123", Security: SecurityWPA3Transition})
+	if !strings.Contains(string(profile), "\tkey_mgmt=WPA-PSK SAE\n\tieee80211w=1\n") {
+		t.Errorf("Expected a transition mode network block, got:\n%s", profile)
+	}
+
+	pmk := strings.Repeat("0123456789abcdef", 4)
+	profile, _ = w.Render(ClientConfig{SSID: "HomeWiFi", Password: pmk})
+	if !strings.Contains(string(profile), "\tpsk="+pmk+"\n") {
+		t.Errorf("Expected a 64 hex digit PSK to be written unquoted, got:\n%s", profile)
+	}
+
+	if _, err := w.Render(ClientConfig{SSID: "HomeWiFi", Password: `bad"quote`}); err == nil {
+		t.Error("Expected an error for a passphrase containing a quote")
+	}
+}
+
+func TestWpaSupplicantConnect(t *testing.T) {
+	calls := recordExecCommand(t)
+	w := newTestWpaSupplicant(t)
+	wpa := startFakeWpaSupplicant(t, filepath.Join(w.CtrlDir, "wlan_test"))
+
+	if err := w.Connect(ClientConfig{SSID: "HomeWiFi", Password: "secret123"}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	conf, err := os.ReadFile(filepath.Join(w.ConfigDir, "wpa_supplicant-wlan_test.conf"))
+	if err != nil {
+		t.Fatalf("wpa_supplicant config was not written: %v", err)
+	}
+	if !strings.Contains(string(conf), "ctrl_interface=DIR="+w.CtrlDir) || !strings.Contains(string(conf), "country=US") || !strings.Contains(string(conf), `ssid="HomeWiFi"`) {
+		t.Errorf("Unexpected wpa_supplicant config:\n%s", conf)
+	}
+	network, _ := os.ReadFile(filepath.Join(w.NetworkdDir, "50-pifigo-wlan_test.network"))
+	if !strings.Contains(string(network), "Name=wlan_test") || !strings.Contains(string(network), "DHCP=yes") {
+		t.Errorf("Unexpected .network file:\n%s", network)
+	}
+
+	expected := []string{
+		"REMOVE_NETWORK all",
+		"ADD_NETWORK",
+		`SET_NETWORK 0 ssid "HomeWiFi"`,
+		"SET_NETWORK 0 key_mgmt WPA-PSK",
+		`SET_NETWORK 0 psk "secret123"`,
+		"SELECT_NETWORK 0",
+	}
+	if got := wpa.Commands(); strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Errorf("Unexpected control commands:\n got: %v\nwant: %v", got, expected)
+	}
+	expectedExec := []string{"systemctl stop hostapd dnsmasq", "networkctl reload", "systemctl start wpa_supplicant@wlan_test"}
+	if strings.Join(*calls, "|") != strings.Join(expectedExec, "|") {
+		t.Errorf("Unexpected commands:\n got: %v\nwant: %v", *calls, expectedExec)
+	}
+
+	st, err := w.Status()
+	if err != nil || st.Mode != ModeClient || st.SSID != "HomeWiFi" || !st.Associated {
+		t.Errorf("Unexpected status %+v (err: %v)", st, err)
+	}
+}
+
+func TestWpaSupplicantSavedNetworks(t *testing.T) {
+	recordExecCommand(t)
+	w := newTestWpaSupplicant(t)
+	wpa := startFakeWpaSupplicant(t, filepath.Join(w.CtrlDir, "wlan_test"))
+	w.Saved = func() ([]ClientConfig, error) {
+		return []ClientConfig{
+			{SSID: "Office", Password: "officepass", Priority: 10},
+			{SSID: "HomeWiFi", Password: "secret123", Priority: 5},
+			{SSID: "Broken", Password: `bad"quote`},
+			{SSID: "Cafe"},
+		}, nil
+	}
+
+	if err := w.Connect(ClientConfig{SSID: "HomeWiFi", Password: "secret123", Priority: 5}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	conf, _ := os.ReadFile(filepath.Join(w.ConfigDir, "wpa_supplicant-wlan_test.conf"))
+	blocks := strings.Split(string(conf), "network={")[1:]
+	expected := []string{`ssid="HomeWiFi"` + "\n\tpriority=5", `ssid="Office"` + "\n\tpriority=10", `ssid="Cafe"` + "\n\tkey_mgmt=NONE"}
+	if len(blocks) != len(expected) {
+		t.Fatalf("Expected %d network blocks, got:\n%s", len(expected), conf)
+	}
+	for i, want := range expected {
+		if !strings.Contains(blocks[i], want) {
+			t.Errorf("Expected block %d to contain %q, got:\n%s", i, want, blocks[i])
+		}
+	}
+	// Only the network being connected is selected in the running wpa_supplicant.
+	for _, cmd := range wpa.Commands() {
+		if strings.Contains(cmd, "Office") {
+			t.Errorf("Unexpected control command for another network: %s", cmd)
+		}
+	}
+}
+
+func TestWpaSupplicantStaticNetworkFile(t *testing.T) {
+	w := newTestWpaSupplicant(t)
+	ip := IPConfig{Mode: IPModeStatic, Address: "192.168.1.150/24", Gateway: "192.168.1.1", DNS: []string{"8.8.8.8", "1.1.1.1"}}
+	if err := w.writeNetworkFile(ip); err != nil {
+		t.Fatalf("writeNetworkFile failed: %v", err)
+	}
+	network, _ := os.ReadFile(filepath.Join(w.NetworkdDir, "50-pifigo-wlan_test.network"))
+	for _, want := range []string{"Address=192.168.1.150/24", "Gateway=192.168.1.1", "DNS=8.8.8.8\nDNS=1.1.1.1"} {
+		if !strings.Contains(string(network), want) {
+			t.Errorf("Expected %q in the .network file:\n%s", want, network)
+		}
+	}
+	if strings.Contains(string(network), "DHCP") {
+		t.Errorf("A static .network file should not enable DHCP:\n%s", network)
+	}
+}
+
+func TestWpaSupplicantConnectFailure(t *testing.T) {
+	recordExecCommand(t)
+	w := newTestWpaSupplicant(t)
+	startFakeWpaSupplicant(t, filepath.Join(w.CtrlDir, "wlan_test"))
+
+	err := w.apply([]byte("network={\n\tbogus=\"secret\"\n}\n"), nil, IPConfig{})
+	if err == nil || !strings.Contains(err.Error(), "SET_NETWORK: FAIL") {
+		t.Errorf("Expected a SET_NETWORK failure, got: %v", err)
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("Error message leaks the network settings: %v", err)
+	}
+}
+
+func TestWpaSupplicantHotspot(t *testing.T) {
+	recordExecCommand(t)
+	w := newTestWpaSupplicant(t)
+	os.MkdirAll(w.ConfigDir, 0755)
+	os.WriteFile(filepath.Join(w.ConfigDir, "wpa_supplicant-wlan_test.conf"), []byte("..."), 0600)
+
+	if err := w.StartHotspot(); err != nil {
+		t.Fatalf("StartHotspot failed: %v", err)
+	}
+	if st, _ := w.Status(); st.Mode != ModeHotspot {
+		t.Errorf("Expected hotspot mode, got %s", st.Mode)
+	}
+	network, _ := os.ReadFile(filepath.Join(w.NetworkdDir, "50-pifigo-wlan_test.network"))
+	if !strings.Contains(string(network), "Address=192.168.100.1/24") {
+		t.Errorf("Expected static hotspot address, got:\n%s", network)
+	}
+}
+
+func TestWpaSupplicantRecover(t *testing.T) {
+	calls := recordExecCommand(t)
+	w := newTestWpaSupplicant(t)
+	wpa := startFakeWpaSupplicant(t, filepath.Join(w.CtrlDir, "wlan_test"))
+
+	if err := w.Reassociate(); err != nil {
+		t.Fatalf("Reassociate failed: %v", err)
+	}
+	if got := wpa.Commands(); len(got) != 1 || got[0] != "REASSOCIATE" {
+		t.Errorf("Unexpected control commands: %v", got)
+	}
+	if err := w.Restart(); err != nil {
+		t.Fatalf("Restart failed: %v", err)
+	}
+	if len(*calls) != 1 || (*calls)[0] != "systemctl restart wpa_supplicant@wlan_test" {
+		t.Errorf("Unexpected commands: %v", *calls)
+	}
+}
@@ -0,0 +1,237 @@
+package probe
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"pifigo/internal/network"
+)
+
+// Layers of a health report, from the radio link up.
+const (
+	LayerLink     = "link"
+	LayerIP       = "ip"
+	LayerGateway  = "gateway"
+	LayerDNS      = "dns"
+	LayerInternet = "internet"
+)
+
+// Verdict is the overall diagnosis of a health report: the lowest layer that
+// failed, or VerdictOK.
+type Verdict string
+
+const (
+	VerdictOK            Verdict = "ok"
+	VerdictNoLink        Verdict = "no_link"
+	VerdictNoIP          Verdict = "no_ip"
+	VerdictNoGateway     Verdict = "no_gateway"
+	VerdictNoDNS         Verdict = "no_dns"
+	VerdictCaptivePortal Verdict = "captive_portal"
+	VerdictNoInternet    Verdict = "no_internet"
+)
+
+// String describes the verdict for logs and status output.
+func (v Verdict) String() string {
+	switch v {
+	case VerdictOK:
+		return "online"
+	case VerdictNoLink:
+		return "not associated with the network"
+	case VerdictNoIP:
+		return "no IP address"
+	case VerdictNoGateway:
+		return "gateway unreachable"
+	case VerdictNoDNS:
+		return "DNS does not resolve"
+	case VerdictCaptivePortal:
+		return "captive portal upstream"
+	case VerdictNoInternet:
+		return "no internet access"
+	}
+	return string(v)
+}
+
+// ErrCaptivePortal is returned by the HTTP probe when the answer looks like
+// it came from a captive portal rather than the real server.
+var ErrCaptivePortal = errors.New("intercepted, likely by a captive portal")
+
+// ArpTable is read to tell whether the gateway answers ARP when it ignores ping.
+var ArpTable = "/proc/net/arp"
+
+// Check is one line of a health report.
+type Check struct {
+	Layer   string `json:"layer"`
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// Report is a layered diagnosis of the client connection.
+type Report struct {
+	Verdict Verdict   `json:"verdict"`
+	Checks  []Check   `json:"checks"`
+	Time    time.Time `json:"time"`
+}
+
+// Online reports whether the configured probes passed.
+func (r Report) Online() bool { return r.Verdict == VerdictOK }
+
+// Summary describes the verdict followed by the failed checks, for logging.
+func (r Report) Summary() string {
+	var failed []string
+	for _, c := range r.Checks {
+		if !c.OK && !c.Skipped {
+			failed = append(failed, c.Name+": "+c.Detail)
+		}
+	}
+	if len(failed) == 0 {
+		return r.Verdict.String()
+	}
+	return r.Verdict.String() + " (" + strings.Join(failed, "; ") + ")"
+}
+
+// Diagnose checks the connection layer by layer: association, IP lease,
+// gateway, DNS and finally the set's probes. The device is online when the
+// probes pass, whatever the lower layers report; otherwise the verdict names
+// the lowest layer that failed, or a captive portal when the lower layers
+// work but a probe was intercepted.
+func Diagnose(ctx context.Context, set *Set, st network.Status, iface string) Report {
+	type probeRun struct {
+		ok      bool
+		results []Result
+	}
+	done := make(chan probeRun, 1)
+	go func() {
+		ok, results := set.Run(ctx)
+		done <- probeRun{ok, results}
+	}()
+
+	linkDetail := "not associated"
+	if st.Associated {
+		linkDetail = st.SSID
+	}
+	ipDetail := "no address"
+	if st.IPAddress != "" {
+		ipDetail = st.IPAddress
+	}
+	checks := []Check{
+		{Layer: LayerLink, Name: "associated", OK: st.Associated, Detail: linkDetail},
+		{Layer: LayerIP, Name: "ip lease", OK: st.IPAddress != "", Detail: ipDetail},
+		checkGateway(ctx, iface),
+	}
+	run := <-done
+	checks = append(checks, checkDNS(ctx, set, run.results))
+	for _, r := range run.results {
+		c := Check{Layer: LayerInternet, Name: r.Name, OK: r.Err == nil, Detail: r.Duration.Round(time.Millisecond).String()}
+		if r.Err != nil {
+			c.Detail = r.Err.Error()
+		}
+		checks = append(checks, c)
+	}
+
+	report := Report{Verdict: VerdictOK, Checks: checks, Time: time.Now()}
+	if run.ok {
+		return report
+	}
+	verdicts := map[string]Verdict{LayerLink: VerdictNoLink, LayerIP: VerdictNoIP, LayerGateway: VerdictNoGateway, LayerDNS: VerdictNoDNS}
+	for _, c := range checks {
+		if v, ok := verdicts[c.Layer]; ok && !c.OK && !c.Skipped {
+			report.Verdict = v
+			return report
+		}
+	}
+	report.Verdict = VerdictNoInternet
+	for _, r := range run.results {
+		if errors.Is(r.Err, ErrCaptivePortal) {
+			report.Verdict = VerdictCaptivePortal
+		}
+	}
+	return report
+}
+
+// checkGateway pings the default gateway. A gateway that ignores ping but
+// answers ARP still counts as reachable.
+func checkGateway(ctx context.Context, iface string) Check {
+	c := Check{Layer: LayerGateway, Name: "gateway"}
+	gw, err := DefaultGateway(iface)
+	if err != nil {
+		c.Detail = err.Error()
+		return c
+	}
+	c.Name = "gateway " + gw.String()
+	if err := (&ICMP{Host: gw.String()}).Check(ctx); err == nil {
+		c.OK, c.Detail = true, "answers ping"
+	} else if inArpTable(gw, iface) {
+		c.OK, c.Detail = true, "answers ARP only"
+	} else {
+		c.Detail = "no answer to ping or ARP"
+	}
+	return c
+}
+
+// checkDNS reports on name resolution. The set's own DNS probes are used if
+// it has any; otherwise the host names of its HTTP probes are resolved with
+// the system resolver.
+func checkDNS(ctx context.Context, set *Set, results []Result) Check {
+	c := Check{Layer: LayerDNS, Name: "dns"}
+	var hosts []string
+	for i, p := range set.Probes {
+		switch p := p.(type) {
+		case *DNS:
+			c.Name = "dns probes"
+			if results[i].Err == nil {
+				c.OK, c.Detail = true, p.Host+" resolves"
+				return c
+			}
+			c.Detail = results[i].Err.Error()
+		case *HTTP:
+			if u, err := url.Parse(p.URL); err == nil && net.ParseIP(u.Hostname()) == nil {
+				hosts = append(hosts, u.Hostname())
+			}
+		}
+	}
+	if c.Detail != "" {
+		return c
+	}
+	if len(hosts) == 0 {
+		c.Skipped, c.Detail = true, "no host names to resolve"
+		return c
+	}
+	for _, host := range hosts {
+		if err := (&DNS{Host: host}).Check(ctx); err != nil {
+			c.Detail = err.Error()
+			continue
+		}
+		c.OK, c.Detail = true, host+" resolves"
+		return c
+	}
+	return c
+}
+
+// inArpTable reports whether the kernel has a complete ARP entry for ip.
+func inArpTable(ip net.IP, iface string) bool {
+	f, err := os.Open(ArpTable)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// IP address, HW type, Flags, HW address, Mask, Device.
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 6 || fields[0] != ip.String() || (iface != "" && fields[5] != iface) {
+			continue
+		}
+		if fields[2] == "0x2" {
+			return true
+		}
+	}
+	return false
+}
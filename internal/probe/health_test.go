@@ -0,0 +1,66 @@
+package probe
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"pifigo/internal/network"
+)
+
+// TestDiagnose verifies the verdict names the lowest failing layer, and that
+// an intercepted probe on a working link is reported as a captive portal.
+func TestDiagnose(t *testing.T) {
+	tmpDir := t.TempDir()
+	RouteTable = filepath.Join(tmpDir, "route")
+	ArpTable = filepath.Join(tmpDir, "arp")
+	defer func() { RouteTable, ArpTable = "/proc/net/route", "/proc/net/arp" }()
+	os.WriteFile(RouteTable, []byte("Iface\tDestination\tGateway\nwlan0\t00000000\t0101A8C0\n"), 0644)
+	os.WriteFile(ArpTable, []byte("IP address       HW type     Flags       HW address            Mask     Device\n192.168.1.1      0x1         0x2         aa:bb:cc:dd:ee:ff     *        wlan0\n"), 0644)
+	// The gateway ignores ping.
+	ExecCommand = func(string, ...string) *exec.Cmd { return exec.Command("/bin/false") }
+	defer func() { ExecCommand = exec.Command }()
+
+	portal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/generate_204" {
+			http.Redirect(w, r, "http://login.hotel.example/", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer portal.Close()
+	intercepted := &Set{Probes: []Probe{&HTTP{URL: portal.URL + "/generate_204"}}, Mode: ModeAny}
+	linked := network.Status{Mode: network.ModeClient, SSID: "Hotel", Associated: true, IPAddress: "192.168.1.20"}
+
+	report := Diagnose(context.Background(), intercepted, linked, "wlan0")
+	if report.Verdict != VerdictCaptivePortal || report.Online() {
+		t.Errorf("Expected a captive portal, got %s", report.Summary())
+	}
+	for _, c := range report.Checks {
+		if c.Layer == LayerGateway && (!c.OK || c.Detail != "answers ARP only") {
+			t.Errorf("Expected the gateway to be reachable through ARP, got %+v", c)
+		}
+		if c.Layer == LayerDNS && !c.Skipped {
+			t.Errorf("Expected no DNS check for an IP address URL, got %+v", c)
+		}
+	}
+
+	report = Diagnose(context.Background(), intercepted, network.Status{Mode: network.ModeClient, Associated: true}, "wlan0")
+	if report.Verdict != VerdictNoIP {
+		t.Errorf("Expected no IP address, got %s", report.Summary())
+	}
+	os.Remove(ArpTable)
+	if report = Diagnose(context.Background(), intercepted, linked, "wlan0"); report.Verdict != VerdictNoGateway {
+		t.Errorf("Expected an unreachable gateway, got %s", report.Summary())
+	}
+
+	// Passing probes mean online, whatever the backend reports.
+	working := &Set{Probes: []Probe{&HTTP{URL: portal.URL + "/ok"}}, Mode: ModeAny}
+	if report = Diagnose(context.Background(), working, network.Status{}, "wlan0"); !report.Online() {
+		t.Errorf("Expected online, got %s", report.Summary())
+	}
+}
@@ -0,0 +1,406 @@
+// Package probe decides whether the device is online. A Set runs several
+// connectivity probes (HTTP, DNS, TCP, ICMP and default-gateway checks)
+// concurrently and combines their results, so one blocked service does not
+// make a working network look offline.
+package probe
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pifigo/internal/config"
+	"pifigo/internal/network"
+)
+
+// Probe types, as used by watchdog.probes[].type in config.yaml.
+const (
+	TypeHTTP    = "http"
+	TypeDNS     = "dns"
+	TypeTCP     = "tcp"
+	TypeICMP    = "icmp"
+	TypeGateway = "gateway"
+)
+
+// Modes for combining probe results, as used by watchdog.probe_mode.
+const (
+	ModeAny    = "any"    // Online if any probe passes.
+	ModeAll    = "all"    // Online only if every probe passes.
+	ModeQuorum = "quorum" // Online if at least Quorum probes pass.
+)
+
+// DefaultTimeout applies to probes without timeout_seconds.
+const DefaultTimeout = 5 * time.Second
+
+var (
+	// ExecCommand is exported so tests can replace ping with a harmless command.
+	ExecCommand = exec.Command
+	// RouteTable is read to find the default gateway.
+	RouteTable = "/proc/net/route"
+)
+
+// Probe is a single connectivity check.
+type Probe interface {
+	// Name describes the probe in logs and status output.
+	Name() string
+	// Check returns nil if the probe passed.
+	Check(ctx context.Context) error
+}
+
+// Result is the outcome of one probe.
+type Result struct {
+	Name     string
+	Err      error
+	Duration time.Duration
+}
+
+// Set is a group of probes and the rule for combining them.
+type Set struct {
+	Probes []Probe
+	Mode   string
+	Quorum int
+}
+
+// FromConfig builds the set configured under watchdog.probes. Invalid probes
+// are logged and skipped; without any valid probe, check_url is probed over
+// HTTP and must answer 204, or a DNS lookup is used if that is not set
+// either.
+func FromConfig(cfg *config.Config) *Set {
+	s := &Set{Mode: cfg.Watchdog.ProbeMode, Quorum: cfg.Watchdog.ProbeQuorum}
+	for _, pc := range cfg.Watchdog.Probes {
+		p, err := New(pc, cfg.Network.WirelessInterface)
+		if err != nil {
+			log.Printf("WARNING: Ignoring connectivity probe: %v", err)
+			continue
+		}
+		s.Probes = append(s.Probes, p)
+	}
+	if len(s.Probes) == 0 {
+		if cfg.Watchdog.CheckURL != "" {
+			s.Probes = []Probe{&HTTP{URL: cfg.Watchdog.CheckURL, ExpectStatus: http.StatusNoContent}}
+		} else {
+			s.Probes = []Probe{&DNS{Host: "www.google.com"}}
+		}
+	}
+	switch s.Mode {
+	case "":
+		s.Mode = ModeAny
+	case ModeAny, ModeAll, ModeQuorum:
+	default:
+		log.Printf("WARNING: Unknown probe_mode %q. Using %q.", s.Mode, ModeAny)
+		s.Mode = ModeAny
+	}
+	return s
+}
+
+// TryOptions returns the options for network.TryConnect set in config.yaml:
+// the connect timeout, and the watchdog's probes as the connectivity check,
+// so a new network is accepted exactly when the watchdog would call it
+// healthy.
+func TryOptions(cfg *config.Config) network.TryOptions {
+	opts := network.TryOptions{
+		Timeout: time.Duration(cfg.Network.ConnectTimeoutSeconds) * time.Second,
+		Online:  FromConfig(cfg).Online,
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = network.DefaultConnectTimeout
+	}
+	return opts
+}
+
+// New builds a probe from its configuration. iface is the interface whose
+// default gateway the gateway probe checks.
+func New(pc config.ProbeConfig, iface string) (Probe, error) {
+	timeout := time.Duration(pc.TimeoutSeconds) * time.Second
+	switch pc.Type {
+	case TypeHTTP:
+		if pc.Target == "" {
+			return nil, errors.New("http probe needs a target URL")
+		}
+		return &HTTP{URL: pc.Target, ExpectStatus: pc.ExpectStatus, ExpectBody: pc.ExpectBody, Timeout: timeout}, nil
+	case TypeDNS:
+		if pc.Target == "" {
+			return nil, errors.New("dns probe needs a name to resolve")
+		}
+		return &DNS{Host: pc.Target, Server: pc.Server, Timeout: timeout}, nil
+	case TypeTCP:
+		if _, _, err := net.SplitHostPort(pc.Target); err != nil {
+			return nil, fmt.Errorf("tcp probe needs a host:port target: %w", err)
+		}
+		return &TCP{Address: pc.Target, Timeout: timeout}, nil
+	case TypeICMP:
+		if pc.Target == "" {
+			return nil, errors.New("icmp probe needs a host")
+		}
+		return &ICMP{Host: pc.Target, Timeout: timeout}, nil
+	case TypeGateway:
+		return &Gateway{Interface: iface, Timeout: timeout}, nil
+	}
+	return nil, fmt.Errorf("unknown probe type %q", pc.Type)
+}
+
+// Run checks every probe concurrently and reports whether the results
+// satisfy the set's mode, along with each probe's result in order.
+func (s *Set) Run(ctx context.Context) (bool, []Result) {
+	results := make([]Result, len(s.Probes))
+	var wg sync.WaitGroup
+	for i, p := range s.Probes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := p.Check(ctx)
+			results[i] = Result{Name: p.Name(), Err: err, Duration: time.Since(start)}
+		}()
+	}
+	wg.Wait()
+	return s.passed(results), results
+}
+
+// Online runs the set and reports whether the device is online.
+func (s *Set) Online(ctx context.Context) bool {
+	ok, _ := s.Run(ctx)
+	return ok
+}
+
+func (s *Set) passed(results []Result) bool {
+	passed := 0
+	for _, r := range results {
+		if r.Err == nil {
+			passed++
+		}
+	}
+	switch s.Mode {
+	case ModeAll:
+		return passed == len(results)
+	case ModeQuorum:
+		quorum := s.Quorum
+		if quorum <= 0 {
+			quorum = len(results)/2 + 1
+		}
+		return passed >= min(quorum, len(results))
+	}
+	return passed > 0
+}
+
+// httpClient does not follow redirects: a captive portal answers with one.
+var httpClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// HTTP requests a URL. Without ExpectBody it sends HEAD; otherwise GET, and
+// the body must contain ExpectBody. A redirect, or an answer other than the
+// expected one, is reported as ErrCaptivePortal.
+type HTTP struct {
+	URL          string
+	ExpectStatus int // Any 2xx if zero.
+	ExpectBody   string
+	Timeout      time.Duration
+}
+
+// Name implements Probe.
+func (p *HTTP) Name() string { return "http " + p.URL }
+
+// Check implements Probe.
+func (p *HTTP) Check(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, p.Timeout)
+	defer cancel()
+	method := http.MethodHead
+	if p.ExpectBody != "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 300 && resp.StatusCode <= 399:
+		return fmt.Errorf("%w: redirected to %s", ErrCaptivePortal, resp.Header.Get("Location"))
+	case p.ExpectStatus != 0 && resp.StatusCode != p.ExpectStatus:
+		if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+			return fmt.Errorf("%w: got status %d, want %d", ErrCaptivePortal, resp.StatusCode, p.ExpectStatus)
+		}
+		return fmt.Errorf("got status %d, want %d", resp.StatusCode, p.ExpectStatus)
+	case p.ExpectStatus == 0 && (resp.StatusCode < 200 || resp.StatusCode > 299):
+		return fmt.Errorf("got status %d", resp.StatusCode)
+	}
+	if p.ExpectBody != "" {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(string(body), p.ExpectBody) {
+			return fmt.Errorf("%w: response does not contain %q", ErrCaptivePortal, p.ExpectBody)
+		}
+	}
+	return nil
+}
+
+// DNS resolves a name, through Server if set or the system resolver.
+type DNS struct {
+	Host    string
+	Server  string // host or host:port; port 53 if omitted.
+	Timeout time.Duration
+}
+
+// Name implements Probe.
+func (p *DNS) Name() string {
+	if p.Server != "" {
+		return "dns " + p.Host + " via " + p.Server
+	}
+	return "dns " + p.Host
+}
+
+// Check implements Probe.
+func (p *DNS) Check(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, p.Timeout)
+	defer cancel()
+	resolver := net.DefaultResolver
+	if p.Server != "" {
+		server := p.Server
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	addrs, err := resolver.LookupHost(ctx, p.Host)
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no addresses")
+	}
+	return err
+}
+
+// TCP opens a connection to Address.
+type TCP struct {
+	Address string
+	Timeout time.Duration
+}
+
+// Name implements Probe.
+func (p *TCP) Name() string { return "tcp " + p.Address }
+
+// Check implements Probe.
+func (p *TCP) Check(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, p.Timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.Address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// ICMP pings Host once with the system ping command, which holds the
+// privileges raw sockets need.
+type ICMP struct {
+	Host    string
+	Timeout time.Duration
+}
+
+// Name implements Probe.
+func (p *ICMP) Name() string { return "icmp " + p.Host }
+
+// Check implements Probe.
+func (p *ICMP) Check(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, p.Timeout)
+	defer cancel()
+	return ping(ctx, p.Host)
+}
+
+// Gateway pings the default gateway of Interface, or of any interface if
+// Interface is empty. It tells a dead uplink apart from a dead local link.
+type Gateway struct {
+	Interface string
+	Timeout   time.Duration
+}
+
+// Name implements Probe.
+func (p *Gateway) Name() string { return "gateway" }
+
+// Check implements Probe.
+func (p *Gateway) Check(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, p.Timeout)
+	defer cancel()
+	gw, err := DefaultGateway(p.Interface)
+	if err != nil {
+		return err
+	}
+	return ping(ctx, gw.String())
+}
+
+// withTimeout bounds a check by its probe's timeout, or DefaultTimeout.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// ping sends one echo request, waiting until the context's deadline.
+func ping(ctx context.Context, host string) error {
+	deadline, _ := ctx.Deadline()
+	secs := max(1, int(time.Until(deadline).Seconds()))
+	output, err := ExecCommand("ping", "-c", "1", "-W", strconv.Itoa(secs), host).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ping %s failed: %w (output: %s)", host, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// DefaultGateway returns the IPv4 default gateway from the kernel's routing
+// table, for iface or any interface if iface is empty.
+func DefaultGateway(iface string) (net.IP, error) {
+	f, err := os.Open(RouteTable)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		// Iface Destination Gateway Flags ...; the header line never matches.
+		if len(fields) < 3 || fields[1] != "00000000" || (iface != "" && fields[0] != iface) {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		ip := make(net.IP, 4)
+		// The table holds addresses in host byte order, little-endian on
+		// the boards pifigo runs on.
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(raw))
+		if !ip.IsUnspecified() {
+			return ip, nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("no default gateway")
+}
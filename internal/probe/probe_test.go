@@ -0,0 +1,192 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"pifigo/internal/config"
+)
+
+// stub is a probe with a fixed outcome.
+type stub struct{ err error }
+
+func (s stub) Name() string                { return "stub" }
+func (s stub) Check(context.Context) error { return s.err }
+
+func TestHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/portal" {
+			w.Write([]byte("<html>Please log in</html>"))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		probe HTTP
+		ok    bool
+	}{
+		{HTTP{URL: srv.URL + "/generate_204"}, true},
+		{HTTP{URL: srv.URL + "/generate_204", ExpectStatus: 204}, true},
+		// A captive portal answering 200 instead of 204 is not the internet.
+		{HTTP{URL: srv.URL + "/portal", ExpectStatus: 204}, false},
+		{HTTP{URL: srv.URL + "/portal", ExpectBody: "Success"}, false},
+		{HTTP{URL: srv.URL + "/portal", ExpectBody: "log in"}, true},
+		{HTTP{URL: "http://127.0.0.1:1"}, false},
+	} {
+		if err := tc.probe.Check(context.Background()); (err == nil) != tc.ok {
+			t.Errorf("%s (status %d, body %q): got %v, want ok=%v", tc.probe.URL, tc.probe.ExpectStatus, tc.probe.ExpectBody, err, tc.ok)
+		}
+	}
+}
+
+func TestTCPAndDNS(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	if err := (&TCP{Address: addr}).Check(context.Background()); err == nil {
+		t.Error("Expected a closed port to fail")
+	}
+	ln, _ = net.Listen("tcp", addr)
+	defer ln.Close()
+	if err := (&TCP{Address: addr}).Check(context.Background()); err != nil {
+		t.Errorf("Expected an open port to pass, got %v", err)
+	}
+
+	// localhost resolves from /etc/hosts without any network.
+	if err := (&DNS{Host: "localhost"}).Check(context.Background()); err != nil {
+		t.Errorf("Expected localhost to resolve, got %v", err)
+	}
+}
+
+func TestGateway(t *testing.T) {
+	RouteTable = filepath.Join(t.TempDir(), "route")
+	defer func() { RouteTable = "/proc/net/route" }()
+	table := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+		"eth0\t00000000\t0101A8C0\t0003\t0\t0\t100\t00000000\t0\t0\t0\n" +
+		"wlan0\t0001A8C0\t00000000\t0001\t0\t0\t600\t00FFFFFF\t0\t0\t0\n" +
+		"wlan0\t00000000\t0102A8C0\t0003\t0\t0\t600\t00000000\t0\t0\t0\n"
+	os.WriteFile(RouteTable, []byte(table), 0644)
+
+	if gw, err := DefaultGateway("wlan0"); err != nil || gw.String() != "192.168.2.1" {
+		t.Errorf("Expected 192.168.2.1 for wlan0, got %v (err: %v)", gw, err)
+	}
+	if _, err := DefaultGateway("wlan1"); err == nil {
+		t.Error("Expected no gateway for an interface without a default route")
+	}
+
+	var pinged string
+	ExecCommand = func(name string, arg ...string) *exec.Cmd {
+		pinged = strings.Join(append([]string{name}, arg...), " ")
+		return exec.Command("/bin/true")
+	}
+	defer func() { ExecCommand = exec.Command }()
+	if err := (&Gateway{Interface: "wlan0"}).Check(context.Background()); err != nil {
+		t.Errorf("Gateway check failed: %v", err)
+	}
+	if !strings.HasPrefix(pinged, "ping -c 1 -W ") || !strings.HasSuffix(pinged, " 192.168.2.1") {
+		t.Errorf("Unexpected ping command: %s", pinged)
+	}
+}
+
+func TestSetModes(t *testing.T) {
+	down := stub{errors.New("down")}
+	probes := []Probe{stub{}, down, stub{}, down}
+	for _, tc := range []struct {
+		mode   string
+		quorum int
+		ok     bool
+	}{
+		{ModeAny, 0, true},
+		{ModeAll, 0, false},
+		{ModeQuorum, 0, false}, // A majority of four is three.
+		{ModeQuorum, 2, true},
+	} {
+		s := &Set{Probes: probes, Mode: tc.mode, Quorum: tc.quorum}
+		ok, results := s.Run(context.Background())
+		if ok != tc.ok {
+			t.Errorf("%s/%d: got %v, want %v", tc.mode, tc.quorum, ok, tc.ok)
+		}
+		if len(results) != 4 || results[1].Err == nil || results[2].Err != nil {
+			t.Errorf("Unexpected results: %+v", results)
+		}
+	}
+	if (&Set{Probes: []Probe{down}, Mode: ModeAny}).Online(context.Background()) {
+		t.Error("Expected a failing set to be offline")
+	}
+}
+
+func TestFromConfig(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Watchdog.CheckURL = "http://example.com/generate_204"
+	if s := FromConfig(cfg); len(s.Probes) != 1 || s.Probes[0].Name() != "http http://example.com/generate_204" || s.Mode != ModeAny {
+		t.Errorf("Expected check_url as the only probe, got %+v", s)
+	}
+
+	// A captive portal answering check_url with its login page is not online.
+	portal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>Please log in</html>"))
+	}))
+	defer portal.Close()
+	cfg.Watchdog.CheckURL = portal.URL
+	if err := FromConfig(cfg).Probes[0].Check(context.Background()); !errors.Is(err, ErrCaptivePortal) {
+		t.Errorf("Expected a 200 from check_url to be reported as a captive portal, got %v", err)
+	}
+
+	cfg.Network.WirelessInterface = "wlan0"
+	cfg.Watchdog.ProbeMode = ModeQuorum
+	cfg.Watchdog.Probes = []config.ProbeConfig{
+		{Type: TypeDNS, Target: "example.com", Server: "1.1.1.1"},
+		{Type: TypeTCP, Target: "1.1.1.1:53"},
+		{Type: TypeTCP, Target: "no-port"},
+		{Type: TypeICMP, Target: "9.9.9.9"},
+		{Type: TypeGateway},
+		{Type: "smoke-signal"},
+	}
+	s := FromConfig(cfg)
+	var names []string
+	for _, p := range s.Probes {
+		names = append(names, p.Name())
+	}
+	want := "dns example.com via 1.1.1.1|tcp 1.1.1.1:53|icmp 9.9.9.9|gateway"
+	if strings.Join(names, "|") != want || s.Mode != ModeQuorum {
+		t.Errorf("Unexpected probes %v in mode %s", names, s.Mode)
+	}
+}
+
+// TestTryOptions verifies a connect is checked with the configured probes
+// and mode rather than check_url alone.
+func TestTryOptions(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	cfg := &config.Config{}
+	cfg.Watchdog.CheckURL = down.URL
+	cfg.Watchdog.Probes = []config.ProbeConfig{{Type: TypeHTTP, Target: up.URL}, {Type: TypeHTTP, Target: down.URL}}
+	opts := TryOptions(cfg)
+	if opts.Timeout <= 0 || !opts.Online(context.Background()) {
+		t.Errorf("Expected a passing probe to be enough in the default mode, got %+v", opts)
+	}
+	cfg.Watchdog.ProbeMode = ModeAll
+	if TryOptions(cfg).Online(context.Background()) {
+		t.Error("Expected a failing probe to fail the check in all mode")
+	}
+}
@@ -0,0 +1,39 @@
+package profiles
+
+import "sort"
+
+// Candidates returns the profiles to try when connecting automatically:
+// those with autoconnect set whose network is in range, highest priority
+// first and then strongest signal. signal maps the SSIDs seen in a scan to
+// their strength in dBm. Hidden networks never show up in a scan by name, so
+// they are tried after the visible networks of the same priority. A nil
+// signal map means no scan was possible; every autoconnect profile is then
+// returned, most recently used first within a priority.
+func Candidates(list []Profile, signal map[string]float64) []Profile {
+	var result []Profile
+	for _, p := range list {
+		if !p.Autoconnect {
+			continue
+		}
+		if _, visible := signal[p.SSID]; signal != nil && !visible && !p.Hidden {
+			continue
+		}
+		result = append(result, p)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		sa, va := signal[a.SSID]
+		sb, vb := signal[b.SSID]
+		switch {
+		case va != vb:
+			return va
+		case va && sa != sb:
+			return sa > sb
+		}
+		return a.LastUsed.After(b.LastUsed)
+	})
+	return result
+}
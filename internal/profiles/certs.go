@@ -0,0 +1,151 @@
+package profiles
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CertsDirName is the certificate directory, kept next to the store's
+// directory: /etc/pifigo/certs for the default store.
+const CertsDirName = "certs"
+
+// Certificate kinds of an enterprise network.
+const (
+	CertCA     = "ca"
+	CertClient = "client"
+	CertKey    = "key"
+)
+
+// MaxCertSize bounds an uploaded certificate or key file.
+const MaxCertSize = 64 << 10
+
+// SaveCert checks an uploaded certificate or private key and stores it as
+// PEM for the profile, readable only by root. DER certificates are
+// converted. It returns the path of the stored file.
+func (s *Store) SaveCert(id, kind string, data []byte) (string, error) {
+	out, err := CheckCert(kind, data)
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.WriteCerts(id, map[string][]byte{kind: out}); err != nil {
+		return "", err
+	}
+	return s.CertPath(id, kind), nil
+}
+
+// CheckCert checks an uploaded certificate or private key and returns it as
+// PEM. DER certificates are converted.
+func CheckCert(kind string, data []byte) ([]byte, error) {
+	if len(data) > MaxCertSize {
+		return nil, fmt.Errorf("%s file is larger than %d KB", kind, MaxCertSize>>10)
+	}
+	switch kind {
+	case CertCA, CertClient:
+		return certPEM(data)
+	case CertKey:
+		return keyPEM(data)
+	}
+	return nil, fmt.Errorf("unknown certificate kind %q", kind)
+}
+
+// CertPath returns where the certificate or key of the given kind is stored
+// for the profile.
+func (s *Store) CertPath(id, kind string) string {
+	return filepath.Join(s.CertsDir, id+"-"+kind+".pem")
+}
+
+// WriteCerts stores certificates checked by CheckCert for the profile,
+// keyed by kind. The returned undo function puts back the files they
+// replaced, or removes them, for when the profile is not kept after all. If
+// a file cannot be written, the ones already written are undone.
+func (s *Store) WriteCerts(id string, certs map[string][]byte) (undo func(), err error) {
+	if !ValidID(id) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidID, id)
+	}
+	previous := make(map[string][]byte)
+	undo = func() {
+		for path, data := range previous {
+			if data == nil {
+				os.Remove(path)
+			} else {
+				writeFile(path, data)
+			}
+		}
+	}
+	if len(certs) == 0 {
+		return undo, nil
+	}
+	if err := os.MkdirAll(s.CertsDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create certificate directory: %w", err)
+	}
+	for kind, data := range certs {
+		path := s.CertPath(id, kind)
+		previous[path], _ = os.ReadFile(path)
+		if err := writeFile(path, data); err != nil {
+			undo()
+			return nil, fmt.Errorf("failed to write %s file: %w", kind, err)
+		}
+	}
+	return undo, nil
+}
+
+// deleteCerts removes the certificate files stored for a profile.
+func (s *Store) deleteCerts(id string) error {
+	for _, kind := range []string{CertCA, CertClient, CertKey} {
+		if err := os.Remove(s.CertPath(id, kind)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete %s file: %w", kind, err)
+		}
+	}
+	return nil
+}
+
+// certPEM returns the certificates in data as PEM. data may be PEM, holding
+// one or more certificates, or a single DER certificate.
+func certPEM(data []byte) ([]byte, error) {
+	if !strings.Contains(string(data), "-----BEGIN") {
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			return nil, errors.New("not a PEM or DER certificate")
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), nil
+	}
+	var out []byte
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return nil, fmt.Errorf("invalid certificate: %w", err)
+		}
+		out = append(out, pem.EncodeToMemory(block)...)
+	}
+	if out == nil {
+		return nil, errors.New("no certificate found in the PEM file")
+	}
+	return out, nil
+}
+
+// keyPEM returns the private key in data, which must be PEM. Encrypted keys
+// are kept as they are; wpa_supplicant decrypts them with the key password.
+func keyPEM(data []byte) ([]byte, error) {
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, errors.New("no private key found in the PEM file")
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			return pem.EncodeToMemory(block), nil
+		}
+	}
+}
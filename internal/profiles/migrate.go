@@ -0,0 +1,169 @@
+package profiles
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LegacyDir is the subdirectory that migrated netplan files are moved to.
+const LegacyDir = "legacy"
+
+// legacyNetplan is the part of a rendered netplan client config that
+// earlier versions saved as a profile.
+type legacyNetplan struct {
+	Network struct {
+		Wifis map[string]struct {
+			DHCP4     any      `yaml:"dhcp4"`
+			Addresses []string `yaml:"addresses"`
+			Gateway4  string   `yaml:"gateway4"`
+			Routes    []struct {
+				To  string `yaml:"to"`
+				Via string `yaml:"via"`
+			} `yaml:"routes"`
+			Nameservers struct {
+				Addresses []string `yaml:"addresses"`
+			} `yaml:"nameservers"`
+			AccessPoints map[string]struct {
+				Password string `yaml:"password"`
+				Hidden   bool   `yaml:"hidden"`
+			} `yaml:"access-points"`
+		} `yaml:"wifis"`
+	} `yaml:"network"`
+}
+
+// MigrateLegacy converts the saved profiles written by earlier versions into
+// structured profiles stored under their ID. Rendered netplan files are
+// parsed and the originals moved to the legacy subdirectory; profiles stored
+// under their SSID are renamed. Files that are neither are left alone. It
+// returns the number of profiles migrated.
+func (s *Store) MigrateLegacy() (int, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not read saved networks directory: %w", err)
+	}
+	key, err := s.key()
+	if err != nil {
+		return 0, err
+	}
+	migrated := 0
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".yaml" {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ".yaml")
+		path := filepath.Join(s.Dir, entry.Name())
+		if p, err := readProfile(path, key); err == nil {
+			if p.ID == name && name == ID(p.SSID) {
+				continue
+			}
+			if err := s.rekey(path, p); err != nil {
+				return migrated, err
+			}
+			migrated++
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return migrated, err
+		}
+		p, err := parseLegacyNetplan(data)
+		if err != nil {
+			log.Printf("WARNING: Could not migrate saved network %s: %v", path, err)
+			continue
+		}
+		if p.Created, err = modTime(path); err != nil {
+			return migrated, err
+		}
+		legacyPath := filepath.Join(s.Dir, LegacyDir, entry.Name())
+		// The originals hold plaintext passwords.
+		if err := os.MkdirAll(filepath.Dir(legacyPath), 0700); err != nil {
+			return migrated, err
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			return migrated, err
+		}
+		if err := os.Rename(path, legacyPath); err != nil {
+			return migrated, err
+		}
+		if err := s.Save(p); err != nil {
+			_ = os.Rename(legacyPath, path)
+			return migrated, err
+		}
+		log.Printf("Migrated saved network %s to a structured profile.", p.SSID)
+		migrated++
+	}
+	return migrated, nil
+}
+
+// rekey stores a structured profile found at path under the ID for its SSID.
+func (s *Store) rekey(path string, p Profile) error {
+	p.ID = ID(p.SSID)
+	if err := s.Save(p); err != nil {
+		return err
+	}
+	if path != s.path(p.ID) {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	log.Printf("Renamed saved network %s to %s.", p.SSID, p.ID)
+	return nil
+}
+
+// parseLegacyNetplan reads the network out of a rendered netplan client config.
+func parseLegacyNetplan(data []byte) (Profile, error) {
+	var doc legacyNetplan
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return Profile{}, fmt.Errorf("not a netplan file: %w", err)
+	}
+	for _, wifi := range doc.Network.Wifis {
+		for ssid, ap := range wifi.AccessPoints {
+			p := New(ssid, ap.Password)
+			p.Hidden = ap.Hidden
+			if isFalse(wifi.DHCP4) && len(wifi.Addresses) > 0 {
+				p.IPMode = IPModeStatic
+				p.Static.Address = wifi.Addresses[0]
+				p.Static.Gateway = wifi.Gateway4
+				for _, route := range wifi.Routes {
+					if route.To == "default" || route.To == "0.0.0.0/0" {
+						p.Static.Gateway = route.Via
+					}
+				}
+				p.Static.DNS = wifi.Nameservers.Addresses
+			} else {
+				p.IPMode = IPModeDHCP
+			}
+			return p, nil
+		}
+	}
+	return Profile{}, fmt.Errorf("no access point found")
+}
+
+// isFalse reports whether a netplan boolean is explicitly off. Netplan
+// accepts both YAML booleans and the strings "no" and "false".
+func isFalse(v any) bool {
+	switch v := v.(type) {
+	case bool:
+		return !v
+	case string:
+		return v == "no" || v == "false" || v == "off"
+	}
+	return false
+}
+
+func modTime(path string) (t time.Time, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return t, err
+	}
+	return info.ModTime(), nil
+}
@@ -0,0 +1,446 @@
+// Package profiles stores the Wi-Fi networks pifigo has connected to as
+// structured records. Profiles are rendered into the backend's own format
+// only when they are applied, so they survive a change of network backend
+// and can be read back without parsing netplan.
+package profiles
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+
+	"pifigo/internal/network"
+)
+
+// Security types. They match the values reported by the scan package.
+const (
+	SecurityOpen           = network.SecurityOpen
+	SecurityWEP            = network.SecurityWEP
+	SecurityWPA2PSK        = network.SecurityWPA2PSK
+	SecurityWPA3SAE        = network.SecurityWPA3SAE
+	SecurityWPA3Transition = network.SecurityWPA3Transition
+	SecurityEAP            = network.SecurityEAP
+)
+
+// IP modes. An empty mode uses network.connection_mode from config.yaml.
+const (
+	IPModeDHCP   = network.IPModeDHCP
+	IPModeStatic = network.IPModeStatic
+)
+
+// Errors returned by the store.
+var (
+	ErrNotFound  = errors.New("network profile not found")
+	ErrInvalidID = errors.New("invalid network profile ID")
+)
+
+// MaxSSIDLength is the longest SSID 802.11 allows, in bytes.
+const MaxSSIDLength = 32
+
+const (
+	maxSlugLength = 32
+	hashLength    = 12
+)
+
+// StaticConfig holds the addressing used when IPMode is static.
+type StaticConfig struct {
+	Address string   `yaml:"address,omitempty"` // With CIDR suffix, e.g. 192.168.1.150/24.
+	Gateway string   `yaml:"gateway,omitempty"`
+	DNS     []string `yaml:"dns,omitempty"`
+}
+
+// EAPSettings holds the 802.1X settings of an enterprise network.
+// Certificates are paths to files in the store's certificate directory.
+type EAPSettings struct {
+	Method            string `yaml:"method"`
+	Identity          string `yaml:"identity"`
+	AnonymousIdentity string `yaml:"anonymous_identity,omitempty"`
+	Password          string `yaml:"password,omitempty"`
+	Phase2            string `yaml:"phase2,omitempty"`
+	CACert            string `yaml:"ca_cert,omitempty"`
+	ClientCert        string `yaml:"client_cert,omitempty"`
+	ClientKey         string `yaml:"client_key,omitempty"`
+	ClientKeyPassword string `yaml:"client_key_password,omitempty"`
+}
+
+// Config returns the settings as a network backend takes them.
+func (e *EAPSettings) Config() *network.EAPConfig {
+	if e == nil {
+		return nil
+	}
+	c := network.EAPConfig(*e)
+	return &c
+}
+
+// Profile is a saved Wi-Fi network.
+type Profile struct {
+	ID          string       `yaml:"id"`
+	SSID        string       `yaml:"ssid"`
+	Hidden      bool         `yaml:"hidden,omitempty"`
+	Security    string       `yaml:"security"`
+	PSK         string       `yaml:"psk,omitempty"` // Passphrase, kept only when it has no PMK.
+	PMK         string       `yaml:"pmk,omitempty"` // 64 hex digits, see PMK.
+	EAP         *EAPSettings `yaml:"eap,omitempty"` // Set when Security is eap.
+	IPMode      string       `yaml:"ip_mode,omitempty"`
+	Static      StaticConfig `yaml:"static,omitempty"`
+	Priority    int          `yaml:"priority"`
+	Autoconnect bool         `yaml:"autoconnect"`
+	Created     time.Time    `yaml:"created"`
+	LastUsed    time.Time    `yaml:"last_used,omitempty"`
+}
+
+// ID returns the profile ID for an SSID. SSIDs are arbitrary bytes and cannot
+// be used as file names, so the ID is a readable slug of the SSID followed by
+// a hash of it, which keeps SSIDs that share a slug apart.
+func ID(ssid string) string {
+	var slug strings.Builder
+	for i := 0; i < len(ssid) && slug.Len() < maxSlugLength; i++ {
+		if c := ssid[i]; isIDChar(c) {
+			slug.WriteByte(c)
+		} else {
+			slug.WriteByte('_')
+		}
+	}
+	sum := sha256.Sum256([]byte(ssid))
+	return slug.String() + "-" + hex.EncodeToString(sum[:])[:hashLength]
+}
+
+// ValidID reports whether id can name a profile. Only IDs made of letters,
+// digits, '-' and '_' are accepted, so an ID can never leave the store's
+// directory.
+func ValidID(id string) bool {
+	if id == "" || len(id) > maxSlugLength+1+hashLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if !isIDChar(id[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isIDChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+}
+
+// New returns a profile for a network that has not been saved yet.
+func New(ssid, psk string) Profile {
+	security := SecurityWPA2PSK
+	if psk == "" {
+		security = SecurityOpen
+	}
+	return Profile{ID: ID(ssid), SSID: ssid, Security: security, PSK: psk, Autoconnect: true}
+}
+
+// ClientConfig returns the values a network backend needs to join the
+// network. Backends take a 64 hex digit PMK in place of the passphrase.
+func (p Profile) ClientConfig() network.ClientConfig {
+	password := p.PSK
+	if password == "" {
+		password = p.PMK
+	}
+	if p.EAP != nil {
+		password = ""
+	}
+	return network.ClientConfig{
+		SSID:     p.SSID,
+		Password: password,
+		Security: p.Security,
+		Hidden:   p.Hidden,
+		IP:       p.IP(),
+		EAP:      p.EAP.Config(),
+		Priority: p.Priority,
+	}
+}
+
+// IP returns the profile's addressing. A profile without an IP mode uses the
+// backend's default.
+func (p Profile) IP() network.IPConfig {
+	if p.IPMode != IPModeStatic {
+		return network.IPConfig{Mode: p.IPMode}
+	}
+	return network.IPConfig{Mode: p.IPMode, Address: p.Static.Address, Gateway: p.Static.Gateway, DNS: p.Static.DNS}
+}
+
+// SetIP stores the addressing on the profile.
+func (p *Profile) SetIP(ip network.IPConfig) {
+	p.IPMode = ip.Mode
+	p.Static = StaticConfig{}
+	if ip.Mode == IPModeStatic {
+		p.Static = StaticConfig{Address: ip.Address, Gateway: ip.Gateway, DNS: ip.DNS}
+	}
+}
+
+// Store keeps one YAML file per profile in a directory. Profile files are
+// only readable by their owner. If the device key file exists, passphrases
+// and PMKs are encrypted with it. Certificates of enterprise networks are
+// kept in CertsDir.
+type Store struct {
+	Dir      string
+	KeyFile  string
+	CertsDir string
+}
+
+// NewStore returns a store backed by dir.
+func NewStore(dir string) *Store {
+	parent := filepath.Dir(dir)
+	return &Store{Dir: dir, KeyFile: filepath.Join(parent, KeyFileName), CertsDir: filepath.Join(parent, CertsDirName)}
+}
+
+// path returns the file holding the profile. The ID must have been checked
+// with ValidID.
+func (s *Store) path(id string) string {
+	return filepath.Join(s.Dir, id+".yaml")
+}
+
+// Get returns the profile with the given ID.
+func (s *Store) Get(id string) (Profile, error) {
+	if !ValidID(id) {
+		return Profile{}, fmt.Errorf("%w: %q", ErrInvalidID, id)
+	}
+	key, err := s.key()
+	if err != nil {
+		return Profile{}, err
+	}
+	p, err := readProfile(s.path(id), key)
+	if os.IsNotExist(err) {
+		return p, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return p, err
+}
+
+// Find returns the saved profile for an SSID.
+func (s *Store) Find(ssid string) (Profile, error) {
+	return s.Get(ID(ssid))
+}
+
+// Resolve returns the profile named by ref, which may be a profile ID or an
+// SSID. It lets people type the network name where an ID is expected.
+func (s *Store) Resolve(ref string) (Profile, error) {
+	if ValidID(ref) {
+		if p, err := s.Get(ref); !errors.Is(err, ErrNotFound) {
+			return p, err
+		}
+	}
+	return s.Find(ref)
+}
+
+// readProfile reads a profile file, decrypting its secrets with key.
+func readProfile(path string, key []byte) (Profile, error) {
+	var p Profile
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return p, err
+	}
+	if err := yaml.Unmarshal(data, &p); err != nil || p.SSID == "" {
+		return p, fmt.Errorf("failed to parse network profile %s: not a pifigo profile", path)
+	}
+	for _, secret := range p.secrets() {
+		if *secret, err = unseal(key, p.ID, *secret); err != nil {
+			return p, fmt.Errorf("network profile %s: %w", path, err)
+		}
+	}
+	return p, nil
+}
+
+// List returns every profile, sorted by SSID. Files that cannot be read are
+// skipped.
+func (s *Store) List() ([]Profile, error) {
+	key, err := s.key()
+	if err != nil {
+		return nil, err
+	}
+	return s.list(key, false)
+}
+
+// list reads every profile with key. A file that cannot be read is skipped,
+// or returned as an error if strict is set.
+func (s *Store) list(key []byte, strict bool) ([]Profile, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read saved networks directory: %w", err)
+	}
+	var list []Profile
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".yaml")
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".yaml" || !ValidID(id) {
+			continue
+		}
+		p, err := readProfile(s.path(id), key)
+		if err != nil && strict {
+			return nil, err
+		}
+		if err != nil {
+			continue
+		}
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].SSID < list[j].SSID })
+	return list, nil
+}
+
+// Save writes the profile, keeping the creation time of an existing one.
+func (s *Store) Save(p Profile) error {
+	key, err := s.key()
+	if err != nil {
+		return err
+	}
+	return s.save(p, key)
+}
+
+// save writes the profile, encrypting its secrets with key unless it is nil.
+func (s *Store) save(p Profile, key []byte) error {
+	if p.SSID == "" || len(p.SSID) > MaxSSIDLength {
+		return fmt.Errorf("SSID must be 1 to %d bytes long", MaxSSIDLength)
+	}
+	if !ValidID(p.ID) {
+		return fmt.Errorf("%w: %q", ErrInvalidID, p.ID)
+	}
+	if err := p.IP().Validate(); err != nil {
+		return err
+	}
+	if p.EAP != nil {
+		if err := p.EAP.Config().Validate(); err != nil {
+			return err
+		}
+		// Sealing below must not touch the caller's copy.
+		eap := *p.EAP
+		p.EAP = &eap
+	}
+	if existing, err := readProfile(s.path(p.ID), key); err == nil && !existing.Created.IsZero() {
+		p.Created = existing.Created
+	}
+	if p.Created.IsZero() {
+		p.Created = time.Now()
+	}
+	if convertsToPMK(p) {
+		pmk, err := PMK(p.PSK, p.SSID)
+		if err != nil {
+			return err
+		}
+		p.PSK, p.PMK = "", pmk
+	}
+	if key != nil {
+		for _, secret := range p.secrets() {
+			var err error
+			if *secret, err = seal(key, p.ID, *secret); err != nil {
+				return err
+			}
+		}
+	}
+	data, err := encode(p)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return fmt.Errorf("failed to create saved networks directory: %w", err)
+	}
+	if err := writeFile(s.path(p.ID), data); err != nil {
+		return fmt.Errorf("failed to write network profile: %w", err)
+	}
+	return nil
+}
+
+// writeFile replaces path with data, readable only by its owner. The file is
+// written to a temporary file and renamed, so an existing file never has
+// looser permissions or partial contents.
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".pifigo-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// encode marshals the profile. SSIDs holding control characters or bytes
+// that are not UTF-8 are written as base64 !!binary, which YAML reads back
+// into the same bytes; plain scalars would lose or mangle them.
+func encode(p Profile) ([]byte, error) {
+	var doc yaml.Node
+	if err := doc.Encode(p); err != nil {
+		return nil, err
+	}
+	if needsBinary(p.SSID) {
+		for i := 0; i+1 < len(doc.Content); i += 2 {
+			if doc.Content[i].Value == "ssid" {
+				v := doc.Content[i+1]
+				v.Tag, v.Value, v.Style = "!!binary", base64.StdEncoding.EncodeToString([]byte(p.SSID)), 0
+			}
+		}
+	}
+	return yaml.Marshal(&doc)
+}
+
+func needsBinary(s string) bool {
+	if !utf8.ValidString(s) {
+		return true
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkUsed records that the profile was just connected to.
+func (s *Store) MarkUsed(id string) error {
+	p, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	p.LastUsed = time.Now()
+	return s.Save(p)
+}
+
+// SetPriority changes the profile's priority. Higher priorities are tried
+// first when connecting automatically.
+func (s *Store) SetPriority(id string, priority int) error {
+	p, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	p.Priority = priority
+	return s.Save(p)
+}
+
+// Delete removes the profile.
+func (s *Store) Delete(id string) error {
+	if !ValidID(id) {
+		return fmt.Errorf("%w: %q", ErrInvalidID, id)
+	}
+	if err := os.Remove(s.path(id)); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrNotFound, id)
+		}
+		return fmt.Errorf("failed to delete profile: %w", err)
+	}
+	return s.deleteCerts(id)
+}
@@ -0,0 +1,348 @@
+package profiles
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStoreRoundTrip(t *testing.T) {
+	store := NewStore(t.TempDir())
+	p := New("HomeWiFi", "secret123")
+	p.Priority = 10
+	if err := store.Save(p); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	got, err := store.Get(p.ID)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	wantPMK, _ := PMK("secret123", "HomeWiFi")
+	if got.SSID != "HomeWiFi" || got.PSK != "" || got.PMK != wantPMK || got.Security != SecurityWPA2PSK || got.Priority != 10 || !got.Autoconnect {
+		t.Errorf("Unexpected profile: %+v", got)
+	}
+	if got.Created.IsZero() {
+		t.Error("Expected the creation time to be set")
+	}
+	if cfg := got.ClientConfig(); cfg.SSID != "HomeWiFi" || cfg.Password != wantPMK {
+		t.Errorf("Unexpected client config: %+v", cfg)
+	}
+
+	if err := store.MarkUsed(p.ID); err != nil {
+		t.Fatalf("MarkUsed failed: %v", err)
+	}
+	used, _ := store.Find("HomeWiFi")
+	if used.LastUsed.IsZero() || !used.Created.Equal(got.Created) {
+		t.Errorf("Expected LastUsed to be set and Created kept, got %+v", used)
+	}
+
+	if open := New("CoffeeShop", ""); open.Security != SecurityOpen {
+		t.Errorf("Expected a network without a password to be open, got %s", open.Security)
+	}
+	store.Save(New("CoffeeShop", ""))
+	list, err := store.List()
+	if err != nil || len(list) != 2 || list[0].SSID != "CoffeeShop" {
+		t.Errorf("Expected two profiles sorted by SSID, got %+v (err: %v)", list, err)
+	}
+
+	if err := store.Delete(p.ID); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := store.Get(p.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after Delete, got %v", err)
+	}
+}
+
+func TestPMK(t *testing.T) {
+	// Test vector from IEEE 802.11i, annex H.4.
+	got, err := PMK("password", "IEEE")
+	if err != nil || got != "f42c6fc52df0ebef9ebb4b90b38a5f902e83fe1b135a70e23aed762e9710a12e" {
+		t.Errorf("Unexpected PMK %s (err: %v)", got, err)
+	}
+}
+
+func TestSecure(t *testing.T) {
+	root := t.TempDir()
+	store := NewStore(filepath.Join(root, "saved_networks"))
+	sae := New("Modern", "correct horse battery")
+	sae.Security = SecurityWPA3SAE
+	store.Save(sae)
+	store.Save(New("HomeWiFi", "secret123"))
+	path := store.path(ID("HomeWiFi"))
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected the profile to be written 0600, got %v (err: %v)", info.Mode(), err)
+	}
+
+	if err := store.Secure(true); err != nil {
+		t.Fatalf("Secure(true) failed: %v", err)
+	}
+	data, _ := os.ReadFile(store.path(sae.ID))
+	if strings.Contains(string(data), "correct horse battery") {
+		t.Errorf("Expected the passphrase to be encrypted, got:\n%s", data)
+	}
+	got, err := store.Find("Modern")
+	if err != nil || got.PSK != "correct horse battery" || got.PMK != "" {
+		t.Errorf("Expected a WPA3 passphrase to be kept and decrypted, got %+v (err: %v)", got, err)
+	}
+
+	// Without the key the secrets cannot be read.
+	key, _ := os.ReadFile(store.KeyFile)
+	os.Remove(store.KeyFile)
+	if _, err := store.Find("Modern"); !errors.Is(err, ErrNoKey) {
+		t.Errorf("Expected ErrNoKey without the device key, got %v", err)
+	}
+	os.WriteFile(store.KeyFile, key, 0600)
+
+	// A profile that cannot be decrypted keeps encryption on, and the key.
+	corrupt := store.path(ID("Corrupt"))
+	os.WriteFile(corrupt, []byte("id: "+ID("Corrupt")+"\nssid: Corrupt\npmk: "+encryptedPrefix+"bm90IGVuY3J5cHRlZA==\n"), 0600)
+	data, _ = os.ReadFile(store.path(sae.ID))
+	if err := store.Secure(false); err == nil {
+		t.Error("Expected Secure(false) to fail for a profile that cannot be decrypted")
+	}
+	if _, err := os.Stat(store.KeyFile); err != nil {
+		t.Errorf("Expected the device key to be kept, got %v", err)
+	}
+	if after, _ := os.ReadFile(store.path(sae.ID)); string(after) != string(data) {
+		t.Error("Expected the other profiles to stay encrypted")
+	}
+	os.Remove(corrupt)
+
+	if err := store.Secure(false); err != nil {
+		t.Fatalf("Secure(false) failed: %v", err)
+	}
+	if _, err := os.Stat(store.KeyFile); !os.IsNotExist(err) {
+		t.Error("Expected the device key to be removed when encryption is turned off")
+	}
+	data, _ = os.ReadFile(store.path(sae.ID))
+	if !strings.Contains(string(data), "correct horse battery") {
+		t.Errorf("Expected the passphrase to be decrypted, got:\n%s", data)
+	}
+}
+
+func TestEnterpriseProfile(t *testing.T) {
+	root := t.TempDir()
+	store := NewStore(filepath.Join(root, "saved_networks"))
+	p := New("eduroam", "")
+	p.Security = SecurityEAP
+	p.EAP = &EAPSettings{Method: "tls", Identity: "alice"}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "alice"}}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	var err error
+	if p.EAP.ClientCert, err = store.SaveCert(p.ID, CertClient, der); err != nil {
+		t.Fatalf("SaveCert failed for a DER certificate: %v", err)
+	}
+	if p.EAP.ClientKey, err = store.SaveCert(p.ID, CertKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})); err != nil {
+		t.Fatalf("SaveCert failed for a PEM key: %v", err)
+	}
+	if _, err := store.SaveCert(p.ID, CertCA, []byte("not a certificate")); err == nil {
+		t.Error("Expected an invalid CA certificate to be rejected")
+	}
+	if _, err := store.SaveCert(p.ID, CertKey, der); err == nil {
+		t.Error("Expected a certificate to be rejected as a private key")
+	}
+	data, _ := os.ReadFile(p.EAP.ClientCert)
+	if block, _ := pem.Decode(data); block == nil || block.Type != "CERTIFICATE" {
+		t.Errorf("Expected the DER certificate to be stored as PEM, got:\n%s", data)
+	}
+	if info, err := os.Stat(store.CertsDir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("Expected the certificate directory to be 0700, got %v (err: %v)", info.Mode(), err)
+	}
+	if info, err := os.Stat(p.EAP.ClientKey); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the key file to be 0600, got %v (err: %v)", info.Mode(), err)
+	}
+
+	p.EAP.Method = "peap"
+	p.EAP.Password = "hunter22"
+	store.Secure(true)
+	if err := store.Save(p); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if p.EAP.Password != "hunter22" {
+		t.Error("Save modified the caller's EAP settings")
+	}
+	data, _ = os.ReadFile(store.path(p.ID))
+	if strings.Contains(string(data), "hunter22") {
+		t.Errorf("Expected the EAP password to be encrypted, got:\n%s", data)
+	}
+	got, err := store.Get(p.ID)
+	if err != nil || got.ClientConfig().EAP == nil || got.ClientConfig().EAP.Password != "hunter22" {
+		t.Errorf("Unexpected enterprise profile %+v (err: %v)", got, err)
+	}
+
+	p.EAP.Password = ""
+	if err := store.Save(p); err == nil {
+		t.Error("Expected PEAP without a password to be rejected")
+	}
+
+	if err := store.Delete(p.ID); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := os.Stat(p.EAP.ClientCert); !os.IsNotExist(err) {
+		t.Error("Expected the certificates to be deleted with the profile")
+	}
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	dir := t.TempDir()
+	for name, fixture := range map[string]string{"Office WiFi.yaml": "legacy_static.yaml", "HomeWiFi.yaml": "legacy_dhcp.yaml"} {
+		data, err := os.ReadFile(filepath.Join("testdata", fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(filepath.Join(dir, name), data, 0644)
+	}
+	os.WriteFile(filepath.Join(dir, "garbage.yaml"), []byte("not: [a, profile"), 0644)
+	// A structured profile stored under its SSID, as before profile IDs.
+	os.WriteFile(filepath.Join(dir, "Cafe.yaml"), []byte("id: Cafe\nssid: Cafe\nsecurity: open\n"), 0644)
+
+	store := NewStore(dir)
+	n, err := store.MigrateLegacy()
+	if err != nil || n != 3 {
+		t.Fatalf("Expected 3 profiles migrated, got %d (err: %v)", n, err)
+	}
+
+	office, err := store.Find("Office WiFi")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if office.SSID != "Office WiFi" || office.PMK == "" || office.PSK != "" || office.IPMode != IPModeStatic ||
+		office.Static.Address != "192.168.1.150/24" || office.Static.Gateway != "192.168.1.1" || len(office.Static.DNS) != 2 {
+		t.Errorf("Unexpected static profile: %+v", office)
+	}
+	home, _ := store.Find("HomeWiFi")
+	if home.IPMode != IPModeDHCP || home.ClientConfig().Password == "" {
+		t.Errorf("Unexpected DHCP profile: %+v", home)
+	}
+	if _, err := os.Stat(filepath.Join(dir, LegacyDir, "HomeWiFi.yaml")); err != nil {
+		t.Errorf("Expected the original file to be kept in %s: %v", LegacyDir, err)
+	}
+	if cafe, err := store.Find("Cafe"); err != nil || cafe.ID != ID("Cafe") {
+		t.Errorf("Expected the Cafe profile to be stored under its ID, got %+v (err: %v)", cafe, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Cafe.yaml")); !os.IsNotExist(err) {
+		t.Error("The profile stored under its SSID should be removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "garbage.yaml")); err != nil {
+		t.Error("Files that are not netplan profiles should be left alone")
+	}
+
+	if n, err := store.MigrateLegacy(); err != nil || n != 0 {
+		t.Errorf("Expected a second migration to be a no-op, got %d (err: %v)", n, err)
+	}
+}
+
+func TestIDsStayInsideTheStore(t *testing.T) {
+	root := t.TempDir()
+	store := NewStore(filepath.Join(root, "saved_networks"))
+	for _, ssid := range []string{"../../netplan/evil", "a/b", "..", "Caf\xe9", "日本語のネットワーク"} {
+		p := New(ssid, "secret123")
+		if err := store.Save(p); err != nil {
+			t.Fatalf("Save(%q) failed: %v", ssid, err)
+		}
+		got, err := store.Find(ssid)
+		if err != nil || got.SSID != ssid {
+			t.Errorf("Expected to read back %q, got %q (err: %v)", ssid, got.SSID, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "netplan")); !os.IsNotExist(err) {
+		t.Error("A profile was written outside the store")
+	}
+	if _, err := store.Get("../state"); !errors.Is(err, ErrInvalidID) {
+		t.Errorf("Expected ErrInvalidID for a path, got %v", err)
+	}
+	if err := store.Delete("../state"); !errors.Is(err, ErrInvalidID) {
+		t.Errorf("Expected Delete to refuse a path, got %v", err)
+	}
+}
+
+func FuzzID(f *testing.F) {
+	for _, seed := range []string{"", "HomeWiFi", "../../netplan/evil", "a/b", "a_b", "\x00\xff", "Office WiFi"} {
+		f.Add(seed, seed+"x")
+	}
+	f.Fuzz(func(t *testing.T, a, b string) {
+		id := ID(a)
+		if !ValidID(id) {
+			t.Fatalf("ID(%q) = %q is not a valid ID", a, id)
+		}
+		if strings.ContainsAny(id, `/\.`) {
+			t.Fatalf("ID(%q) = %q contains path characters", a, id)
+		}
+		if id != ID(a) {
+			t.Fatalf("ID(%q) is not stable", a)
+		}
+		if a != b && id == ID(b) {
+			t.Fatalf("ID(%q) and ID(%q) collide: %q", a, b, id)
+		}
+	})
+}
+
+func FuzzStorePath(f *testing.F) {
+	for _, seed := range []string{"HomeWiFi", "../x", "/etc/passwd", "a/../../b", "..", "", "\x00"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, ref string) {
+		dir := t.TempDir()
+		store := NewStore(dir)
+		if ValidID(ref) {
+			if rel, err := filepath.Rel(dir, store.path(ref)); err != nil || strings.HasPrefix(rel, "..") || strings.ContainsRune(rel, filepath.Separator) {
+				t.Fatalf("ID %q resolves outside the store: %s", ref, store.path(ref))
+			}
+		}
+		if len(ref) == 0 || len(ref) > MaxSSIDLength {
+			return
+		}
+		if err := store.Save(New(ref, "secret123")); err != nil {
+			t.Fatalf("Save(%q) failed: %v", ref, err)
+		}
+		got, err := store.Find(ref)
+		if err != nil || got.SSID != ref {
+			t.Fatalf("Round trip of %q returned %q (err: %v)", ref, got.SSID, err)
+		}
+		entries, _ := os.ReadDir(dir)
+		if len(entries) != 1 {
+			t.Fatalf("Expected one file in the store, got %d", len(entries))
+		}
+	})
+}
+
+func TestCandidates(t *testing.T) {
+	home := New("HomeWiFi", "secret123")
+	office := New("Office", "secret123")
+	office.Priority = 10
+	cafe := New("Cafe", "")
+	attic := New("Attic", "secret123")
+	attic.Hidden = true
+	manual := New("Neighbour", "secret123")
+	manual.Autoconnect = false
+	away := New("Away", "secret123")
+	away.Priority = 100
+	list := []Profile{home, office, cafe, attic, manual, away}
+
+	signal := map[string]float64{"HomeWiFi": -70, "Office": -80, "Cafe": -40, "Neighbour": -30}
+	var got []string
+	for _, p := range Candidates(list, signal) {
+		got = append(got, p.SSID)
+	}
+	if want := "Office Cafe HomeWiFi Attic"; strings.Join(got, " ") != want {
+		t.Errorf("Unexpected candidates %q, want %q", strings.Join(got, " "), want)
+	}
+
+	if n := len(Candidates(list, nil)); n != 5 {
+		t.Errorf("Expected every autoconnect profile without a scan, got %d", n)
+	}
+}
@@ -0,0 +1,168 @@
+package profiles
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeyFileName is the device key file, kept next to the store's directory:
+// /etc/pifigo/device.key for the default store.
+const KeyFileName = "device.key"
+
+const (
+	keySize         = 32 // AES-256
+	encryptedPrefix = "enc:"
+)
+
+// ErrNoKey is returned when a profile is encrypted and the device key is missing.
+var ErrNoKey = errors.New("profile is encrypted but the device key is missing")
+
+// PMK returns the WPA pre-shared key for a passphrase, as the 64 hex digits
+// wpa_supplicant, netplan and NetworkManager accept in place of the
+// passphrase. It is PBKDF2-SHA1 of the passphrase salted with the SSID.
+func PMK(passphrase, ssid string) (string, error) {
+	key, err := pbkdf2.Key(sha1.New, passphrase, []byte(ssid), 4096, 32)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// secrets returns the fields that are encrypted with the device key.
+func (p *Profile) secrets() []*string {
+	secrets := []*string{&p.PSK, &p.PMK}
+	if p.EAP != nil {
+		secrets = append(secrets, &p.EAP.Password, &p.EAP.ClientKeyPassword)
+	}
+	return secrets
+}
+
+// convertsToPMK reports whether the profile's passphrase can be replaced by
+// its PMK. WPA3-SAE, also in transition mode, needs the passphrase itself,
+// and only passphrases of 8 to 63 characters have a PMK.
+func convertsToPMK(p Profile) bool {
+	return p.Security == SecurityWPA2PSK && len(p.PSK) >= 8 && len(p.PSK) <= 63
+}
+
+// key returns the device key, or nil if there is none.
+func (s *Store) key() ([]byte, error) {
+	key, err := os.ReadFile(s.KeyFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device key: %w", err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("device key %s must be %d bytes", s.KeyFile, keySize)
+	}
+	return key, nil
+}
+
+// newKey generates a device key and writes it to the key file.
+func (s *Store) newKey() ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := writeFile(s.KeyFile, key); err != nil {
+		return nil, fmt.Errorf("failed to write device key: %w", err)
+	}
+	return key, nil
+}
+
+// seal encrypts a secret with AES-GCM, bound to the profile ID.
+func seal(key []byte, id, secret string) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), []byte(id))
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// unseal reverses seal. Values without the prefix are returned as they are,
+// so plaintext profiles stay readable.
+func unseal(key []byte, id, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	if key == nil {
+		return "", ErrNoKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode secret: %w", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("encrypted secret is too short")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(id))
+	if err != nil {
+		return "", errors.New("failed to decrypt secret: wrong device key")
+	}
+	return string(plain), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Secure rewrites every profile with the current storage settings: mode
+// 0600, passphrases replaced by their PMK where possible, and the secrets
+// encrypted with the device key if encrypt is set. Turning encryption off
+// decrypts the profiles and removes the key, unless a profile cannot be
+// read, in which case nothing is changed so its secrets are not lost.
+func (s *Store) Secure(encrypt bool) error {
+	key, err := s.key()
+	if err != nil {
+		return err
+	}
+	list, err := s.list(key, !encrypt)
+	if err != nil {
+		return fmt.Errorf("cannot turn profile encryption off: %w", err)
+	}
+	switch {
+	case encrypt && key == nil:
+		if key, err = s.newKey(); err != nil {
+			return err
+		}
+	case !encrypt:
+		key = nil
+	}
+	for _, p := range list {
+		if err := s.save(p, key); err != nil {
+			return err
+		}
+	}
+	if !encrypt {
+		if err := os.Remove(s.KeyFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove device key: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package scan
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Cache holds the most recent scan results so that clients polling the portal
+// never trigger a scan of their own. Scans are run by a single background
+// goroutine, and concurrent Refresh calls share one scan.
+type Cache struct {
+	iface   string
+	apForce func() bool
+
+	mu       sync.Mutex
+	networks []Network
+	updated  time.Time
+	err      error
+	inflight chan struct{}
+}
+
+// NewCache returns an empty cache for the interface. apForce is consulted
+// before every scan and should report whether the hotspot is up.
+func NewCache(iface string, apForce func() bool) *Cache {
+	return &Cache{iface: iface, apForce: apForce}
+}
+
+// Networks returns the cached results and when they were taken. The error
+// is only set when no scan has succeeded yet.
+func (c *Cache) Networks() ([]Network, time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.updated.IsZero() {
+		return nil, c.updated, c.err
+	}
+	return c.networks, c.updated, nil
+}
+
+// Refresh runs a scan and updates the cache. If a scan is already running,
+// it waits for that scan and returns its results instead of starting another.
+func (c *Cache) Refresh() ([]Network, error) {
+	c.mu.Lock()
+	if c.inflight != nil {
+		done := c.inflight
+		c.mu.Unlock()
+		<-done
+		networks, _, err := c.Networks()
+		return networks, err
+	}
+	done := make(chan struct{})
+	c.inflight = done
+	c.mu.Unlock()
+
+	apForce := c.apForce != nil && c.apForce()
+	networks, err := Scan(c.iface, apForce)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inflight = nil
+	close(done)
+	c.err = err
+	if err != nil {
+		if c.updated.IsZero() {
+			return nil, err
+		}
+		return c.networks, err
+	}
+	c.networks = networks
+	c.updated = time.Now()
+	return networks, nil
+}
+
+// Run refreshes the cache immediately and then every interval until ctx is
+// done.
+func (c *Cache) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := c.Refresh(); err != nil {
+			log.Printf("WARNING: Background Wi-Fi scan failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// Package scan runs Wi-Fi scans and parses the output of 'iw dev <iface> scan'
+// into structured results.
+package scan
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ExecCommand is exported so tests can replace it with canned scan output.
+var ExecCommand = exec.Command
+
+// Security is the strongest key management a network advertises.
+type Security string
+
+const (
+	SecurityOpen    Security = "open"
+	SecurityWEP     Security = "wep"
+	SecurityWPA2PSK Security = "wpa2-psk"
+	SecurityWPA3SAE Security = "wpa3-sae"
+	SecurityEAP     Security = "eap"
+
+	// SecurityWPA3Transition is a network offering both WPA2-PSK and
+	// WPA3-SAE, so clients of either kind can join.
+	SecurityWPA3Transition Security = "wpa3-transition"
+)
+
+// Network is a single BSS seen during a scan.
+type Network struct {
+	BSSID     string   `json:"bssid"`
+	SSID      string   `json:"ssid"`
+	Frequency int      `json:"frequency"`
+	Band      string   `json:"band"`
+	Channel   int      `json:"channel"`
+	Signal    float64  `json:"signal"`
+	Security  Security `json:"security"`
+	Hidden    bool     `json:"hidden"`
+}
+
+// Bars maps the signal strength to a 0-4 scale for display.
+func (n Network) Bars() int {
+	switch {
+	case n.Signal >= -55:
+		return 4
+	case n.Signal >= -67:
+		return 3
+	case n.Signal >= -75:
+		return 2
+	case n.Signal >= -85:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Scan runs a scan on the interface and returns the visible networks,
+// deduplicated by SSID and sorted by signal strength. apForce lets the scan
+// run while the interface is operating as an access point.
+func Scan(iface string, apForce bool) ([]Network, error) {
+	args := []string{"dev", iface, "scan"}
+	if apForce {
+		args = append(args, "ap-force")
+	}
+	output, err := ExecCommand("iw", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("iw scan on %s failed: %w", iface, err)
+	}
+	return Dedupe(Parse(string(output))), nil
+}
+
+// bssState collects the fields of one BSS block while it is being parsed.
+type bssState struct {
+	Network
+	privacy           bool
+	psk, sae, eap     bool
+	haveRSNOrWPA      bool
+	channelFromDSInfo int
+}
+
+func (b *bssState) finish() Network {
+	n := b.Network
+	switch {
+	case b.eap:
+		n.Security = SecurityEAP
+	case b.psk && b.sae:
+		n.Security = SecurityWPA3Transition
+	case b.psk:
+		n.Security = SecurityWPA2PSK
+	case b.sae:
+		n.Security = SecurityWPA3SAE
+	case b.privacy && !b.haveRSNOrWPA:
+		n.Security = SecurityWEP
+	default:
+		n.Security = SecurityOpen
+	}
+	n.Band, n.Channel = bandAndChannel(n.Frequency)
+	if n.Channel == 0 {
+		n.Channel = b.channelFromDSInfo
+	}
+	n.Hidden = strings.Trim(n.SSID, "\x00") == ""
+	if n.Hidden {
+		n.SSID = ""
+	}
+	return n
+}
+
+// Parse parses the full output of 'iw dev <iface> scan'. Every BSS is
+// returned, including hidden networks and duplicate SSIDs.
+func Parse(output string) []Network {
+	var networks []Network
+	var cur *bssState
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "BSS ") {
+			if cur != nil {
+				networks = append(networks, cur.finish())
+			}
+			cur = &bssState{}
+			bssid := strings.TrimPrefix(line, "BSS ")
+			if i := strings.IndexAny(bssid, "( "); i >= 0 {
+				bssid = bssid[:i]
+			}
+			cur.BSSID = bssid
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		key, value, _ := strings.Cut(trimmed, ":")
+		value = strings.TrimSpace(value)
+		switch key {
+		case "freq":
+			if f, err := strconv.ParseFloat(value, 64); err == nil {
+				cur.Frequency = int(f)
+			}
+		case "signal":
+			if s, err := strconv.ParseFloat(strings.TrimSuffix(value, " dBm"), 64); err == nil {
+				cur.Signal = s
+			}
+		case "SSID":
+			// iw escapes leading and trailing spaces, so trimming is safe.
+			cur.SSID = unescapeSSID(value)
+		case "capability":
+			cur.privacy = strings.Contains(value, "Privacy")
+		case "DS Parameter set":
+			if ch, err := strconv.Atoi(strings.TrimPrefix(value, "channel ")); err == nil {
+				cur.channelFromDSInfo = ch
+			}
+		case "RSN", "WPA":
+			cur.haveRSNOrWPA = true
+		case "* Authentication suites":
+			for _, suite := range strings.Fields(value) {
+				switch suite {
+				case "PSK", "PSK/SHA-256", "FT/PSK":
+					cur.psk = true
+				case "SAE", "FT/SAE":
+					cur.sae = true
+				case "802.1X", "FT/802.1X", "802.1X/SHA-256", "802.1X/SUITE-B", "802.1X/SUITE-B-192":
+					cur.eap = true
+				}
+			}
+		}
+	}
+	if cur != nil {
+		networks = append(networks, cur.finish())
+	}
+	return networks
+}
+
+// Dedupe keeps the strongest BSS for each SSID and sorts the result by signal,
+// strongest first. Hidden networks are dropped since they cannot be picked by
+// name.
+func Dedupe(networks []Network) []Network {
+	best := make(map[string]Network)
+	for _, n := range networks {
+		if n.Hidden {
+			continue
+		}
+		if cur, ok := best[n.SSID]; !ok || n.Signal > cur.Signal {
+			best[n.SSID] = n
+		}
+	}
+	result := make([]Network, 0, len(best))
+	for _, n := range best {
+		result = append(result, n)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Signal != result[j].Signal {
+			return result[i].Signal > result[j].Signal
+		}
+		return result[i].SSID < result[j].SSID
+	})
+	return result
+}
+
+// bandAndChannel derives the band and channel number from a frequency in MHz.
+func bandAndChannel(freq int) (string, int) {
+	switch {
+	case freq == 2484:
+		return "2.4GHz", 14
+	case freq >= 2412 && freq <= 2472:
+		return "2.4GHz", (freq - 2407) / 5
+	case freq >= 5955 && freq <= 7115:
+		return "6GHz", (freq - 5950) / 5
+	case freq >= 5160 && freq <= 5885:
+		return "5GHz", (freq - 5000) / 5
+	default:
+		return "", 0
+	}
+}
+
+// unescapeSSID reverses the \xNN escaping iw applies to non-printable bytes.
+func unescapeSSID(s string) string {
+	if !strings.Contains(s, `\x`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if v, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,155 @@
+package scan
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	output, err := os.ReadFile("testdata/iw_scan.txt")
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+	networks := Parse(string(output))
+	if len(networks) != 8 {
+		t.Fatalf("Expected 8 BSS entries, got %d: %+v", len(networks), networks)
+	}
+
+	expected := []Network{
+		{BSSID: "aa:bb:cc:00:00:01", SSID: "HomeWiFi", Frequency: 2437, Band: "2.4GHz", Channel: 6, Signal: -48, Security: SecurityWPA2PSK},
+		{BSSID: "aa:bb:cc:00:00:02", SSID: "HomeWiFi", Frequency: 5180, Band: "5GHz", Channel: 36, Signal: -71, Security: SecurityWPA2PSK},
+		{BSSID: "aa:bb:cc:00:00:03", SSID: "Coffee Shop!", Frequency: 2412, Band: "2.4GHz", Channel: 1, Signal: -80, Security: SecurityOpen},
+		{BSSID: "aa:bb:cc:00:00:04", SSID: "Modern", Frequency: 5955, Band: "6GHz", Channel: 1, Signal: -60, Security: SecurityWPA3SAE},
+		{BSSID: "aa:bb:cc:00:00:05", SSID: "eduroam", Frequency: 2462, Band: "2.4GHz", Channel: 11, Signal: -66, Security: SecurityEAP},
+		{BSSID: "aa:bb:cc:00:00:06", SSID: "OldRouter", Frequency: 2422, Band: "2.4GHz", Channel: 3, Signal: -85, Security: SecurityWEP},
+		{BSSID: "aa:bb:cc:00:00:07", SSID: "", Frequency: 2442, Band: "2.4GHz", Channel: 7, Signal: -55, Security: SecurityWPA2PSK, Hidden: true},
+		{BSSID: "aa:bb:cc:00:00:08", SSID: "", Frequency: 2452, Band: "2.4GHz", Channel: 9, Signal: -58, Security: SecurityWPA2PSK, Hidden: true},
+	}
+	for i, want := range expected {
+		if networks[i] != want {
+			t.Errorf("Network %d:\n got: %+v\nwant: %+v", i, networks[i], want)
+		}
+	}
+}
+
+func TestParseTransitionMode(t *testing.T) {
+	output := `BSS aa:bb:cc:00:00:09(on wlan0)
+	freq: 5200
+	capability: ESS Privacy (0x0011)
+	signal: -50.00 dBm
+	SSID: Mixed
+	RSN:	 * Version: 1
+		 * Authentication suites: PSK SAE
+`
+	networks := Parse(output)
+	if len(networks) != 1 || networks[0].Security != SecurityWPA3Transition {
+		t.Errorf("Expected a WPA2/WPA3 transition mode network, got %+v", networks)
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	networks := []Network{
+		{SSID: "HomeWiFi", BSSID: "1", Signal: -70},
+		{SSID: "Office", BSSID: "2", Signal: -60},
+		{SSID: "HomeWiFi", BSSID: "3", Signal: -40},
+		{SSID: "", BSSID: "4", Signal: -30, Hidden: true},
+	}
+	result := Dedupe(networks)
+	if len(result) != 2 {
+		t.Fatalf("Expected 2 networks, got %+v", result)
+	}
+	if result[0].BSSID != "3" || result[1].SSID != "Office" {
+		t.Errorf("Expected strongest HomeWiFi first, then Office, got %+v", result)
+	}
+}
+
+func TestBars(t *testing.T) {
+	cases := map[float64]int{-40: 4, -60: 3, -70: 2, -80: 1, -90: 0}
+	for signal, want := range cases {
+		if got := (Network{Signal: signal}).Bars(); got != want {
+			t.Errorf("Bars() for %v dBm = %d, want %d", signal, got, want)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	originalExec := ExecCommand
+	ExecCommand = func(name string, arg ...string) *exec.Cmd {
+		return exec.Command("cat", "testdata/iw_scan.txt")
+	}
+	defer func() { ExecCommand = originalExec }()
+
+	networks, err := Scan("wlan_test", false)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if len(networks) != 5 || networks[0].SSID != "HomeWiFi" || networks[0].Signal != -48 {
+		t.Errorf("Unexpected scan result: %+v", networks)
+	}
+}
+
+func TestCacheRefreshCoalesces(t *testing.T) {
+	var mu sync.Mutex
+	var calls [][]string
+	originalExec := ExecCommand
+	ExecCommand = func(name string, arg ...string) *exec.Cmd {
+		mu.Lock()
+		calls = append(calls, arg)
+		mu.Unlock()
+		return exec.Command("sh", "-c", "sleep 0.2; cat testdata/iw_scan.txt")
+	}
+	defer func() { ExecCommand = originalExec }()
+
+	cache := NewCache("wlan_test", func() bool { return true })
+	if _, _, err := cache.Networks(); err != nil {
+		t.Errorf("Expected no error from an empty cache, got %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if networks, err := cache.Refresh(); err != nil || len(networks) != 5 {
+				t.Errorf("Refresh returned %d networks (err: %v)", len(networks), err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(calls) != 1 {
+		t.Fatalf("Expected concurrent refreshes to share one scan, got %d scans", len(calls))
+	}
+	if strings.Join(calls[0], " ") != "dev wlan_test scan ap-force" {
+		t.Errorf("Expected an ap-force scan while the hotspot is up, got %v", calls[0])
+	}
+	networks, updated, err := cache.Networks()
+	if err != nil || len(networks) != 5 || updated.IsZero() {
+		t.Errorf("Unexpected cached result: %d networks at %v (err: %v)", len(networks), updated, err)
+	}
+}
+
+func TestCacheKeepsResultsOnFailure(t *testing.T) {
+	originalExec := ExecCommand
+	defer func() { ExecCommand = originalExec }()
+
+	cache := NewCache("wlan_test", nil)
+	ExecCommand = func(name string, arg ...string) *exec.Cmd { return exec.Command("false") }
+	if _, err := cache.Refresh(); err == nil {
+		t.Fatal("Expected an error from a failing scan")
+	}
+	if _, _, err := cache.Networks(); err == nil {
+		t.Error("Expected the error to be reported while nothing is cached")
+	}
+
+	ExecCommand = func(name string, arg ...string) *exec.Cmd { return exec.Command("cat", "testdata/iw_scan.txt") }
+	cache.Refresh()
+	ExecCommand = func(name string, arg ...string) *exec.Cmd { return exec.Command("false") }
+	cache.Refresh()
+	if networks, _, err := cache.Networks(); err != nil || len(networks) != 5 {
+		t.Errorf("Expected stale results to survive a failed scan, got %d (err: %v)", len(networks), err)
+	}
+}
@@ -0,0 +1,448 @@
+// Package state tracks which connection mode pifigo is in and which network
+// profiles it has used. It is the single source of truth for the mode:
+// transitions are serialized, checked against the allowed moves, persisted to
+// disk and published to subscribers.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPath is where the daemon persists its state.
+	DefaultPath = "/var/lib/pifigo/state.json"
+	// LegacySymlink is where earlier versions tracked the last-good network.
+	LegacySymlink = "/etc/pifigo/last-good-wifi.yaml"
+)
+
+// State is a connection mode.
+type State string
+
+const (
+	// Hotspot is setup mode: the access point is up and no client network is
+	// configured, or the user has not picked one yet.
+	Hotspot State = "hotspot"
+	// Connecting means a client connection is being applied and verified.
+	Connecting State = "connecting"
+	// Client means the device is connected to a client network.
+	Client State = "client"
+	// Degraded means the device is still on a client network but the
+	// connectivity checks are failing.
+	Degraded State = "degraded"
+	// Fallback means client mode was abandoned and the hotspot brought back,
+	// for example by the watchdog.
+	Fallback State = "fallback"
+)
+
+// transitions lists the states each state may move to.
+var transitions = map[State][]State{
+	Hotspot:    {Connecting},
+	Connecting: {Client, Hotspot, Fallback},
+	Client:     {Connecting, Degraded, Hotspot},
+	Degraded:   {Client, Connecting, Fallback, Hotspot},
+	Fallback:   {Connecting, Hotspot},
+}
+
+var (
+	// ErrBusy is returned by Acquire while another operation holds the machine.
+	ErrBusy = errors.New("another network operation is in progress")
+	// ErrInvalidTransition is returned for a move the state machine does not allow.
+	ErrInvalidTransition = errors.New("invalid state transition")
+)
+
+// IsClient reports whether the device is on a client network, healthy or not.
+func (s State) IsClient() bool { return s == Client || s == Degraded }
+
+// IsHotspot reports whether the access point is up.
+func (s State) IsHotspot() bool { return s == Hotspot || s == Fallback }
+
+// Event describes one transition.
+type Event struct {
+	From   State     `json:"from"`
+	To     State     `json:"to"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// Failure records why a connection attempt failed.
+type Failure struct {
+	SSID   string    `json:"ssid"`
+	Stage  string    `json:"stage"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// Counters track connection attempts for one profile.
+type Counters struct {
+	Attempts    int       `json:"attempts"`
+	Failures    int       `json:"failures"`
+	LastAttempt time.Time `json:"last_attempt"`
+}
+
+// Snapshot is the persisted state. Profiles are identified by their ID in
+// the saved networks directory.
+type Snapshot struct {
+	State         State               `json:"state"`
+	Reason        string              `json:"reason,omitempty"`
+	Since         time.Time           `json:"since"`
+	ActiveProfile string              `json:"active_profile,omitempty"`
+	LastGood      string              `json:"last_good,omitempty"`
+	LastConnected time.Time           `json:"last_connected,omitempty"`
+	LastFailure   *Failure            `json:"last_failure,omitempty"`
+	Profiles      map[string]Counters `json:"profiles,omitempty"`
+}
+
+// Machine is the connection state machine. The zero value is not usable;
+// create one with New or Load.
+//
+// The file is re-read before every read and every change if it was replaced
+// since, so edits made by another process, such as 'pifigo --set-good' or
+// '--force-hotspot' while the daemon runs, are seen and kept rather than
+// overwritten.
+type Machine struct {
+	mu      sync.Mutex
+	path    string
+	current Snapshot
+	file    os.FileInfo // The state file as last read or written.
+	op      string
+	subs    map[chan Event]struct{}
+}
+
+// New returns a machine in Hotspot that persists to path.
+func New(path string) *Machine {
+	return &Machine{path: path, current: Snapshot{State: Hotspot}, subs: make(map[chan Event]struct{})}
+}
+
+// Load restores the machine from path. A missing file starts in Hotspot.
+func Load(path string) (*Machine, error) {
+	m := New(path)
+	file, _ := os.Stat(path)
+	current, err := readSnapshot(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.current, m.file = current, file
+	return m, nil
+}
+
+// readSnapshot reads and checks the state file.
+func readSnapshot(path string) (Snapshot, error) {
+	var current Snapshot
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return current, err
+	}
+	if err := json.Unmarshal(data, &current); err != nil {
+		return current, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	if _, ok := transitions[current.State]; !ok {
+		return current, fmt.Errorf("unknown state %q in %s", current.State, path)
+	}
+	return current, nil
+}
+
+// Current returns the current state.
+func (m *Machine) Current() State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reload()
+	return m.current.State
+}
+
+// Since returns when the current state was entered and why.
+func (m *Machine) Since() (time.Time, string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reload()
+	return m.current.Since, m.current.Reason
+}
+
+// Snapshot returns a copy of the full state.
+func (m *Machine) Snapshot() Snapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reload()
+	snap := m.current
+	if snap.LastFailure != nil {
+		failure := *snap.LastFailure
+		snap.LastFailure = &failure
+	}
+	snap.Profiles = make(map[string]Counters, len(m.current.Profiles))
+	for id, c := range m.current.Profiles {
+		snap.Profiles[id] = c
+	}
+	return snap
+}
+
+// LastGood returns the ID of the last profile that connected successfully.
+func (m *Machine) LastGood() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reload()
+	return m.current.LastGood
+}
+
+// LastFailure returns the most recent connection failure, or nil if the
+// last attempt succeeded.
+func (m *Machine) LastFailure() *Failure {
+	return m.Snapshot().LastFailure
+}
+
+// Transition moves to the given state if the move is allowed. Moving to the
+// current state is a no-op.
+func (m *Machine) Transition(to State, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reload()
+	from := m.current.State
+	if from == to {
+		return nil
+	}
+	allowed := false
+	for _, s := range transitions[from] {
+		allowed = allowed || s == to
+	}
+	if !allowed {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, from, to)
+	}
+	return m.set(to, reason)
+}
+
+// Force moves to the given state without checking the transition. It is
+// meant for reconciling with what the network backend reports, such as at
+// startup or after an administrator forced the hotspot.
+func (m *Machine) Force(to State, reason string) error {
+	if _, ok := transitions[to]; !ok {
+		return fmt.Errorf("%w: unknown state %q", ErrInvalidTransition, to)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reload()
+	if m.current.State == to {
+		return nil
+	}
+	return m.set(to, reason)
+}
+
+// SetLastGood makes the profile the one to fall back to. An empty ID clears it.
+func (m *Machine) SetLastGood(id string) error {
+	return m.update(func(s *Snapshot) { s.LastGood = id })
+}
+
+// RecordAttempt counts a connection attempt for the profile.
+func (m *Machine) RecordAttempt(id string) error {
+	return m.update(func(s *Snapshot) {
+		c := s.Profiles[id]
+		c.Attempts++
+		c.LastAttempt = time.Now()
+		s.setCounters(id, c)
+	})
+}
+
+// RecordSuccess marks the profile as active and last-good, and clears the
+// last failure.
+func (m *Machine) RecordSuccess(id string) error {
+	return m.update(func(s *Snapshot) {
+		s.ActiveProfile = id
+		s.LastGood = id
+		s.LastConnected = time.Now()
+		s.LastFailure = nil
+	})
+}
+
+// RecordFailure counts a failed attempt for the profile and keeps the reason
+// so the portal can show it.
+func (m *Machine) RecordFailure(id string, failure Failure) error {
+	return m.update(func(s *Snapshot) {
+		c := s.Profiles[id]
+		c.Failures++
+		s.setCounters(id, c)
+		s.LastFailure = &failure
+	})
+}
+
+// ForgetProfile drops everything recorded about a profile.
+func (m *Machine) ForgetProfile(id string) error {
+	return m.update(func(s *Snapshot) {
+		delete(s.Profiles, id)
+		if s.LastGood == id {
+			s.LastGood = ""
+		}
+		if s.ActiveProfile == id {
+			s.ActiveProfile = ""
+		}
+	})
+}
+
+// MigrateSymlink imports the last-good network from the symlink used by
+// earlier versions, which pointed at <dir>/<ssid>.yaml, and removes it.
+func (m *Machine) MigrateSymlink(symlink string) error {
+	target, err := os.Readlink(symlink)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", symlink, err)
+	}
+	id := strings.TrimSuffix(filepath.Base(target), ".yaml")
+	if m.LastGood() == "" {
+		if err := m.SetLastGood(id); err != nil {
+			return err
+		}
+		log.Printf("Migrated last-good network %s from %s.", id, symlink)
+	}
+	return os.Remove(symlink)
+}
+
+func (s *Snapshot) setCounters(id string, c Counters) {
+	if s.Profiles == nil {
+		s.Profiles = make(map[string]Counters)
+	}
+	s.Profiles[id] = c
+}
+
+// update applies fn to the latest state and persists it.
+func (m *Machine) update(fn func(*Snapshot)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reload()
+	fn(&m.current)
+	return m.save()
+}
+
+// reload picks up changes another process made to the file. The current
+// state stays as this process knows it unless the file records a later
+// transition, such as the one 'pifigo --force-hotspot' makes, which is then
+// adopted and published. The file is only read when it was replaced since
+// this process last read or wrote it. The caller holds mu.
+func (m *Machine) reload() {
+	file, err := os.Stat(m.path)
+	if err != nil || m.file != nil && os.SameFile(file, m.file) && file.ModTime().Equal(m.file.ModTime()) {
+		return
+	}
+	disk, err := readSnapshot(m.path)
+	if err != nil {
+		return
+	}
+	m.file = file
+	if disk.Since.After(m.current.Since) && disk.State != m.current.State {
+		ev := Event{From: m.current.State, To: disk.State, Reason: disk.Reason, Time: disk.Since}
+		m.current = disk
+		m.publish(ev)
+		return
+	}
+	disk.State, disk.Reason, disk.Since = m.current.State, m.current.Reason, m.current.Since
+	m.current = disk
+}
+
+// set persists the new state and publishes the transition. The caller holds mu.
+func (m *Machine) set(to State, reason string) error {
+	ev := Event{From: m.current.State, To: to, Reason: reason, Time: time.Now()}
+	m.current.State, m.current.Reason, m.current.Since = to, reason, ev.Time
+	m.publish(ev)
+	return m.save()
+}
+
+// publish logs the transition and sends it to the subscribers. The caller
+// holds mu.
+func (m *Machine) publish(ev Event) {
+	log.Printf("State: %s -> %s (%s)", ev.From, ev.To, ev.Reason)
+	for ch := range m.subs {
+		select {
+		case ch <- ev:
+		default: // A subscriber that is not keeping up misses events.
+		}
+	}
+}
+
+// save writes the state file atomically, so a reader sees either the old or
+// the new file and never a partial one. The caller holds mu.
+func (m *Machine) save() error {
+	if err := writeAtomic(m.path, m.current); err != nil {
+		log.Printf("ERROR: Could not persist state: %v", err)
+		return err
+	}
+	m.file, _ = os.Stat(m.path)
+	return nil
+}
+
+// writeAtomic writes v as JSON to a temporary file next to path, syncs it
+// and renames it over path.
+func writeAtomic(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".state-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to write state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write state: %w", err)
+	}
+	return nil
+}
+
+// Acquire claims the machine for an operation such as a connection attempt,
+// so conflicting operations are rejected instead of interleaved. It returns
+// ErrBusy while another operation holds it; otherwise the caller must call
+// the returned release function when done.
+func (m *Machine) Acquire(op string) (release func(), err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.op != "" {
+		return nil, fmt.Errorf("%w (%s)", ErrBusy, m.op)
+	}
+	m.op = op
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mu.Lock()
+			m.op = ""
+			m.mu.Unlock()
+		})
+	}, nil
+}
+
+// Subscribe returns a channel that receives every subsequent transition, and
+// a function that cancels the subscription. Events are dropped for a
+// subscriber whose buffer is full rather than blocking transitions.
+func (m *Machine) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 16)
+	m.mu.Lock()
+	m.subs[ch] = struct{}{}
+	m.mu.Unlock()
+	return ch, func() {
+		m.mu.Lock()
+		delete(m.subs, ch)
+		m.mu.Unlock()
+	}
+}
@@ -0,0 +1,160 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTransitionsArePersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	m, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if m.Current() != Hotspot {
+		t.Fatalf("Expected a fresh machine to start in hotspot mode, got %s", m.Current())
+	}
+
+	events, cancel := m.Subscribe()
+	defer cancel()
+	if err := m.Transition(Connecting, "connecting to HomeWiFi"); err != nil {
+		t.Fatalf("Transition failed: %v", err)
+	}
+	if err := m.Transition(Client, "connected to HomeWiFi"); err != nil {
+		t.Fatalf("Transition failed: %v", err)
+	}
+	if ev := <-events; ev.From != Hotspot || ev.To != Connecting {
+		t.Errorf("Unexpected first event: %+v", ev)
+	}
+	if ev := <-events; ev.From != Connecting || ev.To != Client || ev.Reason != "connected to HomeWiFi" {
+		t.Errorf("Unexpected second event: %+v", ev)
+	}
+
+	reloaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if reloaded.Current() != Client {
+		t.Errorf("Expected the persisted state to be client, got %s", reloaded.Current())
+	}
+}
+
+func TestForceFromAnotherProcess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	daemon, _ := Load(path)
+	daemon.Transition(Connecting, "connecting to HomeWiFi")
+	daemon.Transition(Client, "connected to HomeWiFi")
+	events, cancel := daemon.Subscribe()
+	defer cancel()
+
+	// 'pifigo --force-hotspot' loads its own machine and forces the state.
+	cli, _ := Load(path)
+	cli.Force(Hotspot, "forced from the command line")
+
+	if daemon.Current() != Hotspot {
+		t.Fatalf("Expected the daemon to adopt the forced state, got %s", daemon.Current())
+	}
+	if _, reason := daemon.Since(); reason != "forced from the command line" {
+		t.Errorf("Unexpected reason: %q", reason)
+	}
+	if ev := <-events; ev.From != Client || ev.To != Hotspot {
+		t.Errorf("Unexpected event: %+v", ev)
+	}
+
+	// An unchanged file is not read again.
+	info, _ := os.Stat(path)
+	os.WriteFile(path, []byte(`{"state": "client"}`), 0644)
+	os.Chtimes(path, info.ModTime(), info.ModTime())
+	if daemon.Current() != Hotspot {
+		t.Errorf("Expected the state file to be read only when replaced, got %s", daemon.Current())
+	}
+
+	// The daemon's own records keep the forced state.
+	daemon.RecordAttempt("HomeWiFi")
+	if reloaded, _ := Load(path); reloaded.Current() != Hotspot {
+		t.Errorf("Expected the forced state to be kept, got %s", reloaded.Current())
+	}
+}
+
+func TestInvalidTransition(t *testing.T) {
+	m, _ := Load(filepath.Join(t.TempDir(), "state.json"))
+	if err := m.Transition(Client, "skipping verification"); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Expected ErrInvalidTransition for hotspot -> client, got %v", err)
+	}
+	if err := m.Force(Client, "found a client configuration at startup"); err != nil {
+		t.Errorf("Force failed: %v", err)
+	}
+	if m.Current() != Client {
+		t.Errorf("Expected client after Force, got %s", m.Current())
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	m, _ := Load(filepath.Join(t.TempDir(), "state.json"))
+	release, err := m.Acquire("connect")
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	if _, err := m.Acquire("connect"); !errors.Is(err, ErrBusy) {
+		t.Errorf("Expected ErrBusy for a second operation, got %v", err)
+	}
+	release()
+	release() // Releasing twice must not free a later operation's claim.
+	if _, err := m.Acquire("reconnect"); err != nil {
+		t.Errorf("Expected Acquire to succeed after release, got %v", err)
+	}
+}
+
+func TestProfileRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	m, _ := Load(path)
+	m.RecordAttempt("HomeWiFi")
+	m.RecordFailure("HomeWiFi", Failure{SSID: "HomeWiFi", Stage: "dhcp", Reason: "no lease"})
+	if f := m.LastFailure(); f == nil || f.Stage != "dhcp" {
+		t.Errorf("Expected the dhcp failure to be recorded, got %+v", f)
+	}
+	m.RecordAttempt("HomeWiFi")
+	m.RecordSuccess("HomeWiFi")
+
+	reloaded, _ := Load(path)
+	snap := reloaded.Snapshot()
+	if snap.LastGood != "HomeWiFi" || snap.ActiveProfile != "HomeWiFi" || snap.LastConnected.IsZero() {
+		t.Errorf("Expected HomeWiFi to be active and last-good, got %+v", snap)
+	}
+	if snap.LastFailure != nil {
+		t.Errorf("A successful connect should clear the last failure, got %+v", snap.LastFailure)
+	}
+	if c := snap.Profiles["HomeWiFi"]; c.Attempts != 2 || c.Failures != 1 {
+		t.Errorf("Unexpected counters: %+v", c)
+	}
+
+	// A change made through another machine, as the CLI does, is seen.
+	reloaded.ForgetProfile("HomeWiFi")
+	if got := m.LastGood(); got != "" {
+		t.Errorf("Expected a change from another process to be picked up, got last-good %q", got)
+	}
+}
+
+func TestMigrateSymlink(t *testing.T) {
+	dir := t.TempDir()
+	profile := filepath.Join(dir, "HomeWiFi.yaml")
+	symlink := filepath.Join(dir, "last-good-wifi.yaml")
+	os.WriteFile(profile, []byte("..."), 0644)
+	os.Symlink(profile, symlink)
+
+	m, _ := Load(filepath.Join(dir, "state.json"))
+	if err := m.MigrateSymlink(symlink); err != nil {
+		t.Fatalf("MigrateSymlink failed: %v", err)
+	}
+	if m.LastGood() != "HomeWiFi" {
+		t.Errorf("Expected last-good HomeWiFi, got %q", m.LastGood())
+	}
+	if _, err := os.Lstat(symlink); !os.IsNotExist(err) {
+		t.Error("The symlink should be removed after migration")
+	}
+	if err := m.MigrateSymlink(symlink); err != nil {
+		t.Errorf("Migrating again should be a no-op, got %v", err)
+	}
+}
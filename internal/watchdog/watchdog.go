@@ -1,81 +1,271 @@
 package watchdog
 
 import (
+	"context"
 	"log"
-	"net/http"
-	"os"
 	"time"
 
 	"pifigo/internal/bootmanager"
 	"pifigo/internal/config"
+	"pifigo/internal/network"
+	"pifigo/internal/probe"
+	"pifigo/internal/state"
 )
 
+// Recovery steps, as listed under watchdog.escalation in config.yaml.
 const (
-	activeClientConfig = "/etc/netplan/99-pifigo-client.yaml"
+	StepReprobe        = "reprobe"         // Only wait and check again.
+	StepReassociate    = "reassociate"     // Make the interface rejoin the current network.
+	StepRestartBackend = "restart_backend" // Restart the service managing the client network.
+	StepOtherNetworks  = "other_networks"  // Try the other saved networks in range.
+	StepHotspot        = "hotspot"         // Give up and bring the hotspot back.
 )
 
-// Start begins the watchdog process in a continuous loop.
-// It only takes action if it's enabled in the config.
-func Start(cfg *config.Config) {
+// DefaultEscalation is used when watchdog.escalation is not set.
+var DefaultEscalation = []string{StepReprobe, StepReassociate, StepRestartBackend, StepOtherNetworks, StepHotspot}
+
+const (
+	settleDelay          = 2 * time.Minute
+	defaultCheckInterval = 2 * time.Minute
+	defaultBackoffMax    = 15 * time.Minute
+	defaultPortalIdle    = 5 * time.Minute
+)
+
+// watchdog holds the state of the recovery ladder between checks.
+type watchdog struct {
+	cfg        *config.Config
+	backend    network.NetworkBackend
+	machine    *state.Machine
+	escalation []string
+	check      func(ctx context.Context) probe.Report
+	// portalIdle reports how long since the portal was last used, or
+	// math.MaxInt64 if it never was. A nil func treats the portal as idle.
+	portalIdle func() time.Duration
+	now        func() time.Time
+
+	failures  int       // Consecutive failed checks.
+	step      int       // Recovery steps taken since connectivity was lost.
+	retries   int       // Failed attempts to leave the hotspot.
+	lastRetry time.Time // When client mode was last retried from the hotspot.
+}
+
+func newWatchdog(cfg *config.Config, backend network.NetworkBackend, machine *state.Machine, portalIdle func() time.Duration) *watchdog {
+	w := &watchdog{
+		cfg:        cfg,
+		backend:    backend,
+		machine:    machine,
+		portalIdle: portalIdle,
+		now:        time.Now,
+	}
+	probes := probe.FromConfig(cfg)
+	w.check = func(ctx context.Context) probe.Report {
+		st, err := backend.Status()
+		if err != nil {
+			log.Printf("WARNING: Watchdog could not read the interface status: %v", err)
+		}
+		return probe.Diagnose(ctx, probes, st, cfg.Network.WirelessInterface)
+	}
+	for _, step := range cfg.Watchdog.Escalation {
+		switch step {
+		case StepReprobe, StepReassociate, StepRestartBackend, StepOtherNetworks, StepHotspot:
+			w.escalation = append(w.escalation, step)
+		default:
+			log.Printf("WARNING: Watchdog: Ignoring unknown escalation step %q.", step)
+		}
+	}
+	if len(w.escalation) == 0 {
+		w.escalation = DefaultEscalation
+	}
+	return w
+}
+
+// Start runs the watchdog until ctx is done. portalIdle reports how long the
+// web portal has gone unused; client mode is only retried from the hotspot
+// while nobody is using it.
+func Start(ctx context.Context, cfg *config.Config, backend network.NetworkBackend, machine *state.Machine, portalIdle func() time.Duration) {
 	// Give the system a couple of minutes to settle after boot before starting checks.
-	time.Sleep(2 * time.Minute)
+	if !sleep(ctx, settleDelay) {
+		return
+	}
 
 	log.Println("Watchdog service started.")
-	failureCount := 0
-
-	for {
-		// Wait for the configured interval before the next check.
-		time.Sleep(time.Duration(cfg.Watchdog.CheckIntervalSeconds) * time.Second)
-
-		// Before checking, verify that we are supposed to be in client mode.
-		// If the client config file doesn't exist, it means we are correctly
-		// in hotspot mode, so the watchdog should do nothing.
-		if _, err := os.Stat(activeClientConfig); os.IsNotExist(err) {
-			if failureCount > 0 {
-				log.Println("Watchdog: Device is in hotspot mode. Resetting failure count.")
-				failureCount = 0 // Reset counter if we're back in hotspot mode.
-			}
-			continue // Skip the check.
+	w := newWatchdog(cfg, backend, machine, portalIdle)
+	for sleep(ctx, w.tick(ctx)) {
+	}
+	log.Println("Watchdog service stopped.")
+}
+
+// sleep waits for d and reports whether ctx is still live afterwards.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// tick performs one round of the watchdog and returns how long to wait
+// before the next. On a client network it checks connectivity and, once the
+// failure threshold is reached, takes the next recovery step, backing off
+// exponentially between steps. While the hotspot is up it may retry the
+// saved networks.
+func (w *watchdog) tick(ctx context.Context) time.Duration {
+	interval := w.interval()
+	current := w.machine.Current()
+	if !current.IsClient() {
+		if w.failures > 0 || w.step > 0 {
+			log.Printf("Watchdog: Device is in %s mode. Resetting failure count.", current)
 		}
+		w.failures, w.step = 0, 0
+		if current.IsHotspot() {
+			w.retryFromHotspot()
+		}
+		return interval
+	}
+	w.retries = 0
 
-		// We are in client mode, so perform the connectivity check.
-		if !checkInternet(cfg.Watchdog.CheckURL) {
-			failureCount++
-			log.Printf("Watchdog: Connectivity check failed (%d/%d).", failureCount, cfg.Watchdog.FailureThreshold)
-		} else {
-			// If the connection is good, reset the counter.
-			if failureCount > 0 {
-				log.Println("Watchdog: Connectivity restored. Resetting failure count.")
-			}
-			failureCount = 0
+	report := w.check(ctx)
+	if report.Online() {
+		if w.failures > 0 {
+			log.Println("Watchdog: Connectivity restored. Resetting failure count.")
 		}
+		w.failures, w.step = 0, 0
+		_ = w.machine.Transition(state.Client, "connectivity restored")
+		return interval
+	}
+	w.failures++
+	log.Printf("Watchdog: Connectivity check failed (%d/%d): %s", w.failures, w.cfg.Watchdog.FailureThreshold, report.Summary())
+	_ = w.machine.Transition(state.Degraded, "connectivity check failed: "+report.Verdict.String())
+	if w.failures < w.cfg.Watchdog.FailureThreshold {
+		return interval
+	}
+	w.escalate(report.Verdict)
+	return backoff(interval, w.step, w.backoffMax())
+}
 
-		// If the failure threshold has been reached, take action.
-		if failureCount >= cfg.Watchdog.FailureThreshold {
-			log.Printf("Watchdog: Failure threshold of %d reached. Forcing hotspot mode.", cfg.Watchdog.FailureThreshold)
-			
-			// Call the function directly to revert to hotspot mode.
-			if err := bootmanager.ForceHotspotMode(); err != nil {
-				log.Printf("Watchdog: ERROR - Failed to force hotspot mode: %v", err)
-			}
-			
-			// Reset the counter after taking action to avoid continuous triggers.
-			failureCount = 0
+// escalate takes the next recovery step. Once the ladder is exhausted its
+// last step is repeated. Reassociating or restarting the backend cannot get
+// past a captive portal upstream, so those steps are skipped for one.
+func (w *watchdog) escalate(verdict probe.Verdict) {
+	step := w.escalation[min(w.step, len(w.escalation)-1)]
+	w.step++
+	for verdict == probe.VerdictCaptivePortal && (step == StepReassociate || step == StepRestartBackend) && w.step < len(w.escalation) {
+		log.Printf("Watchdog: Skipping %s behind a captive portal.", step)
+		step = w.escalation[w.step]
+		w.step++
+	}
+	log.Printf("Watchdog: Connectivity still failing (%s). Recovery step %d: %s.", verdict, w.step, step)
+	switch step {
+	case StepReprobe:
+		// The next check is the re-probe.
+	case StepReassociate, StepRestartBackend:
+		w.recover(step)
+	case StepOtherNetworks:
+		if bootmanager.AutoConnect(w.cfg, w.backend, w.machine, "connectivity lost") {
+			// Give the new network a fresh start.
+			w.failures, w.step = 0, 0
 		}
+	case StepHotspot:
+		w.fallback("connectivity lost: " + verdict.String())
 	}
 }
 
-// checkInternet performs a simple HTTP HEAD request to verify connectivity.
-func checkInternet(url string) bool {
-	client := http.Client{
-		Timeout: 5 * time.Second,
+// recover asks the backend to reassociate or restart, if it can.
+func (w *watchdog) recover(step string) {
+	r, ok := w.backend.(network.Recoverer)
+	if !ok {
+		log.Printf("Watchdog: The %s backend cannot %s. Skipping.", w.backend.Name(), step)
+		return
 	}
-	resp, err := client.Head(url)
+	release, err := w.machine.Acquire("watchdog " + step)
 	if err != nil {
-		return false
+		log.Printf("Watchdog: %v. Skipping %s.", err, step)
+		return
+	}
+	defer release()
+	fn := r.Reassociate
+	if step == StepRestartBackend {
+		fn = r.Restart
+	}
+	if err := fn(); err != nil {
+		log.Printf("ERROR: Watchdog %s failed: %v", step, err)
+	}
+}
+
+// fallback abandons client mode and brings the hotspot back.
+func (w *watchdog) fallback(reason string) {
+	release, err := w.machine.Acquire("watchdog fallback")
+	if err != nil {
+		log.Printf("Watchdog: %v. Not starting the hotspot.", err)
+		return
+	}
+	defer release()
+	log.Println("Watchdog: Recovery failed. Starting the hotspot.")
+	// ForceHotspotMode logs its own errors; the state moves on regardless,
+	// as the client network is not working either.
+	_ = bootmanager.ForceHotspotMode(w.backend)
+	_ = w.machine.Transition(state.Fallback, reason)
+}
+
+// retryFromHotspot tries the saved networks again once the hotspot has been
+// up for watchdog.hotspot_retry_seconds, doubling the wait after each miss,
+// and only while nobody is using the portal.
+func (w *watchdog) retryFromHotspot() {
+	base := time.Duration(w.cfg.Watchdog.HotspotRetrySeconds) * time.Second
+	if base <= 0 {
+		return
+	}
+	since, _ := w.machine.Since()
+	if w.lastRetry.After(since) {
+		since = w.lastRetry
+	}
+	if w.now().Sub(since) < backoff(base, w.retries, w.backoffMax()) {
+		return
+	}
+	if w.portalIdle != nil && w.portalIdle() < w.idleThreshold() {
+		return
+	}
+	log.Println("Watchdog: Portal is idle. Retrying saved networks.")
+	w.lastRetry = w.now()
+	if bootmanager.AutoConnect(w.cfg, w.backend, w.machine, "retrying from hotspot") {
+		w.retries = 0
+		return
+	}
+	w.retries++
+}
+
+func (w *watchdog) interval() time.Duration {
+	if d := time.Duration(w.cfg.Watchdog.CheckIntervalSeconds) * time.Second; d > 0 {
+		return d
+	}
+	return defaultCheckInterval
+}
+
+func (w *watchdog) backoffMax() time.Duration {
+	if d := time.Duration(w.cfg.Watchdog.BackoffMaxSeconds) * time.Second; d > 0 {
+		return d
+	}
+	return defaultBackoffMax
+}
+
+func (w *watchdog) idleThreshold() time.Duration {
+	if d := time.Duration(w.cfg.Watchdog.PortalIdleSeconds) * time.Second; d > 0 {
+		return d
+	}
+	return defaultPortalIdle
+}
+
+// backoff doubles base n times, capped at limit but never below base.
+func backoff(base time.Duration, n int, limit time.Duration) time.Duration {
+	d := base
+	for i := 0; i < n && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = max(limit, base)
 	}
-	defer resp.Body.Close()
-	
-	// A successful request is typically in the 2xx range.
-	return resp.StatusCode >= 200 && resp.StatusCode <= 299
+	return d
 }
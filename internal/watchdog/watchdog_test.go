@@ -1,19 +1,38 @@
 package watchdog
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"pifigo/internal/bootmanager"
+	"pifigo/internal/config"
+	"pifigo/internal/network"
+	"pifigo/internal/probe"
+	"pifigo/internal/profiles"
+	"pifigo/internal/scan"
+	"pifigo/internal/state"
 )
 
-// TestCheckInternet tests the checkInternet function with both a successful
-// and a failing mock server to verify its behavior.
+// TestCheckInternet tests the watchdog's default check of check_url with both
+// a successful and a failing mock server to verify its behavior.
 func TestCheckInternet(t *testing.T) {
-	// --- Test Case 1: Server is online and returns 200 OK ---
+	checkInternet := func(url string) bool {
+		cfg := &config.Config{}
+		cfg.Watchdog.CheckURL = url
+		return newWatchdog(cfg, network.NewFake(), nil, nil).check(context.Background()).Online()
+	}
+
+	// --- Test Case 1: Server is online and returns 204 No Content ---
 
-	// Create a mock HTTP server that always responds with 200 OK.
+	// Create a mock HTTP server that always responds like generate_204. A 200
+	// is what a captive portal answers, which is not online.
 	serverOK := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
+		w.WriteHeader(http.StatusNoContent)
 	}))
 	// defer is used to ensure the server is closed after the test finishes.
 	defer serverOK.Close()
@@ -52,3 +71,146 @@ func TestCheckInternet(t *testing.T) {
 		t.Errorf("checkInternet() returned true for an unreachable server, expected false")
 	}
 }
+
+// TestEscalation verifies the recovery steps are taken one per failed check
+// once the threshold is reached, with the wait doubling between them.
+func TestEscalation(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Watchdog.CheckIntervalSeconds = 60
+	cfg.Watchdog.FailureThreshold = 2
+	cfg.Watchdog.BackoffMaxSeconds = 300
+	cfg.Watchdog.Escalation = []string{StepReprobe, StepReassociate, "bogus", StepRestartBackend, StepHotspot}
+	backend := network.NewFake()
+	backend.Connect(network.ClientConfig{SSID: "HomeWiFi", Password: "secret123"})
+	machine := state.New(filepath.Join(t.TempDir(), "state.json"))
+	machine.Transition(state.Connecting, "test")
+	machine.Transition(state.Client, "test")
+
+	w := newWatchdog(cfg, backend, machine, nil)
+	online := false
+	w.check = func(context.Context) probe.Report {
+		if online {
+			return probe.Report{Verdict: probe.VerdictOK}
+		}
+		return probe.Report{Verdict: probe.VerdictNoInternet}
+	}
+
+	if d := w.tick(context.Background()); d != time.Minute || machine.Current() != state.Degraded {
+		t.Fatalf("Expected a degraded check after one failure, got %s in %s", d, machine.Current())
+	}
+	if d := w.tick(context.Background()); d != 2*time.Minute || len(backend.Calls()) != 1 {
+		t.Fatalf("Expected the re-probe to back off without touching the network, got %s and %v", d, backend.Calls())
+	}
+	if d := w.tick(context.Background()); d != 4*time.Minute || backend.Calls()[1] != "Reassociate" {
+		t.Fatalf("Expected a reassociation, got %s and %v", d, backend.Calls())
+	}
+
+	// Connectivity comes back: the ladder starts over.
+	online = true
+	if d := w.tick(context.Background()); d != time.Minute || machine.Current() != state.Client || w.step != 0 {
+		t.Fatalf("Expected the ladder to reset, got %s in %s at step %d", d, machine.Current(), w.step)
+	}
+
+	online = false
+	for range 4 {
+		w.tick(context.Background())
+	}
+	if calls := backend.Calls(); calls[len(calls)-1] != "Restart" {
+		t.Fatalf("Expected a backend restart, got %v", calls)
+	}
+	if d := w.tick(context.Background()); d != 5*time.Minute {
+		t.Errorf("Expected the backoff to be capped, got %s", d)
+	}
+	if machine.Current() != state.Fallback {
+		t.Errorf("Expected fallback mode, got %s", machine.Current())
+	}
+	if st, _ := backend.Status(); st.Mode != network.ModeHotspot {
+		t.Errorf("Expected the hotspot to be started, got %s", st.Mode)
+	}
+}
+
+// TestEscalationCaptivePortal verifies the steps that cannot get past a
+// captive portal are skipped, and the diagnosis is kept as the reason.
+func TestEscalationCaptivePortal(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Watchdog.FailureThreshold = 1
+	cfg.Watchdog.Escalation = []string{StepReassociate, StepRestartBackend, StepHotspot}
+	backend := network.NewFake()
+	backend.Connect(network.ClientConfig{SSID: "Hotel"})
+	machine := state.New(filepath.Join(t.TempDir(), "state.json"))
+	machine.Transition(state.Connecting, "test")
+	machine.Transition(state.Client, "test")
+
+	w := newWatchdog(cfg, backend, machine, nil)
+	w.check = func(context.Context) probe.Report { return probe.Report{Verdict: probe.VerdictCaptivePortal} }
+	w.tick(context.Background())
+	if calls := backend.Calls(); calls[len(calls)-1] != "StartHotspot" {
+		t.Errorf("Expected straight to the hotspot, got %v", calls)
+	}
+	if _, reason := machine.Since(); machine.Current() != state.Fallback || reason != "connectivity lost: captive portal upstream" {
+		t.Errorf("Expected fallback for the captive portal, got %s (%s)", machine.Current(), reason)
+	}
+}
+
+// TestRetryFromHotspot verifies client mode is retried from the hotspot
+// only after the retry interval and while the portal is idle.
+func TestRetryFromHotspot(t *testing.T) {
+	tmpDir := t.TempDir()
+	originalSavedDir := bootmanager.SavedNetworksDir
+	bootmanager.SavedNetworksDir = tmpDir
+	defer func() { bootmanager.SavedNetworksDir = originalSavedDir }()
+	originalExec := scan.ExecCommand
+	scan.ExecCommand = func(name string, arg ...string) *exec.Cmd {
+		return exec.Command("printf", "%s", "BSS aa:bb:cc:00:00:01(on wlan0)\n\tsignal: -50.00 dBm\n\tSSID: HomeWiFi\n")
+	}
+	defer func() { scan.ExecCommand = originalExec }()
+	profiles.NewStore(tmpDir).Save(profiles.New("HomeWiFi", "secret123"))
+
+	online := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer online.Close()
+	cfg := &config.Config{}
+	cfg.Watchdog.CheckURL = online.URL
+	cfg.Watchdog.HotspotRetrySeconds = 600
+	backend := network.NewFake()
+	machine := state.New(filepath.Join(tmpDir, "state.json"))
+	machine.Transition(state.Connecting, "test")
+	machine.Transition(state.Fallback, "connectivity lost")
+
+	idle := time.Minute
+	w := newWatchdog(cfg, backend, machine, func() time.Duration { return idle })
+	now := time.Now()
+	w.now = func() time.Time { return now }
+
+	w.tick(context.Background())
+	if len(backend.Calls()) != 0 {
+		t.Fatalf("Expected no retry before the retry interval, got %v", backend.Calls())
+	}
+	now = now.Add(15 * time.Minute)
+	w.tick(context.Background())
+	if len(backend.Calls()) != 0 {
+		t.Fatalf("Expected no retry while the portal is in use, got %v", backend.Calls())
+	}
+	idle = time.Hour
+	w.tick(context.Background())
+	if machine.Current() != state.Client || backend.Config().SSID != "HomeWiFi" {
+		t.Errorf("Expected client mode on HomeWiFi, got %s (%v)", machine.Current(), backend.Calls())
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		n          int
+		limit, out time.Duration
+	}{
+		{0, time.Hour, time.Minute},
+		{3, time.Hour, 8 * time.Minute},
+		{10, 15 * time.Minute, 15 * time.Minute},
+		{2, 30 * time.Second, time.Minute},
+	} {
+		if got := backoff(time.Minute, tc.n, tc.limit); got != tc.out {
+			t.Errorf("backoff(1m, %d, %s) = %s, want %s", tc.n, tc.limit, got, tc.out)
+		}
+	}
+}
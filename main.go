@@ -1,20 +1,44 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"pifigo/internal/bootmanager"
 	"pifigo/internal/cli"
 	"pifigo/internal/config"
-	"pifigo/internal/watchdog"
+	"pifigo/internal/daemon"
+	"pifigo/internal/network"
+	"pifigo/internal/state"
 	"pifigo/server"
 )
 
 var version = "0.0.5"
 
+const configPath = "/etc/pifigo/config.yaml"
+
+// loadBackend reads the configuration and builds the network backend it selects.
+func loadBackend() (*config.Config, network.NetworkBackend, error) {
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load configuration from %s: %w", configPath, err)
+	}
+	backend, err := network.New(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	// wpa_supplicant keeps every saved network in its config file.
+	if wpa, ok := backend.(*network.WpaSupplicant); ok {
+		wpa.Saved = bootmanager.SavedNetworks
+	}
+	return cfg, backend, nil
+}
+
 func main() {
 	// --- Define and Parse Command-Line Flags ---
 	// (This section is unchanged)
@@ -26,49 +50,49 @@ func main() {
 	listSaved := flag.Bool("list-saved", false, "List all saved network profiles.")
 	setGood := flag.String("set-good", "", "Set the last-known-good network to the specified SSID.")
 	forgetNetwork := flag.String("forget", "", "Forget (delete) a saved network profile by SSID.")
+	setPriority := flag.String("set-priority", "", "Set the auto-connect priority of a saved network, as SSID=PRIORITY. Higher priorities are tried first.")
 	flag.Parse()
 
 	// --- Dispatch Logic for Flags ---
 	// (This section is unchanged)
 	if *showVersion { fmt.Printf("pifigo version %s\n", version); os.Exit(0) }
 	if *forceHotspot {
-		if err := bootmanager.ForceHotspotMode(); err != nil { log.Fatalf("Failed to force hotspot mode: %v", err) }
+		_, backend, err := loadBackend()
+		if err != nil { log.Fatalf("Failed to force hotspot mode: %v", err) }
+		if err := bootmanager.ForceHotspotMode(backend); err != nil { log.Fatalf("Failed to force hotspot mode: %v", err) }
+		if machine, err := state.Load(state.DefaultPath); err == nil { _ = machine.Force(state.Hotspot, "forced from the command line") }
 		log.Println("Successfully reverted to hotspot mode."); os.Exit(0)
 	}
-	if *showStatus { if err := cli.ShowStatus(); err != nil { log.Fatalf("Failed to get status: %v", err) }; os.Exit(0) }
+	if *showStatus {
+		cfg, backend, err := loadBackend()
+		if err != nil { log.Printf("WARNING: %v. Using the default connectivity check.", err); cfg = &config.Config{}; backend, _ = network.New(cfg) }
+		if err := cli.ShowStatus(cfg, backend); err != nil { log.Fatalf("Failed to get status: %v", err) }; os.Exit(0)
+	}
 	if *showLastGood { if err := cli.ShowLastGood(); err != nil { log.Fatalf("Failed to get last good network: %v", err) }; os.Exit(0) }
 	if *listSaved { if err := cli.ListSavedNetworks(); err != nil { log.Fatalf("Failed to list saved networks: %v", err) }; os.Exit(0) }
 	if *setGood != "" { if err := cli.SetLastGood(*setGood); err != nil { log.Fatalf("Failed to set last good network: %v", err) }; os.Exit(0) }
 	if *forgetNetwork != "" { if err := cli.ForgetNetwork(*forgetNetwork); err != nil { log.Fatalf("Failed to forget network: %v", err) }; os.Exit(0) }
+	if *setPriority != "" { if err := cli.SetPriority(*setPriority); err != nil { log.Fatalf("Failed to set priority: %v", err) }; os.Exit(0) }
+	// 'pifigo passwd' sets the admin password that protects the portal and API.
+	if flag.Arg(0) == "passwd" { if err := cli.SetAdminPassword(configPath); err != nil { log.Fatalf("Failed to set admin password: %v", err) }; os.Exit(0) }
 
 	// --- Default Action: Start the Server and Services ---
 	
 	if *verbose { log.Println("Verbose logging enabled.") }
 	log.Println("No admin flags provided. Starting pifigo services...")
 	
-	appConfig, err := config.LoadConfig("/etc/pifigo/config.yaml")
+	appConfig, backend, err := loadBackend()
 	if err != nil {
-		log.Fatalf("FATAL: Could not load configuration from /etc/pifigo/config.yaml: %v", err)
-	}
-
-	// --- NEW: Sync the hotspot configuration on every start ---
-	if err := bootmanager.SyncHotspotConfig(appConfig); err != nil {
-		log.Printf("WARNING: Could not sync hotspot configuration: %v", err)
-		// This is not a fatal error; the service can continue with the old config.
+		log.Fatalf("FATAL: %v", err)
 	}
+	log.Printf("Using the %s network backend.", backend.Name())
+	server.Version = version
 
-	// Start the boot manager in a background goroutine.
-	stopSignal := make(chan bool, 1)
-	go bootmanager.Start(appConfig, stopSignal)
-
-	// Start the watchdog if it's enabled in the config.
-	if appConfig.Watchdog.Enabled {
-		go watchdog.Start(appConfig)
-	} else {
-		log.Println("Watchdog is disabled in the configuration.")
+	// Run until SIGINT or SIGTERM, then shut the services down cleanly.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := daemon.Run(ctx, appConfig, backend); err != nil {
+		log.Fatalf("FATAL: %v", err)
 	}
-
-	// Create and start the web server in the main thread.
-	srv := server.NewServer(appConfig, stopSignal)
-	srv.Start()
+	log.Println("pifigo services stopped.")
 }
@@ -1,4 +1,7 @@
 # This template is used by the pifigo application to generate the client config.
+# "quote" writes a value as a double-quoted YAML string.
+# A plain password selects WPA2-PSK, which NetworkManager also uses to join
+# WPA2/WPA3 transition mode networks.
 network:
   version: 2
   renderer: NetworkManager
@@ -13,12 +16,47 @@ network:
       routes:
         - to: default
           via: {{.Gateway}}
+      {{- if .DNSServers }}
       nameservers:
         addresses:
         {{- range .DNSServers }}
           - {{.}}
         {{- end }}
+      {{- end }}
     {{- end }}
       access-points:
-        "{{.SSID}}":
-          password: "{{.Password}}"
+        {{ quote .SSID }}:{{ if and (eq .Security "open") (not .Hidden) }} {}{{ end }}
+        {{- if .Hidden }}
+          hidden: true
+        {{- end }}
+        {{- if eq .Security "eap" }}
+          auth:
+            key-management: eap
+            method: {{ .EAP.Method }}
+            identity: {{ quote .EAP.Identity }}
+          {{- if .EAP.AnonymousIdentity }}
+            anonymous-identity: {{ quote .EAP.AnonymousIdentity }}
+          {{- end }}
+          {{- if .EAP.Password }}
+            password: {{ quote .EAP.Password }}
+          {{- end }}
+          {{- if .Phase2 }}
+            phase2-auth: {{ .Phase2 }}
+          {{- end }}
+          {{- if .EAP.CACert }}
+            ca-certificate: {{ quote .EAP.CACert }}
+          {{- end }}
+          {{- if .EAP.ClientCert }}
+            client-certificate: {{ quote .EAP.ClientCert }}
+            client-key: {{ quote .EAP.ClientKey }}
+          {{- end }}
+          {{- if .EAP.ClientKeyPassword }}
+            client-key-password: {{ quote .EAP.ClientKeyPassword }}
+          {{- end }}
+        {{- else if eq .Security "wpa3-sae" }}
+          auth:
+            key-management: sae
+            password: {{ quote .Password }}
+        {{- else if .Password }}
+          password: {{ quote .Password }}
+        {{- end }}
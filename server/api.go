@@ -0,0 +1,329 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"pifigo/internal/network"
+	"pifigo/internal/profiles"
+	"pifigo/internal/scan"
+	"pifigo/internal/state"
+)
+
+// apiError is the body of every JSON error response.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// writeJSON encodes v as the JSON response body with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("ERROR: Failed to encode JSON response: %v", err)
+	}
+}
+
+// writeJSONError writes a JSON error body with the given status code.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, apiError{Error: message})
+}
+
+// scanResult is the body of a scan response.
+type scanResult struct {
+	Networks []scan.Network `json:"networks"`
+}
+
+// handleAPIScan returns the visible networks as JSON, strongest first.
+func (s *Server) handleAPIScan(w http.ResponseWriter, r *http.Request) {
+	networks, err := s.scanResults(r)
+	if err != nil {
+		log.Printf("ERROR: Failed to scan for Wi-Fi networks: %v", err)
+		writeJSONError(w, http.StatusServiceUnavailable, "could not scan for networks")
+		return
+	}
+	if networks == nil {
+		networks = []scan.Network{}
+	}
+	writeJSON(w, http.StatusOK, scanResult{networks})
+}
+
+// maxJSONBodySize bounds JSON request bodies, including certificates.
+const maxJSONBodySize = 1 << 20
+
+// decodeJSON decodes the request body into v. Unknown fields are refused, so
+// a misspelt field is not silently ignored.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return newServiceError(http.StatusBadRequest, "Invalid JSON body: %v", err)
+	}
+	return nil
+}
+
+// writeJSONServiceError writes an error from the service layer as JSON.
+func writeJSONServiceError(w http.ResponseWriter, err error) {
+	status, msg := errorStatus(err)
+	writeJSONError(w, status, msg)
+}
+
+// savedNetwork is the JSON view of a saved profile. Credentials are never
+// included.
+type savedNetwork struct {
+	ID          string      `json:"id"`
+	SSID        string      `json:"ssid"`
+	Security    string      `json:"security"`
+	Hidden      bool        `json:"hidden"`
+	Priority    int         `json:"priority"`
+	Autoconnect bool        `json:"autoconnect"`
+	IP          *ipSettings `json:"ip,omitempty"` // Nil when the network uses the config.yaml default.
+	LastUsed    time.Time   `json:"last_used,omitzero"`
+}
+
+func newSavedNetwork(p profiles.Profile) savedNetwork {
+	v := savedNetwork{ID: p.ID, SSID: p.SSID, Security: p.Security, Hidden: p.Hidden, Priority: p.Priority, Autoconnect: p.Autoconnect, LastUsed: p.LastUsed}
+	if p.IPMode != "" {
+		ip := ipSettings(p.IP())
+		v.IP = &ip
+	}
+	return v
+}
+
+// networkList is the body of the saved network list.
+type networkList struct {
+	Networks []savedNetwork `json:"networks"`
+}
+
+// handleAPINetworks returns the saved networks as JSON.
+func (s *Server) handleAPINetworks(w http.ResponseWriter, r *http.Request) {
+	saved, err := s.savedNetworks()
+	if err != nil {
+		writeJSONServiceError(w, err)
+		return
+	}
+	networks := make([]savedNetwork, 0, len(saved))
+	for _, p := range saved {
+		networks = append(networks, newSavedNetwork(p))
+	}
+	writeJSON(w, http.StatusOK, networkList{networks})
+}
+
+// handleAPIGetNetwork returns one saved network as JSON.
+func (s *Server) handleAPIGetNetwork(w http.ResponseWriter, r *http.Request) {
+	p, err := s.savedNetwork(r.PathValue("id"))
+	if err != nil {
+		writeJSONServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSavedNetwork(p))
+}
+
+// handleAPICreateNetwork saves a network from a networkRequest body without
+// connecting to it.
+func (s *Server) handleAPICreateNetwork(w http.ResponseWriter, r *http.Request) {
+	var req networkRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeJSONServiceError(w, err)
+		return
+	}
+	p, err := s.createNetwork(req)
+	if err != nil {
+		writeJSONServiceError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/api/v1/networks/"+p.ID)
+	writeJSON(w, http.StatusCreated, newSavedNetwork(p))
+}
+
+// handleAPIUpdateNetwork changes the fields of a saved network given in a
+// networkUpdate body.
+func (s *Server) handleAPIUpdateNetwork(w http.ResponseWriter, r *http.Request) {
+	var update networkUpdate
+	if err := decodeJSON(w, r, &update); err != nil {
+		writeJSONServiceError(w, err)
+		return
+	}
+	p, err := s.updateNetwork(r.PathValue("id"), update)
+	if err != nil {
+		writeJSONServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSavedNetwork(p))
+}
+
+// handleAPIDeleteNetwork forgets a saved network.
+func (s *Server) handleAPIDeleteNetwork(w http.ResponseWriter, r *http.Request) {
+	if err := s.deleteNetwork(r.PathValue("id")); err != nil {
+		writeJSONServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// priorityRequest is the body that sets a network's priority.
+type priorityRequest struct {
+	Priority *int `json:"priority"`
+}
+
+// handleAPISetPriority sets the auto-connect priority of a saved network
+// from a {"priority": N} body.
+func (s *Server) handleAPISetPriority(w http.ResponseWriter, r *http.Request) {
+	var body priorityRequest
+	if err := decodeJSON(w, r, &body); err != nil {
+		writeJSONServiceError(w, err)
+		return
+	}
+	if body.Priority == nil {
+		writeJSONError(w, http.StatusBadRequest, `expected a body of the form {"priority": N}`)
+		return
+	}
+	p, err := s.updateNetwork(r.PathValue("id"), networkUpdate{Priority: body.Priority})
+	if err != nil {
+		writeJSONServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSavedNetwork(p))
+}
+
+// handleAPIConnect starts connecting to the network in a networkRequest
+// body. The attempt runs in the background; its outcome shows in the status.
+func (s *Server) handleAPIConnect(w http.ResponseWriter, r *http.Request) {
+	var req networkRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeJSONServiceError(w, err)
+		return
+	}
+	p, err := s.connect(req)
+	if err != nil {
+		writeJSONServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, newSavedNetwork(p))
+}
+
+// handleAPIReconnect starts connecting to a saved network.
+func (s *Server) handleAPIReconnect(w http.ResponseWriter, r *http.Request) {
+	p, err := s.reconnect(r.PathValue("id"))
+	if err != nil {
+		writeJSONServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, newSavedNetwork(p))
+}
+
+// statusView is the connection state together with what the backend reports
+// about the interface.
+type statusView struct {
+	State       state.State    `json:"state"`
+	Since       time.Time      `json:"since"`
+	Reason      string         `json:"reason,omitempty"`
+	Backend     string         `json:"backend"`
+	Interface   string         `json:"interface"`
+	Mode        network.Mode   `json:"mode,omitempty"`
+	SSID        string         `json:"ssid,omitempty"`
+	IPAddress   string         `json:"ip_address,omitempty"`
+	LastGood    string         `json:"last_good,omitempty"`
+	LastFailure *state.Failure `json:"last_failure,omitempty"`
+}
+
+// handleAPIStatus returns the connection state as JSON.
+func (s *Server) handleAPIStatus(w http.ResponseWriter, r *http.Request) {
+	since, reason := s.State.Since()
+	v := statusView{
+		State:       s.State.Current(),
+		Since:       since,
+		Reason:      reason,
+		Backend:     s.Backend.Name(),
+		Interface:   s.AppConfig.Network.WirelessInterface,
+		LastGood:    s.State.LastGood(),
+		LastFailure: s.State.LastFailure(),
+	}
+	if st, err := s.Backend.Status(); err != nil {
+		log.Printf("WARNING: Could not read the interface status: %v", err)
+	} else {
+		v.Mode, v.SSID, v.IPAddress = st.Mode, st.SSID, st.IPAddress
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// configView is the part of config.yaml the API exposes. Passwords and file
+// system paths are left out.
+type configView struct {
+	Language            string `json:"language"`
+	DeviceHostname      string `json:"device_hostname"`
+	Backend             string `json:"backend"`
+	WirelessInterface   string `json:"wireless_interface"`
+	HotspotSSID         string `json:"hotspot_ssid"`
+	HotspotIPAddress    string `json:"hotspot_ip_address"`
+	WifiCountry         string `json:"wifi_country"`
+	ConnectionMode      string `json:"connection_mode"`
+	ValidateCredentials bool   `json:"validate_credentials"`
+	WatchdogEnabled     bool   `json:"watchdog_enabled"`
+	BootTimeoutSeconds  int    `json:"boot_timeout_seconds"`
+}
+
+// handleAPIConfig returns the non-secret configuration as JSON.
+func (s *Server) handleAPIConfig(w http.ResponseWriter, r *http.Request) {
+	cfg := s.AppConfig
+	writeJSON(w, http.StatusOK, configView{
+		Language:            cfg.Language,
+		DeviceHostname:      cfg.Network.DeviceHostname,
+		Backend:             s.Backend.Name(),
+		WirelessInterface:   cfg.Network.WirelessInterface,
+		HotspotSSID:         cfg.Network.ApSSID,
+		HotspotIPAddress:    cfg.Network.ApIpAddress,
+		WifiCountry:         cfg.Network.WifiCountry,
+		ConnectionMode:      cfg.Network.ConnectionMode,
+		ValidateCredentials: cfg.Network.ValidateCredentials,
+		WatchdogEnabled:     cfg.Watchdog.Enabled,
+		BootTimeoutSeconds:  cfg.BootManager.TimeoutSeconds,
+	})
+}
+
+// handleAPIFullConfig returns the whole configuration to a logged-in admin,
+// without the fields tagged json:"-". Without an admin password nobody logs
+// in, so it is refused rather than served to everyone on the hotspot.
+func (s *Server) handleAPIFullConfig(w http.ResponseWriter, r *http.Request) {
+	if !s.authEnabled() {
+		writeJSONError(w, http.StatusForbidden, "Set an admin password with 'pifigo passwd' to read the full configuration.")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.AppConfig)
+}
+
+// versionInfo is the body of the version response.
+type versionInfo struct {
+	Version string `json:"version"`
+	API     string `json:"api"`
+}
+
+// handleAPIVersion returns the pifigo version and the API version.
+func (s *Server) handleAPIVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, versionInfo{Version, "v1"})
+}
+
+// handleAPINotFound answers requests for unknown API paths with a JSON error
+// rather than the portal's file server.
+func (s *Server) handleAPINotFound(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, http.StatusNotFound, "no such API endpoint: "+r.Method+" "+r.URL.Path)
+}
+
+// apiMethodNotAllowed answers requests for a known API path with a method it
+// does not support, listing the ones it does in the Allow header.
+func apiMethodNotAllowed(methods []string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method "+r.Method+" is not allowed on "+r.URL.Path)
+	}
+}
+
+// handleAPIHealth returns the connection state and, in client mode, a
+// layered diagnosis of the connection.
+func (s *Server) handleAPIHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.health(r.Context()))
+}
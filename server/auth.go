@@ -0,0 +1,301 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"pifigo/internal/locale"
+)
+
+const (
+	// sessionCookie holds the session token of a logged-in browser.
+	sessionCookie = "pifigo_session"
+	// csrfHeader carries the CSRF token on requests made with the cookie.
+	csrfHeader = "X-CSRF-Token"
+	// defaultSessionLifetime is used when admin.session_minutes is not set.
+	defaultSessionLifetime = time.Hour
+	// maxLoginFailures wrong passwords in a row lock logins for loginLockout.
+	maxLoginFailures = 5
+	loginLockout     = time.Minute
+)
+
+// session is a logged-in admin: a browser holding the session cookie, or an
+// API client holding the same token as a bearer token.
+type session struct {
+	csrf    string
+	expires time.Time
+}
+
+// sessionStore keeps the sessions in memory, so they end when pifigo
+// restarts. The zero value is ready to use.
+type sessionStore struct {
+	mu          sync.Mutex
+	sessions    map[string]session
+	failures    int
+	lockedUntil time.Time
+}
+
+// authEnabled reports whether an admin password is set. Without one the
+// portal and the API are open, as they always were.
+func (s *Server) authEnabled() bool {
+	return s.AppConfig.Admin.PasswordHash != ""
+}
+
+// sessionLifetime returns how long a login lasts.
+func (s *Server) sessionLifetime() time.Duration {
+	if m := s.AppConfig.Admin.SessionMinutes; m > 0 {
+		return time.Duration(m) * time.Minute
+	}
+	return defaultSessionLifetime
+}
+
+// login checks the admin password and starts a session. After
+// maxLoginFailures wrong passwords in a row, logins are refused for
+// loginLockout to slow down guessing.
+func (s *Server) login(password string) (string, session, error) {
+	if !s.authEnabled() {
+		return "", session{}, newServiceError(http.StatusBadRequest, "No admin password is set.")
+	}
+	a := &s.auth
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if time.Now().Before(a.lockedUntil) {
+		return "", session{}, newServiceError(http.StatusTooManyRequests, "Too many wrong passwords. Please wait a minute and try again.")
+	}
+	if bcrypt.CompareHashAndPassword([]byte(s.AppConfig.Admin.PasswordHash), []byte(password)) != nil {
+		if a.failures++; a.failures >= maxLoginFailures {
+			log.Printf("WARNING: %d wrong admin passwords in a row. Locking logins for %s.", a.failures, loginLockout)
+			a.failures, a.lockedUntil = 0, time.Now().Add(loginLockout)
+		}
+		return "", session{}, newServiceError(http.StatusUnauthorized, "Wrong password.")
+	}
+	a.failures = 0
+	token, sess := newToken(), session{csrf: newToken(), expires: time.Now().Add(s.sessionLifetime())}
+	if a.sessions == nil {
+		a.sessions = make(map[string]session)
+	}
+	a.sessions[token] = sess
+	return token, sess, nil
+}
+
+// logout ends the session.
+func (s *Server) logout(token string) {
+	s.auth.mu.Lock()
+	defer s.auth.mu.Unlock()
+	delete(s.auth.sessions, token)
+}
+
+// session returns the request's session, from the bearer token or the
+// session cookie. bearer reports which one was used.
+func (s *Server) session(r *http.Request) (token string, sess session, bearer, ok bool) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token, bearer = strings.TrimPrefix(auth, "Bearer "), true
+	} else if c, err := r.Cookie(sessionCookie); err == nil {
+		token = c.Value
+	}
+	if token == "" {
+		return "", session{}, bearer, false
+	}
+	s.auth.mu.Lock()
+	defer s.auth.mu.Unlock()
+	now := time.Now()
+	for t, sess := range s.auth.sessions {
+		if now.After(sess.expires) {
+			delete(s.auth.sessions, t)
+		}
+	}
+	sess, ok = s.auth.sessions[token]
+	return token, sess, bearer, ok
+}
+
+// newToken returns a random token for a session or CSRF check.
+func newToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// requireAuth lets requests through only with a valid session once an admin
+// password is set; public paths are always let through. Requests made with
+// the session cookie that change something must also carry the session's
+// CSRF token in the X-CSRF-Token header. Bearer tokens are not sent by
+// browsers on their own, so they need no CSRF token.
+func (s *Server) requireAuth(next http.Handler, public map[string]bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authEnabled() || public[r.Method+" "+r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		_, sess, bearer, ok := s.session(r)
+		api := strings.HasPrefix(r.URL.Path, "/api/v1/")
+		switch {
+		case !ok && api:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pifigo"`)
+			writeJSONError(w, http.StatusUnauthorized, "Log in with POST /api/v1/login and send the token as a bearer token.")
+		case !ok && r.Header.Get("HX-Request") != "":
+			// HTMX follows HX-Redirect even on an error status.
+			w.Header().Set("HX-Redirect", "/login")
+			http.Error(w, "Please log in.", http.StatusUnauthorized)
+		case !ok && r.Method == http.MethodGet:
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+		case !ok:
+			http.Error(w, "Please log in.", http.StatusUnauthorized)
+		case !bearer && !safeMethod(r.Method) && subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(sess.csrf)) != 1:
+			if api {
+				writeJSONError(w, http.StatusForbidden, "Missing or wrong CSRF token.")
+			} else {
+				http.Error(w, "Missing or wrong CSRF token. Please reload the page.", http.StatusForbidden)
+			}
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// safeMethod reports whether requests with the method only read.
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// loginTemplate renders the login page.
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{.Title}}</title>
+    <link rel="stylesheet" href="/static/pifigo.css">
+</head>
+<body class="bg-stone-100 text-stone-800 min-h-screen flex items-center justify-center p-4">
+    <form method="post" action="/login" class="bg-white p-6 rounded-lg shadow-md w-full max-w-sm space-y-4">
+        <h1 class="text-xl font-bold">{{.Heading}}</h1>
+        {{if .Error}}<p class="text-red-600 font-semibold">{{.Error}}</p>{{end}}
+        <label for="password-input" class="block font-semibold">{{.PasswordLabel}}</label>
+        <input id="password-input" type="password" name="password" autofocus required
+            class="w-full p-3 border border-stone-300 rounded-lg focus:ring-2 focus:ring-blue-500 transition">
+        <button type="submit"
+            class="w-full bg-blue-600 text-white font-bold py-3 px-4 rounded-lg hover:bg-blue-700 transition-colors">{{.Button}}</button>
+    </form>
+</body>
+</html>
+`))
+
+// loginPage is the data of the login page.
+type loginPage struct {
+	Lang, Title, Heading, PasswordLabel, Button, Error string
+}
+
+// newLoginPage returns the login page in the configured language, with
+// English for any string the language file lacks.
+func (s *Server) newLoginPage() loginPage {
+	page := loginPage{Lang: s.AppConfig.Language, Title: s.AppConfig.UI.PageTitle, Heading: "Administrator Login", PasswordLabel: "Admin password:", Button: "Log In"}
+	langFilePath := filepath.Join(s.AppConfig.Paths.LocalesDir, s.AppConfig.Language+".yaml")
+	if lang, err := locale.LoadLanguageStrings(langFilePath); err == nil {
+		for _, v := range []struct {
+			dst *string
+			src string
+		}{
+			{&page.Title, lang.PageTitle},
+			{&page.Heading, lang.LoginHeading},
+			{&page.PasswordLabel, lang.AdminPasswordLabel},
+			{&page.Button, lang.LoginButtonText},
+		} {
+			if v.src != "" {
+				*v.dst = v.src
+			}
+		}
+	}
+	return page
+}
+
+// handleLoginPage shows the login form.
+func (s *Server) handleLoginPage(w http.ResponseWriter, r *http.Request) {
+	if !s.authEnabled() {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	s.renderLogin(w, http.StatusOK, "")
+}
+
+// handleLogin checks the password from the login form and sets the session
+// cookie.
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	token, sess, err := s.login(r.FormValue("password"))
+	if err != nil {
+		status, msg := errorStatus(err)
+		s.renderLogin(w, status, msg)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: token, Path: "/", Expires: sess.expires, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	log.Printf("Admin logged in from %s.", r.RemoteAddr)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (s *Server) renderLogin(w http.ResponseWriter, status int, msg string) {
+	page := s.newLoginPage()
+	page.Error = msg
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	if err := loginTemplate.Execute(w, page); err != nil {
+		log.Printf("ERROR: Failed to render the login page: %v", err)
+	}
+}
+
+// handleLogout ends the browser's session and returns to the login page.
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if token, _, _, ok := s.session(r); ok {
+		s.logout(token)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	if r.Header.Get("HX-Request") != "" {
+		w.Header().Set("HX-Redirect", "/login")
+		return
+	}
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// loginRequest is the body of an API login.
+type loginRequest struct {
+	Password string `json:"password"`
+}
+
+// loginResponse carries the bearer token of a new API session.
+type loginResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// handleAPILogin exchanges the admin password for a bearer token.
+func (s *Server) handleAPILogin(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeJSONServiceError(w, err)
+		return
+	}
+	token, sess, err := s.login(req.Password)
+	if err != nil {
+		writeJSONServiceError(w, err)
+		return
+	}
+	log.Printf("API client logged in from %s.", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, loginResponse{Token: token, ExpiresAt: sess.expires})
+}
+
+// handleAPILogout revokes the token the request was made with.
+func (s *Server) handleAPILogout(w http.ResponseWriter, r *http.Request) {
+	if token, _, _, ok := s.session(r); ok {
+		s.logout(token)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// setupAuthServer returns a test server protected by the admin password
+// "correct horse".
+func setupAuthServer(t *testing.T) *Server {
+	server := setupTestServer(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash the password: %v", err)
+	}
+	server.AppConfig.Admin.PasswordHash = string(hash)
+	return server
+}
+
+// authRequest sends a request through the server's handler with the given
+// headers and cookies.
+func authRequest(server *Server, method, path, body string, header map[string]string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rr := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAuthDisabledByDefault(t *testing.T) {
+	server := setupTestServer(t)
+	if rr := apiRequest(server, "GET", "/api/v1/status", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected the API to be open without an admin password, got %d", rr.Code)
+	}
+	if rr := apiRequest(server, "GET", "/login", ""); rr.Code != http.StatusSeeOther {
+		t.Errorf("Expected the login page to redirect home, got %d", rr.Code)
+	}
+}
+
+func TestAuthRequiresLogin(t *testing.T) {
+	server := setupAuthServer(t)
+
+	rr := apiRequest(server, "GET", "/api/v1/status", "")
+	if rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") == "" || !strings.Contains(rr.Body.String(), `"error"`) {
+		t.Errorf("Expected a JSON 401 from the API, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := apiRequest(server, "GET", "/", ""); rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/login" {
+		t.Errorf("Expected the portal to redirect to the login page, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	rr = authRequest(server, "GET", "/api/ssids", "", map[string]string{"HX-Request": "true"})
+	if rr.Code != http.StatusUnauthorized || rr.Header().Get("HX-Redirect") != "/login" {
+		t.Errorf("Expected HTMX to be sent to the login page, got %d %q", rr.Code, rr.Header().Get("HX-Redirect"))
+	}
+	if rr := apiRequest(server, "GET", "/login", ""); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `name="password"`) {
+		t.Errorf("Expected the login page, got %d", rr.Code)
+	}
+	if rr := apiRequest(server, "GET", "/api/v1/openapi.json", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected the OpenAPI document to be public, got %d", rr.Code)
+	}
+}
+
+func TestAuthPortalLogin(t *testing.T) {
+	server := setupAuthServer(t)
+	form := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+
+	rr := authRequest(server, "POST", "/login", "password=wrong", form)
+	if rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), "Wrong password.") || len(rr.Result().Cookies()) != 0 {
+		t.Errorf("Expected a wrong password to be refused, got %d", rr.Code)
+	}
+	rr = authRequest(server, "POST", "/login", "password=correct+horse", form)
+	cookies := rr.Result().Cookies()
+	if rr.Code != http.StatusSeeOther || len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatalf("Expected a session cookie, got %d %v", rr.Code, cookies)
+	}
+	cookie := cookies[0]
+
+	// The page data carries the CSRF token that changing requests must send.
+	rr = authRequest(server, "GET", "/api/data", "", nil, cookie)
+	var data PageData
+	if err := json.Unmarshal(rr.Body.Bytes(), &data); err != nil || data.CSRFToken == "" {
+		t.Fatalf("Expected a CSRF token in the page data, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := authRequest(server, "GET", "/api/v1/status", "", nil, cookie); rr.Code != http.StatusOK {
+		t.Errorf("Expected the session to be accepted, got %d", rr.Code)
+	}
+	if rr := authRequest(server, "POST", "/api/v1/logout", "", nil, cookie); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected a request without the CSRF token to be refused, got %d", rr.Code)
+	}
+	if rr := authRequest(server, "POST", "/api/v1/logout", "", map[string]string{csrfHeader: "wrong"}, cookie); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected a wrong CSRF token to be refused, got %d", rr.Code)
+	}
+
+	rr = authRequest(server, "POST", "/logout", "", map[string]string{csrfHeader: data.CSRFToken, "HX-Request": "true"}, cookie)
+	if rr.Header().Get("HX-Redirect") != "/login" {
+		t.Errorf("Expected logout to return to the login page, got %d", rr.Code)
+	}
+	if rr := authRequest(server, "GET", "/api/v1/status", "", nil, cookie); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the session to end on logout, got %d", rr.Code)
+	}
+}
+
+func TestAuthAPILogin(t *testing.T) {
+	server := setupAuthServer(t)
+
+	rr := apiRequest(server, "POST", "/api/v1/login", `{"password": "correct horse"}`)
+	var login loginResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &login); rr.Code != http.StatusOK || err != nil || login.Token == "" {
+		t.Fatalf("Unexpected login response: %d %s", rr.Code, rr.Body.String())
+	}
+	bearer := map[string]string{"Authorization": "Bearer " + login.Token}
+
+	// Bearer tokens are not sent by browsers on their own, so no CSRF token is needed.
+	rr = authRequest(server, "POST", "/api/v1/networks", `{"ssid": ""}`, bearer)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected the bearer token to be accepted, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	// The full configuration is served to an admin, still without secrets.
+	server.AppConfig.Network.ApPassword = "hotspot-secret"
+	if rr := apiRequest(server, "GET", "/api/v1/config/full", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the full configuration to need a login, got %d", rr.Code)
+	}
+	rr = authRequest(server, "GET", "/api/v1/config/full", "", bearer)
+	body := rr.Body.String()
+	if rr.Code != http.StatusOK || !strings.Contains(body, `"WirelessInterface":"wlan_test"`) || strings.Contains(body, "hotspot-secret") || strings.Contains(body, server.AppConfig.Admin.PasswordHash) {
+		t.Errorf("Unexpected full configuration: %d %s", rr.Code, body)
+	}
+	var full any
+	json.Unmarshal(rr.Body.Bytes(), &full)
+	spec := loadSpec(t, server)
+	schema := operation(spec, "GET", "/api/v1/config/full")["responses"].(map[string]any)["200"].(map[string]any)["content"].(map[string]any)["application/json"].(map[string]any)["schema"].(map[string]any)
+	for _, p := range validate(spec, schema, full, "full config") {
+		t.Error(p)
+	}
+
+	if rr := authRequest(server, "POST", "/api/v1/logout", "", bearer); rr.Code != http.StatusNoContent {
+		t.Errorf("Unexpected logout status: %d", rr.Code)
+	}
+	if rr := authRequest(server, "GET", "/api/v1/status", "", bearer); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the token to be revoked, got %d", rr.Code)
+	}
+
+	// Repeated wrong passwords lock logins for a while.
+	for i := 0; i < maxLoginFailures; i++ {
+		if rr := apiRequest(server, "POST", "/api/v1/login", `{"password": "wrong"}`); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected a wrong password to be refused, got %d", rr.Code)
+		}
+	}
+	if rr := apiRequest(server, "POST", "/api/v1/login", `{"password": "correct horse"}`); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected logins to be locked, got %d", rr.Code)
+	}
+}
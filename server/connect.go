@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"pifigo/internal/network"
+	"pifigo/internal/probe"
+	"pifigo/internal/profiles"
+	"pifigo/internal/state"
+)
+
+// checkCredentials runs the credential check, if enabled, and returns a
+// message for the user when the network refused the credentials. Checks that
+// cannot run on this hardware are logged and skipped.
+func (s *Server) checkCredentials(c network.ClientConfig) string {
+	if s.Validator == nil {
+		return ""
+	}
+	err := s.Validator.Validate(c)
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, network.ErrWrongPassword):
+		return fmt.Sprintf("Wrong password for %s. Please check it and try again.", c.SSID)
+	case errors.Is(err, network.ErrEAPFailure):
+		return fmt.Sprintf("%s did not accept the identity or password. Please check them and try again.", c.SSID)
+	case errors.Is(err, network.ErrServerCertificate):
+		return fmt.Sprintf("The server certificate of %s did not match the CA certificate.", c.SSID)
+	case errors.Is(err, network.ErrNetworkNotFound):
+		return fmt.Sprintf("Network %s was not found. Check the name and that the device is in range.", c.SSID)
+	case errors.Is(err, network.ErrAssociationRejected):
+		return fmt.Sprintf("%s refused the connection. It may be full or restrict which devices can join.", c.SSID)
+	case errors.Is(err, network.ErrValidationTimeout):
+		return fmt.Sprintf("Could not verify the password for %s in time. Please try again.", c.SSID)
+	}
+	log.Printf("WARNING: Skipping credential check for %s: %v", c.SSID, err)
+	return ""
+}
+
+// startConnect tries the profile in the background. The profile is saved
+// and made the last-good network only once the connection is verified;
+// otherwise the previous configuration is restored and the failure recorded.
+// release is called once the attempt is over, and undo, if set, when it
+// fails.
+func (s *Server) startConnect(profile profiles.Profile, release, undo func()) {
+	previous := s.previousNetwork()
+	opts := probe.TryOptions(s.AppConfig)
+	opts.Undo = undo
+	ssid := profile.SSID
+	s.pending.Add(1)
+	go func() {
+		defer s.pending.Done()
+		defer release()
+		if err := s.State.Transition(state.Connecting, "connecting to "+ssid); err != nil {
+			log.Printf("ERROR: Could not connect to %s: %v", ssid, err)
+			if undo != nil {
+				undo()
+			}
+			return
+		}
+		_ = s.State.RecordAttempt(profile.ID)
+		if err := network.TryConnect(s.Backend, profile.ClientConfig(), previous, opts); err != nil {
+			log.Printf("ERROR: Could not connect to %s: %v", ssid, err)
+			s.recordFailure(profile, err)
+			s.settleAfterFailure(ssid)
+			return
+		}
+		log.Printf("Connected to %s.", ssid)
+		profile.LastUsed = time.Now()
+		if err := s.profiles().Save(profile); err != nil {
+			log.Printf("ERROR: Failed to save network profile: %v", err)
+		}
+		_ = s.State.RecordSuccess(profile.ID)
+		_ = s.State.Transition(state.Client, "connected to "+ssid)
+	}()
+}
+
+// settleAfterFailure leaves the Connecting state for whatever the rollback
+// achieved: the previous client network or the hotspot.
+func (s *Server) settleAfterFailure(ssid string) {
+	if st, err := s.Backend.Status(); err == nil && st.Mode == network.ModeClient {
+		_ = s.State.Transition(state.Client, "restored previous network after failing to connect to "+ssid)
+		return
+	}
+	_ = s.State.Transition(state.Hotspot, "failed to connect to "+ssid)
+}
+
+// previousNetwork returns the network to fall back to if a connection attempt
+// fails: the last-good profile while in client mode, otherwise nil, which
+// means the hotspot.
+func (s *Server) previousNetwork() *network.ClientConfig {
+	if !s.State.Current().IsClient() {
+		return nil
+	}
+	lastGood := s.State.LastGood()
+	if lastGood == "" {
+		return nil
+	}
+	profile, err := s.profiles().Get(lastGood)
+	if err != nil {
+		return nil
+	}
+	c := profile.ClientConfig()
+	return &c
+}
+
+// recordFailure records why a connection attempt failed, so the portal can
+// show it once the hotspot is back.
+func (s *Server) recordFailure(profile profiles.Profile, err error) {
+	failure := state.Failure{SSID: profile.SSID, Stage: network.FailureStage(err), Reason: err.Error(), Time: time.Now()}
+	_ = s.State.RecordFailure(profile.ID, failure)
+}
@@ -1,39 +1,70 @@
 package server
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"net/http"
-	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"unicode"
 
-	"pifigo/internal/config"
 	"pifigo/internal/locale"
+	"pifigo/internal/network"
+	"pifigo/internal/profiles"
+	"pifigo/internal/scan"
+	"pifigo/internal/state"
 )
 
-// execCommand is a package-level variable that holds the function for executing commands.
-// This allows us to replace it with a mock during testing.
-var execCommand = exec.Command
+var savedNetworksDir = "/etc/pifigo/saved_networks"
 
-var (
-	savedNetworksDir   = "/etc/pifigo/saved_networks"
-	lastGoodSymlink    = "/etc/pifigo/last-good-wifi.yaml"
-	activeClientConfig = "/etc/netplan/99-pifigo-client.yaml"
-	netplanTemplate    = "/etc/pifigo/netplan.tpl"
-)
+// profiles returns the store holding the saved networks.
+func (s *Server) profiles() *profiles.Store {
+	return profiles.NewStore(savedNetworksDir)
+}
 
 // PageData is a composite struct that holds all data needed for API responses.
 type PageData struct {
-	Config  *config.Config
-	Strings *locale.LanguageStrings
+	Config      PublicConfig
+	Strings     *locale.LanguageStrings
+	LastFailure *state.Failure
+	CSRFToken   string `json:",omitempty"` // Set for a logged-in admin; sent back in the X-CSRF-Token header.
+}
+
+// PublicConfig is the part of the configuration the portal page shows. It is
+// served to anyone on the hotspot, so it must never hold secrets or anything
+// else an admin has not chosen to show.
+type PublicConfig struct {
+	Hostname  string   // The name the device has once online; the page shows it as the device ID.
+	PageTitle string
+	Heading   string
+	ImageURL  string
+	Language  string
+	Languages []string // Languages with a file in the locales directory.
 }
 
-// serveDataAPI loads the full configuration and language strings and serves them as JSON.
+// publicConfig returns the configuration the portal page may show.
+func (s *Server) publicConfig() PublicConfig {
+	cfg := s.AppConfig
+	pub := PublicConfig{
+		Hostname:  cfg.Network.DeviceHostname,
+		PageTitle: cfg.UI.PageTitle,
+		Heading:   cfg.UI.HeadingText,
+		ImageURL:  cfg.UI.CustomImageURL,
+		Language:  cfg.Language,
+		Languages: []string{},
+	}
+	files, _ := filepath.Glob(filepath.Join(cfg.Paths.LocalesDir, "*.yaml"))
+	for _, f := range files {
+		pub.Languages = append(pub.Languages, strings.TrimSuffix(filepath.Base(f), ".yaml"))
+	}
+	return pub
+}
+
+// serveDataAPI loads the public configuration and language strings and serves them as JSON.
 func (s *Server) serveDataAPI(w http.ResponseWriter, r *http.Request) {
 	langFilePath := filepath.Join(s.AppConfig.Paths.LocalesDir, s.AppConfig.Language+".yaml")
 	langStrings, err := locale.LoadLanguageStrings(langFilePath)
@@ -42,111 +73,220 @@ func (s *Server) serveDataAPI(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	pageData := PageData{Config: s.AppConfig, Strings: langStrings}
+	pageData := PageData{Config: s.publicConfig(), Strings: langStrings, LastFailure: s.State.LastFailure()}
+	if _, sess, _, ok := s.session(r); ok {
+		pageData.CSRFToken = sess.csrf
+	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(pageData); err != nil {
 		log.Printf("ERROR: Failed to encode JSON response: %v", err)
 	}
 }
 
-// handleScanSSIDs scans for wireless networks and returns an HTML fragment for HTMX.
+// signalBar is one bar of the signal strength indicator in the SSID list.
+type signalBar struct {
+	Height int
+	On     bool
+}
+
+// ssidListTemplate renders scan results as the HTMX fragment for the network list.
+var ssidListTemplate = template.Must(template.New("ssids").Parse(`{{range .}}<div class="ssid-item flex justify-between items-center" onclick="selectSSID('{{.SSID}}', '{{.Security}}')">
+    <span>{{.SSID}}</span>
+    <span class="flex items-center gap-2 text-stone-500 text-sm">
+        {{if .Secured}}<span title="{{.Security}}">&#128274;</span>{{end}}
+        <span class="flex items-end gap-px h-4" title="{{.Signal}} dBm">{{range .Bars}}<span class="inline-block w-1 rounded-sm {{if .On}}bg-blue-600{{else}}bg-stone-300{{end}}" style="height: {{.Height}}px"></span>{{end}}</span>
+    </span>
+</div>{{end}}`))
+
+// scanResults returns the cached scan results. Passing refresh=1 forces a new
+// scan, which is shared with any scan already in progress. A scan is also run
+// if the background scanner has not produced results yet.
+func (s *Server) scanResults(r *http.Request) ([]scan.Network, error) {
+	if r.URL.Query().Get("refresh") == "1" {
+		return s.Scans.Refresh()
+	}
+	networks, updated, err := s.Scans.Networks()
+	if updated.IsZero() {
+		return s.Scans.Refresh()
+	}
+	return networks, err
+}
+
+// handleScanSSIDs returns the cached scan results as an HTML fragment for
+// HTMX. If a refresh fails, the networks of the last scan are still listed.
 func (s *Server) handleScanSSIDs(w http.ResponseWriter, r *http.Request) {
-	cmdStr := fmt.Sprintf("iw dev %s scan | grep 'SSID:' | sed 's/\\s*SSID: //'", s.AppConfig.Network.WirelessInterface)
-	cmd := execCommand("sh", "-c", cmdStr)
-	out, err := cmd.Output()
-	if err != nil {
+	networks, err := s.scanResults(r)
+	if err != nil && len(networks) == 0 {
 		log.Printf("ERROR: Failed to scan for Wi-Fi networks: %v", err)
 		fmt.Fprint(w, `<p class="text-red-500 p-4">Error: Could not scan for networks.</p>`)
 		return
 	}
-	var ssids []string
-	for _, ssid := range strings.Split(string(out), "\n") {
-		if trimmed := strings.TrimSpace(ssid); trimmed != "" {
-			ssids = append(ssids, trimmed)
+	w.Header().Set("Content-Type", "text/html")
+	if err != nil {
+		log.Printf("WARNING: Failed to refresh the Wi-Fi scan, showing the last results: %v", err)
+		fmt.Fprint(w, `<p class="text-stone-500 text-sm p-2">Could not refresh the list. These networks are from the last scan.</p>`)
+	}
+	type ssidView struct {
+		scan.Network
+		Secured bool
+		Bars    []signalBar
+	}
+	views := make([]ssidView, 0, len(networks))
+	for _, n := range networks {
+		v := ssidView{Network: n, Secured: n.Security != scan.SecurityOpen}
+		for i := 0; i < 4; i++ {
+			v.Bars = append(v.Bars, signalBar{Height: 4 * (i + 1), On: i < n.Bars()})
 		}
+		views = append(views, v)
+	}
+	if err := ssidListTemplate.Execute(w, views); err != nil {
+		log.Printf("ERROR: Failed to render SSID list: %v", err)
 	}
-	listTemplate := `{{range .}}<div class="ssid-item" onclick="selectSSID('{{.}}')">{{.}}</div>{{end}}`
-	tmpl, _ := template.New("ssids").Parse(listTemplate)
-	w.Header().Set("Content-Type", "text/html")
-	tmpl.Execute(w, ssids)
 }
 
-// handleConnect receives credentials, saves the profile, and applies the connection.
+// handleConnect receives credentials and starts a transactional connect. The
+// profile is only saved once the connection has been verified.
 func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
-	ssid := r.FormValue("ssid")
-	password := r.FormValue("password")
-	if ssid == "" { http.Error(w, "SSID cannot be empty.", http.StatusBadRequest); return }
-	log.Printf("Received request to connect to SSID: %s", ssid)
-	tmpl, err := template.ParseFiles(netplanTemplate); if err != nil { log.Printf("ERROR: Failed to parse netplan template: %v", err); http.Error(w, "Internal Server Error", 500); return }
-	data := struct{ SSID, Password, WirelessInterface string }{ssid, password, s.AppConfig.Network.WirelessInterface}
-	var buf bytes.Buffer
-	if err := tmpl.Execute(&buf, data); err != nil { log.Printf("ERROR: Failed to execute netplan template: %v", err); http.Error(w, "Internal Server Error", 500); return }
-	netplanContent := buf.Bytes()
-	if err := os.MkdirAll(savedNetworksDir, 0755); err != nil { log.Printf("ERROR: Could not create saved_networks directory: %v", err); http.Error(w, "Internal Server Error", 500); return }
-	profilePath := filepath.Join(savedNetworksDir, ssid+".yaml")
-	if err := os.WriteFile(profilePath, netplanContent, 0644); err != nil { log.Printf("ERROR: Failed to write network profile: %v", err); http.Error(w, "Internal Server Error", 500); return }
-	log.Printf("Saved new network profile to %s", profilePath)
-	_ = os.Remove(lastGoodSymlink)
-	if err := os.Symlink(profilePath, lastGoodSymlink); err != nil { log.Printf("ERROR: Failed to update symlink: %v", err) } else { log.Printf("Updated last-good symlink to point to %s", profilePath) }
-	if err := os.WriteFile(activeClientConfig, netplanContent, 0644); err != nil { log.Printf("ERROR: Failed to write active netplan config: %v", err); http.Error(w, "Internal Server Error", 500); return }
-	select { case s.StopSignal <- true: log.Println("Sent stop signal to boot manager."); default: log.Println("Could not send stop signal to boot manager (it may have already exited).") }
-	
-	cmd := execCommand("sh", "-c", "systemctl stop hostapd dnsmasq pifigo && netplan apply")
-	if output, err := cmd.CombinedOutput(); err != nil { log.Printf("ERROR: Failed to apply netplan configuration: %v\nOutput: %s", err, string(output)); http.Error(w, "Failed to apply network settings.", 500); return }
-	
-	fmt.Fprint(w, `<p class="text-green-600 font-semibold">Success! The device is now attempting to connect to your Wi-Fi network.</p>`)
+	r.Body = http.MaxBytesReader(w, r.Body, maxConnectFormSize)
+	if err := r.ParseMultipartForm(maxConnectFormSize); err != nil && !errors.Is(err, http.ErrNotMultipart) { http.Error(w, "Invalid form.", http.StatusBadRequest); return }
+	req, err := networkFromForm(r)
+	if err != nil { writeHTMLError(w, "Invalid enterprise settings: "+err.Error()); return }
+	if _, err := s.connect(req); err != nil { writeHTMLServiceError(w, err); return }
+
+	fmt.Fprint(w, `<p class="text-green-600 font-semibold">Success! The device is now attempting to connect to your Wi-Fi network. If it cannot connect, the setup hotspot will come back and show what went wrong.</p>`)
+}
+
+// networkFromForm reads the connect form, including uploaded certificates.
+func networkFromForm(r *http.Request) (networkRequest, error) {
+	req := networkRequest{SSID: r.FormValue("ssid"), Password: r.FormValue("password"), Hidden: r.FormValue("hidden") != ""}
+	if ip, ok := ipFromForm(r); ok {
+		settings := ipSettings(ip)
+		req.IP = &settings
+	}
+	if r.FormValue("security") != profiles.SecurityEAP {
+		return req, nil
+	}
+	req.Security = profiles.SecurityEAP
+	req.EAP = &eapRequest{
+		Method:            r.FormValue("eap_method"),
+		Identity:          r.FormValue("identity"),
+		AnonymousIdentity: r.FormValue("anonymous_identity"),
+		Phase2:            r.FormValue("phase2"),
+		ClientKeyPassword: r.FormValue("client_key_password"),
+	}
+	uploads := []struct {
+		field string
+		data  *string
+	}{
+		{"ca_cert", &req.EAP.CACert},
+		{"client_cert", &req.EAP.ClientCert},
+		{"client_key", &req.EAP.ClientKey},
+	}
+	for _, u := range uploads {
+		file, _, err := r.FormFile(u.field)
+		if errors.Is(err, http.ErrMissingFile) || errors.Is(err, http.ErrNotMultipart) {
+			continue
+		}
+		if err != nil {
+			return req, err
+		}
+		data, err := io.ReadAll(io.LimitReader(file, profiles.MaxCertSize+1))
+		file.Close()
+		if err != nil {
+			return req, err
+		}
+		*u.data = string(data)
+	}
+	return req, nil
+}
+
+// ipFromForm reads the optional addressing fields of the connect form. ok is
+// false when the form leaves the addressing as it is: the saved network's
+// settings, or the config.yaml default for a new one.
+func ipFromForm(r *http.Request) (ip network.IPConfig, ok bool) {
+	ip.Mode = r.FormValue("ip_mode")
+	if ip.Mode == "" {
+		return ip, false
+	}
+	if ip.Mode == network.IPModeStatic {
+		ip.Address = strings.TrimSpace(r.FormValue("static_ip"))
+		ip.Gateway = strings.TrimSpace(r.FormValue("gateway"))
+		ip.DNS = strings.FieldsFunc(r.FormValue("dns"), func(c rune) bool { return c == ',' || unicode.IsSpace(c) })
+	}
+	return ip, true
+}
+
+// scannedSecurity returns the security type the latest scan saw for the
+// SSID. ok is false when the network is not in the scan results, as for a
+// hidden network.
+func (s *Server) scannedSecurity(ssid string) (security string, ok bool) {
+	networks, _, _ := s.Scans.Networks()
+	for _, n := range networks {
+		if n.SSID == ssid {
+			return string(n.Security), true
+		}
+	}
+	return "", false
+}
+
+// maxConnectFormSize bounds the connect form, including uploaded certificates.
+const maxConnectFormSize = 1 << 20
+
+// busyMessage is shown when a connection attempt is already running.
+const busyMessage = "Another connection attempt is already in progress. Please wait for it to finish."
+
+// writeHTMLError writes an error message as an HTMX fragment. It is sent with
+// a 200 status, since HTMX does not swap error responses by default.
+func writeHTMLError(w http.ResponseWriter, msg string) {
+	fmt.Fprintf(w, `<p class="text-red-600 font-semibold">%s</p>`, template.HTMLEscapeString(msg))
+}
+
+// writeHTMLServiceError writes an error from the service layer for HTMX.
+// Malformed requests and unknown networks keep their error status; anything
+// else is shown to the user as a message fragment.
+func writeHTMLServiceError(w http.ResponseWriter, err error) {
+	status, msg := errorStatus(err)
+	if status == http.StatusBadRequest || status == http.StatusNotFound { http.Error(w, msg, status); return }
+	writeHTMLError(w, msg)
 }
 
 // handleListSavedNetworks reads the saved network profiles and returns an HTML fragment.
 func (s *Server) handleListSavedNetworks(w http.ResponseWriter, r *http.Request) {
-	files, err := os.ReadDir(savedNetworksDir)
+	saved, err := s.savedNetworks()
 	langFilePath := filepath.Join(s.AppConfig.Paths.LocalesDir, s.AppConfig.Language+".yaml")
 	langStrings, _ := locale.LoadLanguageStrings(langFilePath)
-	if err != nil || len(files) == 0 {
+	if err != nil || len(saved) == 0 {
 		if langStrings != nil {
 			fmt.Fprintf(w, `<p class="text-stone-500 p-4 text-center">%s</p>`, langStrings.NoSavedConnectionsMessage)
 		}
 		return
 	}
-	var savedSSIDs []string
-	for _, file := range files {
-		if !file.IsDir() && filepath.Ext(file.Name()) == ".yaml" {
-			savedSSIDs = append(savedSSIDs, strings.TrimSuffix(file.Name(), ".yaml"))
-		}
-	}
 	reconnectText := "Reconnect"
 	if langStrings != nil {
 		reconnectText = langStrings.ReconnectButtonText
 	}
-	listTemplate := `{{range .SSIDs}}
+	listTemplate := `{{range .Profiles}}
         <div class="flex justify-between items-center p-2 rounded-lg hover:bg-stone-100">
-            <span class="font-medium">{{.}}</span>
-            <button hx-post="/reconnect" hx-vals='{"ssid": "{{.}}"}' hx-target="#response-div" hx-swap="innerHTML" hx-indicator="#spinner" class="px-3 py-1 text-sm bg-stone-200 text-stone-700 font-semibold rounded-md hover:bg-stone-300 transition-colors">
+            <span class="font-medium">{{.SSID}}</span>
+            <button hx-post="/reconnect" hx-vals='{"id": "{{.ID}}"}' hx-target="#response-div" hx-swap="innerHTML" hx-indicator="#spinner" class="px-3 py-1 text-sm bg-stone-200 text-stone-700 font-semibold rounded-md hover:bg-stone-300 transition-colors">
                 {{$.ReconnectText}}
             </button>
         </div>
         {{end}}`
 	tmpl, _ := template.New("saved").Parse(listTemplate)
-	data := struct { SSIDs []string; ReconnectText string }{ savedSSIDs, reconnectText }
+	data := struct { Profiles []profiles.Profile; ReconnectText string }{ saved, reconnectText }
 	w.Header().Set("Content-Type", "text/html")
 	tmpl.Execute(w, data)
 }
 
-// handleReconnect takes a saved SSID, applies its config, and connects.
+// handleReconnect takes a saved profile ID, applies its config, and connects.
+// Forms from earlier versions post the SSID instead, which is still accepted.
 func (s *Server) handleReconnect(w http.ResponseWriter, r *http.Request) {
-	ssid := r.FormValue("ssid")
-	if ssid == "" { http.Error(w, "SSID cannot be empty.", http.StatusBadRequest); return }
-	log.Printf("Received reconnect request for SSID: %s", ssid)
-	profilePath := filepath.Join(savedNetworksDir, ssid+".yaml")
-	netplanContent, err := os.ReadFile(profilePath)
-	if err != nil { log.Printf("ERROR: Could not read saved profile '%s': %v", profilePath, err); http.Error(w, "Could not find saved network profile.", http.StatusNotFound); return }
-	_ = os.Remove(lastGoodSymlink)
-	if err := os.Symlink(profilePath, lastGoodSymlink); err != nil { log.Printf("ERROR: Failed to update symlink: %v", err) }
-	if err := os.WriteFile(activeClientConfig, netplanContent, 0644); err != nil { log.Printf("ERROR: Failed to write active netplan config: %v", err); http.Error(w, "Internal Server Error", 500); return }
-	select { case s.StopSignal <- true: log.Println("Sent stop signal to boot manager."); default: log.Println("Could not send stop signal to boot manager (it may have already exited).") }
-	
-	cmd := execCommand("sh", "-c", "systemctl stop hostapd dnsmasq pifigo && netplan apply")
-	if output, err := cmd.CombinedOutput(); err != nil { log.Printf("ERROR: Failed to apply netplan configuration: %v\nOutput: %s", err, string(output)); http.Error(w, "Failed to apply network settings.", 500); return }
-
-	fmt.Fprintf(w, `<p class="text-green-600 font-semibold">Success! Attempting to reconnect to %s.</p>`, ssid)
+	id := r.FormValue("id")
+	if ssid := r.FormValue("ssid"); id == "" && ssid != "" { id = profiles.ID(ssid) }
+	if !profiles.ValidID(id) { http.Error(w, "Invalid network profile.", http.StatusBadRequest); return }
+	profile, err := s.reconnect(id)
+	if err != nil { writeHTMLServiceError(w, err); return }
+
+	fmt.Fprintf(w, `<p class="text-green-600 font-semibold">Success! Attempting to reconnect to %s.</p>`, template.HTMLEscapeString(profile.SSID))
 }
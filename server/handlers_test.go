@@ -1,6 +1,16 @@
 package server
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -8,6 +18,11 @@ import (
 	"os/exec"
 	"path/filepath"
 	"pifigo/internal/config"
+	"pifigo/internal/network"
+	"pifigo/internal/probe"
+	"pifigo/internal/profiles"
+	"pifigo/internal/scan"
+	"pifigo/internal/state"
 	"strings"
 	"testing"
 )
@@ -49,8 +64,18 @@ no_saved_connections_message: "None saved"
 	// Override paths to use temp directory
 	cfg.Paths.LocalesDir = filepath.Join(tmpDir, "testdata", "locales")
 
-	stopSignal := make(chan bool, 1)
-	return NewServer(cfg, stopSignal)
+	// Connections are verified against a local probe instead of the internet.
+	online := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(online.Close)
+	cfg.Watchdog.CheckURL = online.URL
+
+	machine, err := state.Load(filepath.Join(tmpDir, "state.json"))
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	return NewServer(cfg, network.NewFake(), machine)
 }
 
 // setupTestNetDirs creates temporary directories for network files and overrides the package variables.
@@ -58,37 +83,46 @@ func setupTestNetDirs(t *testing.T) func() {
 	tmpDir := t.TempDir()
 
 	origSavedDir := savedNetworksDir
-	origActiveConfig := activeClientConfig
-	origSymlink := lastGoodSymlink
-	origTemplate := netplanTemplate
-
 	savedNetworksDir = filepath.Join(tmpDir, "saved_networks")
-	activeClientConfig = filepath.Join(tmpDir, "99-pifigo-client.yaml")
-	lastGoodSymlink = filepath.Join(tmpDir, "last-good-wifi.yaml")
-	netplanTemplate = filepath.Join(tmpDir, "netplan.tpl")
-
 	os.MkdirAll(savedNetworksDir, 0755)
-	os.WriteFile(netplanTemplate, []byte("ssid: {{.SSID}}"), 0644)
 
 	return func() {
 		savedNetworksDir = origSavedDir
-		activeClientConfig = origActiveConfig
-		lastGoodSymlink = origSymlink
-		netplanTemplate = origTemplate
 	}
 }
 
-// mockExecCommand replaces the real exec.Command with a harmless one for testing.
-func mockExecCommand(t *testing.T) func() {
-	originalExec := execCommand
-	execCommand = func(name string, arg ...string) *exec.Cmd {
-		// Instead of running the real command, run '/bin/true', which does nothing and exits successfully.
-		return exec.Command("/bin/true")
-	}
-	// Return a cleanup function to restore the original execCommand.
-	return func() {
-		execCommand = originalExec
+// sampleScan is a trimmed 'iw scan' output with a duplicate SSID.
+const sampleScan = `BSS aa:bb:cc:00:00:01(on wlan_test)
+	freq: 2437
+	capability: ESS Privacy (0x0011)
+	signal: -70.00 dBm
+	SSID: HomeWiFi
+	RSN:	 * Version: 1
+		 * Authentication suites: PSK
+BSS aa:bb:cc:00:00:02(on wlan_test)
+	freq: 5180
+	capability: ESS Privacy (0x0011)
+	signal: -45.00 dBm
+	SSID: HomeWiFi
+	RSN:	 * Version: 1
+		 * Authentication suites: PSK
+BSS aa:bb:cc:00:00:03(on wlan_test)
+	freq: 2412
+	capability: ESS (0x0001)
+	signal: -60.00 dBm
+	SSID: CoffeeShop
+`
+
+// mockScan makes scans return sampleScan and counts how many were run.
+func mockScan(t *testing.T) *int {
+	scans := 0
+	originalExec := scan.ExecCommand
+	scan.ExecCommand = func(name string, arg ...string) *exec.Cmd {
+		scans++
+		return exec.Command("printf", "%s", sampleScan)
 	}
+	t.Cleanup(func() { scan.ExecCommand = originalExec })
+	return &scans
 }
 
 func TestServeDataAPI(t *testing.T) {
@@ -107,13 +141,35 @@ func TestServeDataAPI(t *testing.T) {
 	}
 }
 
+// TestServeDataAPIPublicOnly verifies the page data holds only what the
+// portal shows: no secrets, paths or addresses.
+func TestServeDataAPIPublicOnly(t *testing.T) {
+	server := setupTestServer(t)
+	server.AppConfig.Network.DeviceHostname = "pifigo-test"
+	server.AppConfig.Network.ApPassword = "hotspot-secret"
+	server.AppConfig.Network.StaticIP = "10.9.8.7/24"
+	server.AppConfig.Admin.PasswordHash = "hash-secret"
+
+	rr := httptest.NewRecorder()
+	server.serveDataAPI(rr, httptest.NewRequest("GET", "/api/data", nil))
+	var data PageData
+	if err := json.Unmarshal(rr.Body.Bytes(), &data); err != nil {
+		t.Fatalf("Failed to decode the page data: %v", err)
+	}
+	if data.Config.Hostname != "pifigo-test" || len(data.Config.Languages) != 1 || data.Config.Languages[0] != "en" {
+		t.Errorf("Unexpected public config: %+v", data.Config)
+	}
+	for _, leak := range []string{"hotspot-secret", "hash-secret", "10.9.8.7", "testdata", "wlan_test"} {
+		if strings.Contains(rr.Body.String(), leak) {
+			t.Errorf("Page data contains %q: %s", leak, rr.Body.String())
+		}
+	}
+}
+
 func TestHandleConnect(t *testing.T) {
 	cleanupNetDirs := setupTestNetDirs(t)
 	defer cleanupNetDirs()
 
-	cleanupExec := mockExecCommand(t)
-	defer cleanupExec()
-
 	server := setupTestServer(t)
 
 	formData := url.Values{}
@@ -125,19 +181,306 @@ func TestHandleConnect(t *testing.T) {
 	rr := httptest.NewRecorder()
 
 	server.handleConnect(rr, req)
+	server.pending.Wait()
 
 	// Check that the handler completed successfully.
 	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
 	}
 
-	profilePath := filepath.Join(savedNetworksDir, "MyTestNetwork.yaml")
-	if _, err := os.Stat(profilePath); os.IsNotExist(err) {
-		t.Errorf("Expected network profile to be saved at %s, but it was not", profilePath)
+	saved, err := profiles.NewStore(savedNetworksDir).Find("MyTestNetwork")
+	if err != nil {
+		t.Errorf("Expected network profile to be saved, but it was not: %v", err)
+	} else if saved.PMK == "" || saved.PSK != "" || saved.LastUsed.IsZero() {
+		t.Errorf("Unexpected saved profile: %+v", saved)
+	}
+
+	if lastGood := server.State.LastGood(); lastGood != profiles.ID("MyTestNetwork") {
+		t.Errorf("Expected MyTestNetwork to be recorded as last-good, got %q", lastGood)
+	}
+
+	// Check that the network was handed to the backend.
+	backend := server.Backend.(*network.Fake)
+	if backend.Config().SSID != "MyTestNetwork" {
+		t.Errorf("Expected backend to connect to MyTestNetwork, got %+v", backend.Config())
+	}
+	if server.State.Current() != state.Client {
+		t.Errorf("Expected the state machine to reach client, got %s", server.State.Current())
+	}
+
+	// Resubmitting a saved network without its password keeps the saved one.
+	req = httptest.NewRequest("POST", "/connect", strings.NewReader(url.Values{"ssid": {"MyTestNetwork"}}.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	server.handleConnect(httptest.NewRecorder(), req)
+	server.pending.Wait()
+	if c := backend.Config(); c.Security != network.SecurityWPA2PSK || c.Password != saved.PMK {
+		t.Errorf("Expected the saved credentials to be used, got %+v", c)
+	}
+	if resaved, _ := profiles.NewStore(savedNetworksDir).Find("MyTestNetwork"); resaved.Security != profiles.SecurityWPA2PSK || resaved.PMK != saved.PMK {
+		t.Errorf("Expected the saved credentials to be kept, got %+v", resaved)
+	}
+}
+
+func TestHandleConnectStaticIP(t *testing.T) {
+	cleanupNetDirs := setupTestNetDirs(t)
+	defer cleanupNetDirs()
+	server := setupTestServer(t)
+
+	post := func(address string) *httptest.ResponseRecorder {
+		formData := url.Values{}
+		formData.Set("ssid", "Office")
+		formData.Set("password", "password123")
+		formData.Set("ip_mode", "static")
+		formData.Set("static_ip", address)
+		formData.Set("gateway", "192.168.1.1")
+		formData.Set("dns", "8.8.8.8, 1.1.1.1")
+		req := httptest.NewRequest("POST", "/connect", strings.NewReader(formData.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		server.handleConnect(rr, req)
+		server.pending.Wait()
+		return rr
+	}
+
+	if rr := post("10.0.0.5/24"); !strings.Contains(rr.Body.String(), "Invalid IP settings") {
+		t.Errorf("Expected a gateway off the subnet to be rejected, got: %s", rr.Body.String())
+	}
+	if calls := server.Backend.(*network.Fake).Calls(); len(calls) != 0 {
+		t.Errorf("Invalid settings should not touch the network, got %v", calls)
+	}
+
+	post("192.168.1.150/24")
+	ip := server.Backend.(*network.Fake).Config().IP
+	if ip.Mode != network.IPModeStatic || ip.Address != "192.168.1.150/24" || len(ip.DNS) != 2 {
+		t.Errorf("Expected the static settings to be applied, got %+v", ip)
+	}
+	saved, err := profiles.NewStore(savedNetworksDir).Find("Office")
+	if err != nil || saved.IPMode != profiles.IPModeStatic || saved.Static.Gateway != "192.168.1.1" {
+		t.Errorf("Expected the static settings to be saved, got %+v (err: %v)", saved, err)
+	}
+}
+
+func TestHandleConnectSecurityFromScan(t *testing.T) {
+	cleanupNetDirs := setupTestNetDirs(t)
+	defer cleanupNetDirs()
+	mockScan(t)
+	server := setupTestServer(t)
+	server.Scans.Refresh()
+
+	post := func(form url.Values) network.ClientConfig {
+		req := httptest.NewRequest("POST", "/connect", strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		server.handleConnect(rr, req)
+		server.pending.Wait()
+		if !strings.Contains(rr.Body.String(), "Success!") {
+			t.Fatalf("Expected success, got: %s", rr.Body.String())
+		}
+		return server.Backend.(*network.Fake).Config()
+	}
+
+	c := post(url.Values{"ssid": {"CoffeeShop"}, "password": {"leftover"}})
+	if c.Security != network.SecurityOpen || c.Password != "" {
+		t.Errorf("Expected the scanned open network to be joined without a password, got %+v", c)
+	}
+
+	c = post(url.Values{"ssid": {"Attic"}, "password": {"secret123"}, "hidden": {"on"}})
+	if !c.Hidden || c.Security != network.SecurityWPA2PSK {
+		t.Errorf("Expected a hidden WPA2 network, got %+v", c)
+	}
+	saved, err := profiles.NewStore(savedNetworksDir).Find("Attic")
+	if err != nil || !saved.Hidden {
+		t.Errorf("Expected the hidden flag to be saved, got %+v (err: %v)", saved, err)
+	}
+}
+
+func TestHandleConnectEnterprise(t *testing.T) {
+	cleanupNetDirs := setupTestNetDirs(t)
+	defer cleanupNetDirs()
+	server := setupTestServer(t)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "radius"}}
+	ca, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+
+	post := func(ssid, method string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("ssid", ssid)
+		form.WriteField("security", "eap")
+		form.WriteField("eap_method", method)
+		form.WriteField("identity", "alice@example.edu")
+		form.WriteField("password", "hunter22")
+		part, _ := form.CreateFormFile("ca_cert", "ca.der")
+		part.Write(ca)
+		form.Close()
+		req := httptest.NewRequest("POST", "/connect", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		rr := httptest.NewRecorder()
+		server.handleConnect(rr, req)
+		server.pending.Wait()
+		return rr
+	}
+	rr := post("eduroam", "peap")
+
+	if !strings.Contains(rr.Body.String(), "Success!") {
+		t.Fatalf("Expected success, got: %s", rr.Body.String())
+	}
+	eap := server.Backend.(*network.Fake).Config().EAP
+	if eap == nil || eap.Method != network.EAPPEAP || eap.Identity != "alice@example.edu" || eap.Password != "hunter22" {
+		t.Fatalf("Expected the enterprise settings to be applied, got %+v", eap)
+	}
+	if filepath.Dir(eap.CACert) != filepath.Join(filepath.Dir(savedNetworksDir), "certs") {
+		t.Errorf("Expected the CA certificate to be stored in the certificate directory, got %q", eap.CACert)
+	}
+	if data, err := os.ReadFile(eap.CACert); err != nil || !strings.Contains(string(data), "BEGIN CERTIFICATE") {
+		t.Errorf("Expected the CA certificate to be stored as PEM (err: %v)", err)
+	}
+
+	formData := url.Values{}
+	formData.Set("ssid", "eduroam")
+	formData.Set("security", "eap")
+	formData.Set("eap_method", "tls")
+	formData.Set("identity", "alice@example.edu")
+	req := httptest.NewRequest("POST", "/connect", strings.NewReader(formData.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	server.handleConnect(rr, req)
+	if !strings.Contains(rr.Body.String(), "Invalid enterprise settings") {
+		t.Errorf("Expected EAP-TLS without a client certificate to be rejected, got: %s", rr.Body.String())
+	}
+
+	// Certificates are not kept for settings that are refused or a network
+	// that cannot be joined.
+	caPath := profiles.NewStore(savedNetworksDir).CertPath(profiles.ID("Library"), profiles.CertCA)
+	if rr := post("Library", "tls"); !strings.Contains(rr.Body.String(), "Invalid enterprise settings") {
+		t.Errorf("Expected EAP-TLS without a client certificate to be rejected, got: %s", rr.Body.String())
+	}
+	if _, err := os.Stat(caPath); !os.IsNotExist(err) {
+		t.Errorf("Expected no certificate to be written for refused settings, got %v", err)
+	}
+	server.AppConfig.Network.ConnectTimeoutSeconds = 1
+	server.Backend.(*network.Fake).NoAssociation = true
+	post("Library", "peap")
+	if _, err := os.Stat(caPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the certificate to be removed after a failed connect, got %v", err)
+	}
+	if _, err := os.Stat(eap.CACert); err != nil {
+		t.Errorf("Expected the certificate of the joined network to be kept, got %v", err)
+	}
+}
+
+func TestHandleConnectFailure(t *testing.T) {
+	cleanupNetDirs := setupTestNetDirs(t)
+	defer cleanupNetDirs()
+
+	server := setupTestServer(t)
+	server.AppConfig.Network.ConnectTimeoutSeconds = 1
+	backend := server.Backend.(*network.Fake)
+	backend.NoAssociation = true
+
+	formData := url.Values{}
+	formData.Set("ssid", "WrongPassword")
+	formData.Set("password", "password123")
+	req := httptest.NewRequest("POST", "/connect", strings.NewReader(formData.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	server.handleConnect(httptest.NewRecorder(), req)
+	server.pending.Wait()
+
+	// The device should be back in hotspot mode with nothing saved.
+	if st, _ := backend.Status(); st.Mode != network.ModeHotspot {
+		t.Errorf("Expected rollback to hotspot mode, got %s", st.Mode)
+	}
+	if server.State.Current() != state.Hotspot {
+		t.Errorf("Expected the state machine to settle in hotspot, got %s", server.State.Current())
+	}
+	if _, err := profiles.NewStore(savedNetworksDir).Find("WrongPassword"); !errors.Is(err, profiles.ErrNotFound) {
+		t.Error("A profile that failed to connect should not be saved")
+	}
+	if lastGood := server.State.LastGood(); lastGood != "" {
+		t.Errorf("A failed profile should not become last-good, got %q", lastGood)
+	}
+	if c := server.State.Snapshot().Profiles[profiles.ID("WrongPassword")]; c.Attempts != 1 || c.Failures != 1 {
+		t.Errorf("Expected one failed attempt to be counted, got %+v", c)
+	}
+
+	// The failure is reported to the portal.
+	rr := httptest.NewRecorder()
+	server.serveDataAPI(rr, httptest.NewRequest("GET", "/api/data", nil))
+	var data PageData
+	json.NewDecoder(rr.Body).Decode(&data)
+	if data.LastFailure == nil || data.LastFailure.SSID != "WrongPassword" || data.LastFailure.Stage != network.StageAssociation {
+		t.Errorf("Expected the association failure to be reported, got %+v", data.LastFailure)
+	}
+}
+
+// stubValidator answers every credential check with err.
+type stubValidator struct{ err error }
+
+func (v stubValidator) Validate(network.ClientConfig) error { return v.err }
+
+func TestHandleConnectWrongPassword(t *testing.T) {
+	cleanupNetDirs := setupTestNetDirs(t)
+	defer cleanupNetDirs()
+
+	server := setupTestServer(t)
+	server.Validator = stubValidator{&network.ConnectError{Stage: network.StageAuthentication, Err: network.ErrWrongPassword}}
+	backend := server.Backend.(*network.Fake)
+
+	formData := url.Values{}
+	formData.Set("ssid", "HomeWiFi")
+	formData.Set("password", "typo")
+	req := httptest.NewRequest("POST", "/connect", strings.NewReader(formData.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	server.handleConnect(rr, req)
+	server.pending.Wait()
+
+	if !strings.Contains(rr.Body.String(), "Wrong password for HomeWiFi") {
+		t.Errorf("Expected a wrong password message, got: %s", rr.Body.String())
+	}
+	for _, call := range backend.Calls() {
+		if call == "Connect" || call == "StopHotspot" {
+			t.Errorf("The hotspot should stay up after a failed credential check, got calls %v", backend.Calls())
+		}
+	}
+
+	// A check that cannot run on this hardware does not block the connection.
+	server.Validator = stubValidator{network.ErrValidationUnsupported}
+	req = httptest.NewRequest("POST", "/connect", strings.NewReader(formData.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	server.handleConnect(httptest.NewRecorder(), req)
+	server.pending.Wait()
+	if st, _ := backend.Status(); st.Mode != network.ModeClient {
+		t.Errorf("Expected the connection to go ahead, got %s", st.Mode)
+	}
+}
+
+func TestHandleConnectBusy(t *testing.T) {
+	cleanupNetDirs := setupTestNetDirs(t)
+	defer cleanupNetDirs()
+
+	server := setupTestServer(t)
+	release, err := server.State.Acquire("connect")
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
 	}
+	defer release()
+
+	formData := url.Values{}
+	formData.Set("ssid", "HomeWiFi")
+	formData.Set("password", "password123")
+	req := httptest.NewRequest("POST", "/connect", strings.NewReader(formData.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	server.handleConnect(rr, req)
+	server.pending.Wait()
 
-	if _, err := os.Lstat(lastGoodSymlink); os.IsNotExist(err) {
-		t.Errorf("Expected last-good symlink to be created at %s, but it was not", lastGoodSymlink)
+	if !strings.Contains(rr.Body.String(), "already in progress") {
+		t.Errorf("Expected a busy message, got: %s", rr.Body.String())
+	}
+	if calls := server.Backend.(*network.Fake).Calls(); len(calls) > 1 {
+		t.Errorf("A second connection attempt should not touch the network, got calls %v", calls)
 	}
 }
 
@@ -156,8 +499,9 @@ func TestHandleListSavedNetworks(t *testing.T) {
 	}
 
 	// Add some saved networks
-	os.WriteFile(filepath.Join(savedNetworksDir, "HomeWiFi.yaml"), []byte("..."), 0644)
-	os.WriteFile(filepath.Join(savedNetworksDir, "OfficeWiFi.yaml"), []byte("..."), 0644)
+	store := profiles.NewStore(savedNetworksDir)
+	store.Save(profiles.New("HomeWiFi", "secret123"))
+	store.Save(profiles.New("OfficeWiFi", "secret456"))
 
 	rr = httptest.NewRecorder() // Reset the recorder
 	server.handleListSavedNetworks(rr, req)
@@ -175,44 +519,312 @@ func TestHandleReconnect(t *testing.T) {
 	cleanupNetDirs := setupTestNetDirs(t)
 	defer cleanupNetDirs()
 
-	cleanupExec := mockExecCommand(t)
-	defer cleanupExec()
-
 	server := setupTestServer(t)
 
 	// Create a fake saved network profile
 	savedSSID := "MyHomeWiFi"
-	savedContent := "network: MyHomeWiFi"
-	profilePath := filepath.Join(savedNetworksDir, savedSSID+".yaml")
-	os.WriteFile(profilePath, []byte(savedContent), 0644)
+	profiles.NewStore(savedNetworksDir).Save(profiles.New(savedSSID, "secret123"))
 
 	// Create the form data for the POST request
 	formData := url.Values{}
-	formData.Set("ssid", savedSSID)
+	formData.Set("id", profiles.ID(savedSSID))
 
 	req := httptest.NewRequest("POST", "/reconnect", strings.NewReader(formData.Encode()))
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	rr := httptest.NewRecorder()
 
 	server.handleReconnect(rr, req)
+	server.pending.Wait()
 
 	// Check that the handler completed successfully.
 	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
 	}
 
-	// Check that the active config was written with the correct content
-	activeContent, err := os.ReadFile(activeClientConfig)
-	if err != nil {
-		t.Fatalf("Could not read active client config: %v", err)
+	// Check that the backend was asked to apply the saved profile
+	active := server.Backend.(*network.Fake).Config()
+	if pmk, _ := profiles.PMK("secret123", savedSSID); active.SSID != savedSSID || active.Password != pmk {
+		t.Errorf("Expected the saved network to be applied, got %+v", active)
 	}
-	if string(activeContent) != savedContent {
-		t.Errorf("Expected active config content to be '%s', got '%s'", savedContent, string(activeContent))
+
+	// Check that the last-good network was updated
+	if lastGood := server.State.LastGood(); lastGood != profiles.ID(savedSSID) {
+		t.Errorf("Expected last-good to be %s, got %s", savedSSID, lastGood)
 	}
 
-	// Check that the symlink was updated
-	target, _ := os.Readlink(lastGoodSymlink)
-	if filepath.Base(target) != savedSSID+".yaml" {
-		t.Errorf("Symlink points to wrong file: expected %s.yaml, got %s", savedSSID, filepath.Base(target))
+	// Forms from earlier versions post the SSID.
+	req = httptest.NewRequest("POST", "/reconnect", strings.NewReader(url.Values{"ssid": {savedSSID}}.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	server.handleReconnect(rr, req)
+	server.pending.Wait()
+	if !strings.Contains(rr.Body.String(), "Attempting to reconnect to "+savedSSID) {
+		t.Errorf("Expected a reconnect by SSID, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	// A profile ID that is a path is refused before touching the disk.
+	formData.Set("id", "../../netplan/evil")
+	req = httptest.NewRequest("POST", "/reconnect", strings.NewReader(formData.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	server.handleReconnect(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a path as profile ID, got %d", rr.Code)
+	}
+}
+
+func TestHandleScanSSIDs(t *testing.T) {
+	mockScan(t)
+	server := setupTestServer(t)
+	rr := httptest.NewRecorder()
+	server.handleScanSSIDs(rr, httptest.NewRequest("GET", "/api/ssids", nil))
+
+	body := rr.Body.String()
+	if strings.Count(body, "selectSSID(") != 2 {
+		t.Errorf("Expected 2 deduplicated networks, got: %s", body)
+	}
+	if strings.Index(body, "HomeWiFi") > strings.Index(body, "CoffeeShop") {
+		t.Errorf("Expected networks sorted by signal, got: %s", body)
+	}
+	if strings.Count(body, "&#128274;") != 1 {
+		t.Errorf("Expected a lock icon for the secured network only, got: %s", body)
+	}
+}
+
+func TestHandleAPIScan(t *testing.T) {
+	mockScan(t)
+	server := setupTestServer(t)
+	rr := httptest.NewRecorder()
+	server.handleAPIScan(rr, httptest.NewRequest("GET", "/api/v1/scan", nil))
+
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Unexpected response: %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	var resp struct {
+		Networks []scan.Network `json:"networks"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("Could not decode response: %v", err)
+	}
+	if len(resp.Networks) != 2 || resp.Networks[0].BSSID != "aa:bb:cc:00:00:02" || resp.Networks[0].Band != "5GHz" {
+		t.Errorf("Unexpected networks: %+v", resp.Networks)
+	}
+	if resp.Networks[1].Security != scan.SecurityOpen {
+		t.Errorf("Expected CoffeeShop to be open, got %s", resp.Networks[1].Security)
+	}
+}
+
+func TestHandleAPISetPriority(t *testing.T) {
+	cleanupNetDirs := setupTestNetDirs(t)
+	defer cleanupNetDirs()
+	server := setupTestServer(t)
+	store := profiles.NewStore(savedNetworksDir)
+	store.Save(profiles.New("HomeWiFi", "secret123"))
+
+	put := func(id, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/api/v1/networks/"+id+"/priority", strings.NewReader(body))
+		req.SetPathValue("id", id)
+		rr := httptest.NewRecorder()
+		server.handleAPISetPriority(rr, req)
+		return rr
+	}
+	if rr := put(profiles.ID("HomeWiFi"), `{"priority": 7}`); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"priority":7`) {
+		t.Errorf("Unexpected response: %d %s", rr.Code, rr.Body.String())
+	}
+	if p, _ := store.Find("HomeWiFi"); p.Priority != 7 {
+		t.Errorf("Expected priority 7 to be saved, got %d", p.Priority)
+	}
+	if rr := put(profiles.ID("HomeWiFi"), `{}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a priority, got %d", rr.Code)
+	}
+	if rr := put(profiles.ID("HomeWiFi"), `{"priorty": 1}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown field, got %d", rr.Code)
+	}
+	if rr := put("../etc", `{"priority": 1}`); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown network, got %d", rr.Code)
+	}
+
+	rr := httptest.NewRecorder()
+	server.handleAPINetworks(rr, httptest.NewRequest("GET", "/api/v1/networks", nil))
+	if !strings.Contains(rr.Body.String(), `"ssid":"HomeWiFi"`) || strings.Contains(rr.Body.String(), "secret") {
+		t.Errorf("Unexpected saved network list: %s", rr.Body.String())
+	}
+}
+
+func TestScanResultsUseCache(t *testing.T) {
+	scans := mockScan(t)
+	server := setupTestServer(t)
+
+	for i := 0; i < 3; i++ {
+		server.handleScanSSIDs(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/ssids", nil))
+	}
+	if *scans != 1 {
+		t.Errorf("Expected polling to be served from the cache after the first scan, got %d scans", *scans)
+	}
+
+	server.handleAPIScan(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/scan?refresh=1", nil))
+	if *scans != 2 {
+		t.Errorf("Expected refresh=1 to trigger a scan, got %d scans", *scans)
+	}
+
+	// A failed refresh still lists the networks of the last scan.
+	scan.ExecCommand = func(name string, arg ...string) *exec.Cmd { return exec.Command("false") }
+	rr := httptest.NewRecorder()
+	server.handleScanSSIDs(rr, httptest.NewRequest("GET", "/api/ssids?refresh=1", nil))
+	if body := rr.Body.String(); !strings.Contains(body, "from the last scan") || !strings.Contains(body, "ssid-item") {
+		t.Errorf("Expected the cached networks after a failed refresh, got: %s", body)
+	}
+}
+
+func TestHandleHealth(t *testing.T) {
+	server := setupTestServer(t)
+	online := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer online.Close()
+	server.Probes = &probe.Set{Probes: []probe.Probe{&probe.HTTP{URL: online.URL}}, Mode: probe.ModeAny}
+
+	// In hotspot mode only the state is reported.
+	rr := httptest.NewRecorder()
+	server.handleAPIHealth(rr, httptest.NewRequest("GET", "/api/v1/health", nil))
+	if !strings.Contains(rr.Body.String(), `"state":"hotspot"`) || strings.Contains(rr.Body.String(), `"report"`) {
+		t.Errorf("Unexpected hotspot health: %s", rr.Body.String())
+	}
+
+	server.State.Force(state.Client, "test")
+	rr = httptest.NewRecorder()
+	server.handleAPIHealth(rr, httptest.NewRequest("GET", "/api/v1/health", nil))
+	if !strings.Contains(rr.Body.String(), `"verdict":"ok"`) || !strings.Contains(rr.Body.String(), `"layer":"link"`) {
+		t.Errorf("Unexpected client health: %s", rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	server.handleHealth(rr, httptest.NewRequest("GET", "/api/health", nil))
+	if !strings.Contains(rr.Body.String(), "Online") || !strings.Contains(rr.Body.String(), "http "+online.URL) {
+		t.Errorf("Unexpected health fragment: %s", rr.Body.String())
+	}
+
+	// The labels come from the language file.
+	langFile := filepath.Join(server.AppConfig.Paths.LocalesDir, "en.yaml")
+	lang, _ := os.ReadFile(langFile)
+	os.WriteFile(langFile, append(lang, "health_online: \"Connected\"\n"...), 0644)
+	rr = httptest.NewRecorder()
+	server.handleHealth(rr, httptest.NewRequest("GET", "/api/health", nil))
+	if !strings.Contains(rr.Body.String(), "Connected") {
+		t.Errorf("Expected the localized label, got: %s", rr.Body.String())
+	}
+}
+
+// apiRequest sends a request through the server's routes.
+func apiRequest(server *Server, method, path, body string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rr
+}
+
+func TestAPINetworks(t *testing.T) {
+	cleanupNetDirs := setupTestNetDirs(t)
+	defer cleanupNetDirs()
+	server := setupTestServer(t)
+	id := profiles.ID("HomeWiFi")
+
+	rr := apiRequest(server, "POST", "/api/v1/networks", `{"ssid": "HomeWiFi", "password": "secret123", "priority": 3}`)
+	if rr.Code != http.StatusCreated || rr.Header().Get("Location") != "/api/v1/networks/"+id {
+		t.Fatalf("Unexpected create response: %d %s", rr.Code, rr.Body.String())
+	}
+	if p, err := profiles.NewStore(savedNetworksDir).Find("HomeWiFi"); err != nil || p.Priority != 3 || p.Security != profiles.SecurityWPA2PSK {
+		t.Errorf("Unexpected saved profile: %+v (err: %v)", p, err)
+	}
+	if c := server.Backend.(*network.Fake).Config(); c.SSID != "" {
+		t.Errorf("Creating a network should not connect to it, got %+v", c)
+	}
+	if rr := apiRequest(server, "POST", "/api/v1/networks", `{"ssid": "HomeWiFi"}`); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a network that is already saved, got %d", rr.Code)
+	}
+	if rr := apiRequest(server, "POST", "/api/v1/networks", `{"ssid": "HomeWiFi", "pasword": "typo"}`); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), `"error"`) {
+		t.Errorf("Expected a JSON 400 for an unknown field, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr = apiRequest(server, "PATCH", "/api/v1/networks/"+id, `{"autoconnect": false, "ip": {"mode": "static", "address": "192.168.1.150/24", "gateway": "192.168.1.1"}}`)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"autoconnect":false`) || !strings.Contains(rr.Body.String(), `"address":"192.168.1.150/24"`) {
+		t.Errorf("Unexpected update response: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := apiRequest(server, "PATCH", "/api/v1/networks/"+id, `{"ip": {"mode": "static", "address": "not-an-ip"}}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for invalid IP settings, got %d", rr.Code)
+	}
+	rr = apiRequest(server, "GET", "/api/v1/networks/"+id, "")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"priority":3`) || strings.Contains(rr.Body.String(), "secret") {
+		t.Errorf("Unexpected network: %d %s", rr.Code, rr.Body.String())
+	}
+
+	server.State.RecordSuccess(id)
+	if rr := apiRequest(server, "DELETE", "/api/v1/networks/"+id, ""); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 on delete, got %d %s", rr.Code, rr.Body.String())
+	}
+	if server.State.LastGood() != "" {
+		t.Errorf("Expected the deleted network to be forgotten, got last-good %q", server.State.LastGood())
+	}
+	for _, method := range []string{"GET", "DELETE"} {
+		if rr := apiRequest(server, method, "/api/v1/networks/"+id, ""); rr.Code != http.StatusNotFound || rr.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("Expected a JSON 404 for %s of a deleted network, got %d", method, rr.Code)
+		}
+	}
+	if rr := apiRequest(server, "GET", "/api/v1/nothing", ""); rr.Code != http.StatusNotFound || !strings.Contains(rr.Body.String(), `"error"`) {
+		t.Errorf("Expected a JSON 404 for an unknown endpoint, got %d %s", rr.Code, rr.Body.String())
+	}
+	rr = apiRequest(server, "PATCH", "/api/v1/networks/"+id+"/priority", "")
+	if rr.Code != http.StatusMethodNotAllowed || rr.Header().Get("Allow") != "PUT" || !strings.Contains(rr.Body.String(), `"error"`) {
+		t.Errorf("Expected a JSON 405 allowing PUT, got %d %q %s", rr.Code, rr.Header().Get("Allow"), rr.Body.String())
+	}
+}
+
+func TestAPIConnect(t *testing.T) {
+	cleanupNetDirs := setupTestNetDirs(t)
+	defer cleanupNetDirs()
+	server := setupTestServer(t)
+
+	if rr := apiRequest(server, "POST", "/api/v1/connect", `{"password": "secret123"}`); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "SSID cannot be empty") {
+		t.Errorf("Expected 400 without an SSID, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	release, _ := server.State.Acquire("connect")
+	if rr := apiRequest(server, "POST", "/api/v1/connect", `{"ssid": "HomeWiFi", "password": "secret123"}`); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 while another attempt runs, got %d", rr.Code)
+	}
+	release()
+
+	rr := apiRequest(server, "POST", "/api/v1/connect", `{"ssid": "HomeWiFi", "password": "secret123", "security": "wpa3-sae", "hidden": true}`)
+	server.pending.Wait()
+	if rr.Code != http.StatusAccepted || !strings.Contains(rr.Body.String(), `"security":"wpa3-sae"`) {
+		t.Errorf("Unexpected connect response: %d %s", rr.Code, rr.Body.String())
+	}
+	if c := server.Backend.(*network.Fake).Config(); c.SSID != "HomeWiFi" || !c.Hidden || c.Security != profiles.SecurityWPA3SAE {
+		t.Errorf("Unexpected network applied: %+v", c)
+	}
+
+	rr = apiRequest(server, "GET", "/api/v1/status", "")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"state":"client"`) || !strings.Contains(rr.Body.String(), `"last_good":"`+profiles.ID("HomeWiFi")+`"`) {
+		t.Errorf("Unexpected status: %d %s", rr.Code, rr.Body.String())
+	}
+
+	if rr := apiRequest(server, "POST", "/api/v1/networks/"+profiles.ID("HomeWiFi")+"/connect", ""); rr.Code != http.StatusAccepted {
+		t.Errorf("Expected 202 on reconnect, got %d %s", rr.Code, rr.Body.String())
+	}
+	server.pending.Wait()
+	if rr := apiRequest(server, "POST", "/api/v1/networks/Nowhere-000000000000/connect", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 on reconnect to an unknown network, got %d", rr.Code)
+	}
+}
+
+func TestAPIConfigAndVersion(t *testing.T) {
+	server := setupTestServer(t)
+	server.AppConfig.Network.ApPassword = "hotspot-secret"
+
+	rr := apiRequest(server, "GET", "/api/v1/config", "")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"wireless_interface":"wlan_test"`) || strings.Contains(rr.Body.String(), "hotspot-secret") {
+		t.Errorf("Unexpected config: %d %s", rr.Code, rr.Body.String())
+	}
+	rr = apiRequest(server, "GET", "/api/v1/version", "")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"version":"`+Version+`"`) {
+		t.Errorf("Unexpected version: %d %s", rr.Code, rr.Body.String())
 	}
 }
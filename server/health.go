@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"pifigo/internal/locale"
+	"pifigo/internal/probe"
+	"pifigo/internal/state"
+)
+
+// healthView is the connection state and, in client mode, the diagnosis of
+// the connection.
+type healthView struct {
+	State  state.State   `json:"state"`
+	Since  time.Time     `json:"since"`
+	Reason string        `json:"reason"`
+	Report *probe.Report `json:"report,omitempty"`
+}
+
+// health diagnoses the client connection. The probes only run in client
+// mode; in hotspot mode the reason for the last transition explains why.
+func (s *Server) health(ctx context.Context) healthView {
+	since, reason := s.State.Since()
+	v := healthView{State: s.State.Current(), Since: since, Reason: reason}
+	if !v.State.IsClient() {
+		return v
+	}
+	st, err := s.Backend.Status()
+	if err != nil {
+		log.Printf("WARNING: Could not read the interface status: %v", err)
+	}
+	report := probe.Diagnose(ctx, s.Probes, st, s.AppConfig.Network.WirelessInterface)
+	v.Report = &report
+	return v
+}
+
+// healthStrings are the labels of the health card.
+type healthStrings struct {
+	Online, Offline, Connecting, Hotspot string
+}
+
+// newHealthStrings returns the health card labels in the configured
+// language, with English for any string the language file lacks.
+func (s *Server) newHealthStrings() healthStrings {
+	labels := healthStrings{Online: "Online", Offline: "Offline:", Connecting: "Connecting", Hotspot: "Hotspot mode"}
+	langFilePath := filepath.Join(s.AppConfig.Paths.LocalesDir, s.AppConfig.Language+".yaml")
+	if lang, err := locale.LoadLanguageStrings(langFilePath); err == nil {
+		for _, v := range []struct {
+			dst *string
+			src string
+		}{
+			{&labels.Online, lang.HealthOnline},
+			{&labels.Offline, lang.HealthOffline},
+			{&labels.Connecting, lang.HealthConnecting},
+			{&labels.Hotspot, lang.HealthHotspot},
+		} {
+			if v.src != "" {
+				*v.dst = v.src
+			}
+		}
+	}
+	return labels
+}
+
+// healthTemplate renders the health card as an HTMX fragment.
+var healthTemplate = template.Must(template.New("health").Parse(`{{if .Report}}{{if .Report.Online}}<p class="font-semibold text-green-600">{{.Strings.Online}}</p>{{else}}<p class="font-semibold text-red-600">{{.Strings.Offline}} {{.Report.Verdict}}</p>{{end}}
+<ul class="mt-2 space-y-1 text-sm">{{range .Report.Checks}}
+    <li class="flex justify-between gap-4"><span>{{if .Skipped}}&#8211;{{else if .OK}}&#10003;{{else}}&#10007;{{end}} {{.Name}}</span><span class="text-stone-500 truncate">{{.Detail}}</span></li>{{end}}
+</ul>{{else}}<p class="font-semibold">{{if eq .State "connecting"}}{{.Strings.Connecting}}{{else}}{{.Strings.Hotspot}}{{end}}</p>
+{{if .Reason}}<p class="text-sm text-stone-500">{{.Reason}}</p>{{end}}{{end}}`))
+
+// handleHealth returns the health card as an HTML fragment for HTMX.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		healthView
+		Strings healthStrings
+	}{s.health(r.Context()), s.newHealthStrings()}
+	w.Header().Set("Content-Type", "text/html")
+	if err := healthTemplate.Execute(w, data); err != nil {
+		log.Printf("ERROR: Failed to render health: %v", err)
+	}
+}
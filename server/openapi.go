@@ -0,0 +1,242 @@
+package server
+
+import (
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"pifigo/internal/config"
+)
+
+// apiRoute is one endpoint of the JSON API. Handler registers the API from
+// this table and the OpenAPI document is generated from it, so the two
+// cannot drift apart.
+type apiRoute struct {
+	Method    string
+	Path      string
+	Summary   string
+	Handler   http.HandlerFunc
+	Public    bool              // Reachable without logging in when an admin password is set.
+	Query     map[string]string // Query parameters and their descriptions.
+	Request   any               // Value of the JSON body's type; nil if the request has no body.
+	Responses map[int]any       // Value of the body's type by status; nil for no body.
+}
+
+// responses returns the responses of a route: the body sent on success and
+// an apiError for each error status.
+func responses(status int, body any, errorStatuses ...int) map[int]any {
+	r := map[int]any{status: body}
+	for _, code := range errorStatuses {
+		r[code] = apiError{}
+	}
+	return r
+}
+
+// apiRoutes lists the endpoints of the JSON API.
+func (s *Server) apiRoutes() []apiRoute {
+	const (
+		badRequest = http.StatusBadRequest
+		notFound   = http.StatusNotFound
+		conflict   = http.StatusConflict
+		invalid    = http.StatusUnprocessableEntity
+		internal   = http.StatusInternalServerError
+	)
+	return []apiRoute{
+		{Method: "POST", Path: "/api/v1/login", Summary: "Exchange the admin password for a bearer token.", Handler: s.handleAPILogin, Public: true,
+			Request: loginRequest{}, Responses: responses(http.StatusOK, loginResponse{}, badRequest, http.StatusUnauthorized, http.StatusTooManyRequests)},
+		{Method: "POST", Path: "/api/v1/logout", Summary: "Revoke the bearer token of the request.", Handler: s.handleAPILogout,
+			Responses: responses(http.StatusNoContent, nil)},
+		{Method: "GET", Path: "/api/v1/scan", Summary: "List the visible networks, strongest first.", Handler: s.handleAPIScan,
+			Query:     map[string]string{"refresh": "Set to 1 to scan now instead of returning the cached results."},
+			Responses: responses(http.StatusOK, scanResult{}, http.StatusServiceUnavailable)},
+		{Method: "GET", Path: "/api/v1/networks", Summary: "List the saved networks.", Handler: s.handleAPINetworks,
+			Responses: responses(http.StatusOK, networkList{}, internal)},
+		{Method: "POST", Path: "/api/v1/networks", Summary: "Save a network without connecting to it.", Handler: s.handleAPICreateNetwork,
+			Request: networkRequest{}, Responses: responses(http.StatusCreated, savedNetwork{}, badRequest, conflict, invalid, internal)},
+		{Method: "GET", Path: "/api/v1/networks/{id}", Summary: "Get a saved network.", Handler: s.handleAPIGetNetwork,
+			Responses: responses(http.StatusOK, savedNetwork{}, notFound, internal)},
+		{Method: "PATCH", Path: "/api/v1/networks/{id}", Summary: "Change the given fields of a saved network.", Handler: s.handleAPIUpdateNetwork,
+			Request: networkUpdate{}, Responses: responses(http.StatusOK, savedNetwork{}, badRequest, notFound, invalid, internal)},
+		{Method: "DELETE", Path: "/api/v1/networks/{id}", Summary: "Forget a saved network.", Handler: s.handleAPIDeleteNetwork,
+			Responses: responses(http.StatusNoContent, nil, notFound, internal)},
+		{Method: "PUT", Path: "/api/v1/networks/{id}/priority", Summary: "Set the auto-connect priority of a saved network.", Handler: s.handleAPISetPriority,
+			Request: priorityRequest{}, Responses: responses(http.StatusOK, savedNetwork{}, badRequest, notFound, invalid, internal)},
+		{Method: "POST", Path: "/api/v1/networks/{id}/connect", Summary: "Start connecting to a saved network.", Handler: s.handleAPIReconnect,
+			Responses: responses(http.StatusAccepted, savedNetwork{}, notFound, conflict, internal)},
+		{Method: "POST", Path: "/api/v1/connect", Summary: "Start a verified connect to a network; the network is saved once it works.", Handler: s.handleAPIConnect,
+			Request: networkRequest{}, Responses: responses(http.StatusAccepted, savedNetwork{}, badRequest, conflict, invalid)},
+		{Method: "GET", Path: "/api/v1/status", Summary: "Get the connection state.", Handler: s.handleAPIStatus,
+			Responses: responses(http.StatusOK, statusView{})},
+		{Method: "GET", Path: "/api/v1/health", Summary: "Diagnose the client connection layer by layer.", Handler: s.handleAPIHealth,
+			Responses: responses(http.StatusOK, healthView{})},
+		{Method: "GET", Path: "/api/v1/config", Summary: "Get the configuration, without secrets.", Handler: s.handleAPIConfig,
+			Responses: responses(http.StatusOK, configView{})},
+		{Method: "GET", Path: "/api/v1/config/full", Summary: "Get the whole configuration, without secrets. Only served once an admin password is set.", Handler: s.handleAPIFullConfig,
+			Responses: responses(http.StatusOK, config.Config{}, http.StatusForbidden)},
+		{Method: "GET", Path: "/api/v1/version", Summary: "Get the pifigo and API versions.", Handler: s.handleAPIVersion,
+			Responses: responses(http.StatusOK, versionInfo{})},
+		{Method: "GET", Path: "/api/v1/openapi.json", Summary: "Get this OpenAPI document.", Handler: s.handleAPIOpenAPI, Public: true,
+			Responses: responses(http.StatusOK, map[string]any{})},
+	}
+}
+
+// handleAPIOpenAPI serves the OpenAPI document of the JSON API.
+func (s *Server) handleAPIOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.openAPI())
+}
+
+// openAPI generates the OpenAPI 3 document of the JSON API from its routes.
+func (s *Server) openAPI() map[string]any {
+	components := schemas{}
+	paths := map[string]map[string]any{}
+	for _, rt := range s.apiRoutes() {
+		op := map[string]any{"summary": rt.Summary}
+		var params []any
+		for _, name := range pathParams(rt.Path) {
+			params = append(params, map[string]any{"name": name, "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+		}
+		for _, name := range slices.Sorted(maps.Keys(rt.Query)) {
+			params = append(params, map[string]any{"name": name, "in": "query", "description": rt.Query[name], "schema": map[string]any{"type": "string"}})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+		if rt.Request != nil {
+			op["requestBody"] = map[string]any{"required": true, "content": jsonContent(components.of(reflect.TypeOf(rt.Request)))}
+		}
+		resps := map[string]any{}
+		for status, body := range rt.Responses {
+			resp := map[string]any{"description": http.StatusText(status)}
+			if body != nil {
+				resp["content"] = jsonContent(components.of(reflect.TypeOf(body)))
+			}
+			resps[strconv.Itoa(status)] = resp
+		}
+		if rt.Public {
+			op["security"] = []any{}
+		} else {
+			// Once an admin password is set, every other route needs a token.
+			resps[strconv.Itoa(http.StatusUnauthorized)] = map[string]any{"description": "Not logged in.", "content": jsonContent(components.of(reflect.TypeOf(apiError{})))}
+		}
+		op["responses"] = resps
+		if paths[rt.Path] == nil {
+			paths[rt.Path] = map[string]any{}
+		}
+		paths[rt.Path][strings.ToLower(rt.Method)] = op
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "pifigo API",
+			"version":     Version,
+			"description": "Provisioning and status API of the pifigo Wi-Fi setup portal. Errors are returned as an ApiError body. Once an admin password is set, log in with POST /api/v1/login and send the token as a bearer token.",
+		},
+		"paths":    paths,
+		"security": []any{map[string]any{"bearerAuth": []any{}}},
+		"components": map[string]any{
+			"schemas":         components,
+			"securitySchemes": map[string]any{"bearerAuth": map[string]any{"type": "http", "scheme": "bearer"}},
+		},
+	}
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+// pathParams returns the names of the {wildcards} in a route path.
+func pathParams(path string) []string {
+	var names []string
+	for _, seg := range strings.Split(path, "/") {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			names = append(names, strings.TrimSuffix(seg[1:len(seg)-1], "..."))
+		}
+	}
+	return names
+}
+
+// schemas collects the JSON schemas of named struct types, keyed by their
+// component name.
+type schemas map[string]any
+
+// of returns the JSON schema of a type as encoding/json encodes it. Named
+// structs are added to the components and referenced.
+func (c schemas) of(t reflect.Type) map[string]any {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return c.of(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": c.of(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": c.of(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return c.object(t)
+		}
+		name := schemaName(t)
+		if _, ok := c[name]; !ok {
+			c[name] = nil // Marks the type as seen while its fields are walked.
+			c[name] = c.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+// object returns the schema of a struct's exported fields. Fields without
+// omitempty or omitzero are always encoded, so they are required; slices and
+// maps among them may be null.
+func (c schemas) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = c.of(f.Type)
+		if !strings.Contains(opts, "omitempty") && !strings.Contains(opts, "omitzero") {
+			required = append(required, name)
+			// A nil slice or map is encoded as null.
+			if k := f.Type.Kind(); k == reflect.Slice || k == reflect.Map {
+				props[name].(map[string]any)["nullable"] = true
+			}
+		}
+	}
+	o := map[string]any{"type": "object", "properties": props, "additionalProperties": false}
+	if required != nil {
+		o["required"] = required
+	}
+	return o
+}
+
+// schemaName is the component name of a type: its Go name, capitalized.
+func schemaName(t reflect.Type) string {
+	r, size := utf8.DecodeRuneInString(t.Name())
+	return string(unicode.ToUpper(r)) + t.Name()[size:]
+}
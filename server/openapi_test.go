@@ -0,0 +1,231 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"pifigo/internal/profiles"
+	"pifigo/internal/state"
+)
+
+// loadSpec fetches the OpenAPI document the way a client would.
+func loadSpec(t *testing.T, server *Server) map[string]any {
+	rr := apiRequest(server, "GET", "/api/v1/openapi.json", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Could not fetch the OpenAPI document: %d %s", rr.Code, rr.Body.String())
+	}
+	var spec map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("OpenAPI document is not JSON: %v", err)
+	}
+	return spec
+}
+
+// operation returns the spec's operation for a method and path, or nil.
+func operation(spec map[string]any, method, path string) map[string]any {
+	item, _ := spec["paths"].(map[string]any)[path].(map[string]any)
+	op, _ := item[strings.ToLower(method)].(map[string]any)
+	return op
+}
+
+// TestOpenAPIDescribesRoutes verifies every /api/v1 route is in the spec:
+// those registered from the route table, and any registered by hand.
+func TestOpenAPIDescribesRoutes(t *testing.T) {
+	server := setupTestServer(t)
+	spec := loadSpec(t, server)
+	if spec["openapi"] != "3.0.3" {
+		t.Errorf("Unexpected OpenAPI version: %v", spec["openapi"])
+	}
+
+	for _, rt := range server.apiRoutes() {
+		op := operation(spec, rt.Method, rt.Path)
+		if op == nil {
+			t.Errorf("%s %s is not in the spec", rt.Method, rt.Path)
+			continue
+		}
+		for status := range rt.Responses {
+			if _, ok := op["responses"].(map[string]any)[strconv.Itoa(status)]; !ok {
+				t.Errorf("%s %s: response %d is not in the spec", rt.Method, rt.Path, status)
+			}
+		}
+		if len(pathParams(rt.Path)) > 0 && op["parameters"] == nil {
+			t.Errorf("%s %s: path parameters are not in the spec", rt.Method, rt.Path)
+		}
+	}
+
+	files, _ := filepath.Glob("*.go")
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", name, err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) == 0 {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			lit, isLit := call.Args[0].(*ast.BasicLit)
+			if !ok || !isLit || (sel.Sel.Name != "HandleFunc" && sel.Sel.Name != "Handle") {
+				return true
+			}
+			pattern, _ := strconv.Unquote(lit.Value)
+			method, path, found := strings.Cut(pattern, " ")
+			if !found {
+				method, path = "GET", pattern
+			}
+			if strings.HasPrefix(path, "/api/v1/") && path != "/api/v1/" && operation(spec, method, path) == nil {
+				t.Errorf("%s registers %q, which is not in the spec", fset.Position(lit.Pos()), pattern)
+			}
+			return true
+		})
+	}
+}
+
+// validate checks a decoded JSON value against a schema of the spec and
+// returns the problems found. Fields the schema does not describe are
+// problems, as are missing required ones.
+func validate(spec map[string]any, schema map[string]any, v any, where string) (problems []string) {
+	fail := func(format string, a ...any) { problems = append(problems, where+": "+fmt.Sprintf(format, a...)) }
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		resolved, ok := spec["components"].(map[string]any)["schemas"].(map[string]any)[name].(map[string]any)
+		if !ok {
+			fail("unresolved schema %s", ref)
+			return problems
+		}
+		schema = resolved
+	}
+	if v == nil && schema["nullable"] == true {
+		return problems
+	}
+	switch schema["type"] {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			fail("expected an object, got %v", v)
+			return problems
+		}
+		props, _ := schema["properties"].(map[string]any)
+		for key, value := range obj {
+			if p, ok := props[key].(map[string]any); ok {
+				problems = append(problems, validate(spec, p, value, where+"."+key)...)
+			} else if extra, ok := schema["additionalProperties"].(map[string]any); ok {
+				problems = append(problems, validate(spec, extra, value, where+"."+key)...)
+			} else if props != nil || schema["additionalProperties"] == false {
+				fail("field %q is not in the spec", key)
+			}
+		}
+		required, _ := schema["required"].([]any)
+		for _, key := range required {
+			if _, ok := obj[key.(string)]; !ok {
+				fail("required field %q is missing", key)
+			}
+		}
+	case "array":
+		items, ok := v.([]any)
+		if !ok {
+			fail("expected an array, got %v", v)
+			return problems
+		}
+		for i, item := range items {
+			problems = append(problems, validate(spec, schema["items"].(map[string]any), item, where+"["+strconv.Itoa(i)+"]")...)
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			fail("expected a string, got %v", v)
+		}
+	case "integer", "number":
+		if _, ok := v.(float64); !ok {
+			fail("expected a number, got %v", v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			fail("expected a boolean, got %v", v)
+		}
+	}
+	return problems
+}
+
+// TestOpenAPIDescribesResponses calls the API and checks every status and
+// body it returns against the spec.
+func TestOpenAPIDescribesResponses(t *testing.T) {
+	cleanupNetDirs := setupTestNetDirs(t)
+	defer cleanupNetDirs()
+	mockScan(t)
+	server := setupTestServer(t)
+	spec := loadSpec(t, server)
+	id := profiles.ID("HomeWiFi")
+	profiles.NewStore(savedNetworksDir).Save(profiles.New("HomeWiFi", "secret123"))
+	server.State.RecordFailure(id, state.Failure{SSID: "HomeWiFi", Stage: "dhcp", Reason: "no lease"})
+
+	for _, c := range []struct{ method, pattern, path, body string }{
+		{"GET", "/api/v1/scan", "/api/v1/scan", ""},
+		{"GET", "/api/v1/networks", "/api/v1/networks", ""},
+		{"POST", "/api/v1/networks", "/api/v1/networks", `{"ssid": "Office", "ip": {"mode": "static", "address": "10.0.0.5/24", "gateway": "10.0.0.1"}}`},
+		{"POST", "/api/v1/networks", "/api/v1/networks", `{"ssid": "Office"}`},
+		{"POST", "/api/v1/networks", "/api/v1/networks", `{"nonsense": true}`},
+		{"GET", "/api/v1/networks/{id}", "/api/v1/networks/" + profiles.ID("Office"), ""},
+		{"GET", "/api/v1/networks/{id}", "/api/v1/networks/unknown-000000000000", ""},
+		{"PATCH", "/api/v1/networks/{id}", "/api/v1/networks/" + id, `{"hidden": true}`},
+		{"PUT", "/api/v1/networks/{id}/priority", "/api/v1/networks/" + id + "/priority", `{"priority": 2}`},
+		{"DELETE", "/api/v1/networks/{id}", "/api/v1/networks/" + profiles.ID("Office"), ""},
+		{"POST", "/api/v1/connect", "/api/v1/connect", `{"ssid": ""}`},
+		{"POST", "/api/v1/networks/{id}/connect", "/api/v1/networks/" + id + "/connect", ""},
+		{"GET", "/api/v1/status", "/api/v1/status", ""},
+		{"GET", "/api/v1/health", "/api/v1/health", ""},
+		{"GET", "/api/v1/config", "/api/v1/config", ""},
+		{"GET", "/api/v1/config/full", "/api/v1/config/full", ""},
+		{"GET", "/api/v1/version", "/api/v1/version", ""},
+		{"POST", "/api/v1/login", "/api/v1/login", `{"password": "secret"}`},
+		{"POST", "/api/v1/logout", "/api/v1/logout", ""},
+	} {
+		rr := apiRequest(server, c.method, c.path, c.body)
+		server.pending.Wait()
+		where := c.method + " " + c.path
+		op := operation(spec, c.method, c.pattern)
+		if op == nil {
+			t.Errorf("%s: no operation %s %s in the spec", where, c.method, c.pattern)
+			continue
+		}
+		resp, ok := op["responses"].(map[string]any)[strconv.Itoa(rr.Code)].(map[string]any)
+		if !ok {
+			t.Errorf("%s: status %d is not in the spec (%s)", where, rr.Code, rr.Body.String())
+			continue
+		}
+		content, hasBody := resp["content"].(map[string]any)
+		if !hasBody {
+			if rr.Body.Len() != 0 {
+				t.Errorf("%s: expected no body, got %s", where, rr.Body.String())
+			}
+			continue
+		}
+		var body any
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: body is not JSON: %v", where, err)
+			continue
+		}
+		schema := content["application/json"].(map[string]any)["schema"].(map[string]any)
+		for _, p := range validate(spec, schema, body, where) {
+			t.Error(p)
+		}
+	}
+
+	// A field the spec does not describe must be caught.
+	undocumented := map[string]any{"version": "1", "api": "v1", "extra": 1}
+	if problems := validate(spec, map[string]any{"$ref": "#/components/schemas/VersionInfo"}, undocumented, "version"); len(problems) != 1 {
+		t.Errorf("Expected the undocumented field to be reported, got %v", problems)
+	}
+}
@@ -1,45 +1,202 @@
 package server
 
 import (
+	"context"
+	"fmt"
+	"io/fs"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"pifigo/internal/config"
+	"pifigo/internal/network"
+	"pifigo/internal/probe"
+	"pifigo/internal/scan"
+	"pifigo/internal/state"
+	"pifigo/web"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Server holds all dependencies for the web server, including the channel
-// to signal the boot manager.
+const (
+	// DefaultAddr is where the portal listens unless Server.Addr is changed.
+	DefaultAddr = ":80"
+	// defaultScanInterval is used when scan.interval_seconds is not set.
+	defaultScanInterval = 30 * time.Second
+	// shutdownTimeout bounds how long open requests may take to finish.
+	shutdownTimeout = 10 * time.Second
+)
+
+// Version is reported by the API. main sets it to the release version.
+var Version = "dev"
+
+// Server holds all dependencies for the web server, including the network
+// backend and the connection state machine.
 type Server struct {
-	AppConfig  *config.Config
-	StopSignal chan<- bool // The channel is write-only from the server's perspective.
+	AppConfig *config.Config
+	Backend   network.NetworkBackend
+	Scans     *scan.Cache
+	Probes    *probe.Set // Connectivity probes for the health report.
+	Addr      string     // Address to listen on; DefaultAddr unless changed.
+	State     *state.Machine
+	Validator network.CredentialValidator // Checks credentials before connecting; nil skips the check.
+
+	pending      sync.WaitGroup // Connection attempts running in the background.
+	lastActivity atomic.Int64   // Unix nanoseconds of the last request; 0 if none yet.
+	auth         sessionStore   // Admin sessions, used once an admin password is set.
 }
 
 // NewServer creates and returns a new Server instance.
-func NewServer(cfg *config.Config, stopSignal chan<- bool) *Server {
-	return &Server{
-		AppConfig:  cfg,
-		StopSignal: stopSignal,
+func NewServer(cfg *config.Config, backend network.NetworkBackend, machine *state.Machine) *Server {
+	// Scans use ap-force while the hotspot is up, since the interface is
+	// then operating as an access point.
+	apForce := func() bool { return machine.Current().IsHotspot() }
+	s := &Server{
+		AppConfig: cfg,
+		Backend:   backend,
+		Scans:     scan.NewCache(cfg.Network.WirelessInterface, apForce),
+		Probes:    probe.FromConfig(cfg),
+		Addr:      DefaultAddr,
+		State:     machine,
 	}
+	if cfg.Network.ValidateCredentials {
+		s.Validator = network.NewValidator(cfg.Network.WirelessInterface, 0)
+	}
+	return s
 }
 
-// Start registers all routes and starts the web server.
-func (s *Server) Start() {
-	// Serve static files (index.html, etc.) from the configured web_root.
-	fs := http.FileServer(http.Dir(s.AppConfig.Paths.WebRoot))
-	http.Handle("/", fs)
+// Start starts the background scanner and serves the portal on s.Addr until
+// ctx is done. It then drains open requests with http.Server.Shutdown and
+// waits for connection attempts in progress, so none is cut off half
+// applied. It returns an error if the server cannot listen or fails.
+func (s *Server) Start(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on %s: %w", s.Addr, err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	interval := time.Duration(s.AppConfig.Scan.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultScanInterval
+	}
+	var scanner sync.WaitGroup
+	scanner.Add(1)
+	go func() {
+		defer scanner.Done()
+		s.Scans.Run(ctx, interval)
+	}()
+	defer scanner.Wait()
+
+	httpServer := &http.Server{Handler: s.Handler()}
+	served := make(chan error, 1)
+	go func() { served <- httpServer.Serve(ln) }()
+	log.Printf("Starting pifigo web server on http://%s", ln.Addr())
+	switch _, dir := s.webRoot(); {
+	case dir != "":
+		log.Printf("Serving web assets from '%s'", dir)
+	case s.AppConfig.Paths.WebRoot != "":
+		log.Printf("WARNING: web_root '%s' has no index.html. Serving the web assets built into pifigo instead.", s.AppConfig.Paths.WebRoot)
+	default:
+		log.Println("Serving the web assets built into pifigo")
+	}
+
+	select {
+	case err := <-served:
+		return fmt.Errorf("web server failed: %w", err)
+	case <-ctx.Done():
+	}
+	log.Println("Shutting down the web server...")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	err = httpServer.Shutdown(shutdownCtx)
+	s.pending.Wait()
+	return err
+}
+
+// webRoot returns the portal's pages and the directory they are served
+// from: the web_root directory if one is configured, otherwise the pages
+// built into the binary and "". A web_root without an index.html falls back
+// to the built-in pages too; upgraded installs still name /var/www/pifigo,
+// which the package no longer ships.
+func (s *Server) webRoot() (fs.FS, string) {
+	dir := s.AppConfig.Paths.WebRoot
+	if dir == "" {
+		return web.Files, ""
+	}
+	if _, err := os.Stat(filepath.Join(dir, "index.html")); err != nil {
+		return web.Files, ""
+	}
+	return os.DirFS(dir), dir
+}
+
+// Handler returns the portal's routes, with portal use tracked and, once an
+// admin password is set, a login required.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	// Serve static files (index.html, etc.) from the configured web_root, or
+	// the ones built into the binary.
+	root, _ := s.webRoot()
+	mux.Handle("/", http.FileServer(http.FS(root)))
 
 	// Register API endpoints to their handler methods.
-	http.HandleFunc("/api/data", s.serveDataAPI)
-	http.HandleFunc("/api/ssids", s.handleScanSSIDs)
-	http.HandleFunc("/connect", s.handleConnect)
+	mux.HandleFunc("/api/data", s.serveDataAPI)
+	mux.HandleFunc("/api/ssids", s.handleScanSSIDs)
+	mux.HandleFunc("/connect", s.handleConnect)
 
 	// --- NEW ROUTES FOR SAVED CONNECTIONS ---
-	http.HandleFunc("/api/saved_networks", s.handleListSavedNetworks)
-	http.HandleFunc("/reconnect", s.handleReconnect)
+	mux.HandleFunc("/api/saved_networks", s.handleListSavedNetworks)
+	mux.HandleFunc("/reconnect", s.handleReconnect)
+	mux.HandleFunc("GET /api/health", s.handleHealth)
+
+	// Admin login, used once an admin password is set.
+	mux.HandleFunc("GET /login", s.handleLoginPage)
+	mux.HandleFunc("POST /login", s.handleLogin)
+	mux.HandleFunc("POST /logout", s.handleLogout)
+	public := map[string]bool{"GET /login": true, "POST /login": true, "GET /static/pifigo.css": true}
+
+	// Versioned JSON API, described by /api/v1/openapi.json. Other methods
+	// on a known path get a 405 rather than the catch-all's 404.
+	allowed := make(map[string][]string)
+	var paths []string
+	for _, rt := range s.apiRoutes() {
+		mux.HandleFunc(rt.Method+" "+rt.Path, rt.Handler)
+		if rt.Public {
+			public[rt.Method+" "+rt.Path] = true
+		}
+		if allowed[rt.Path] == nil {
+			paths = append(paths, rt.Path)
+		}
+		allowed[rt.Path] = append(allowed[rt.Path], rt.Method)
+	}
+	for _, path := range paths {
+		mux.Handle(path, apiMethodNotAllowed(allowed[path]))
+	}
+	mux.HandleFunc("/api/v1/", s.handleAPINotFound)
+
+	return s.trackActivity(s.requireAuth(mux, public))
+}
+
+// trackActivity records the time of every request, so the watchdog can tell
+// whether someone is using the portal.
+func (s *Server) trackActivity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lastActivity.Store(time.Now().UnixNano())
+		next.ServeHTTP(w, r)
+	})
+}
 
-	// Start the server.
-	log.Printf("Starting pifigo web server on http://0.0.0.0:80")
-	log.Printf("Serving web assets from '%s'", s.AppConfig.Paths.WebRoot)
-	if err := http.ListenAndServe(":80", nil); err != nil {
-		log.Fatalf("FATAL: ListenAndServe failed: %v", err)
+// PortalIdle returns how long ago the portal last served a request. It is
+// effectively unbounded before the first request.
+func (s *Server) PortalIdle() time.Duration {
+	last := s.lastActivity.Load()
+	if last == 0 {
+		return time.Duration(math.MaxInt64)
 	}
+	return time.Since(time.Unix(0, last))
 }
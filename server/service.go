@@ -0,0 +1,368 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"pifigo/internal/network"
+	"pifigo/internal/profiles"
+)
+
+// serviceError is an error the user can act on, such as invalid input or a
+// busy device. The portal shows its message as is and the JSON API returns
+// it in the error body, with status as the HTTP status.
+type serviceError struct {
+	status int
+	msg    string
+}
+
+func (e *serviceError) Error() string { return e.msg }
+
+func newServiceError(status int, format string, a ...any) error {
+	return &serviceError{status: status, msg: fmt.Sprintf(format, a...)}
+}
+
+// errInternal is returned for failures that are not the user's; the cause
+// is logged where it happens.
+var errInternal = newServiceError(http.StatusInternalServerError, "Internal error. See the pifigo log for details.")
+
+// errorStatus returns the HTTP status and message for an error returned by
+// the service layer.
+func errorStatus(err error) (int, string) {
+	var se *serviceError
+	if errors.As(err, &se) {
+		return se.status, se.msg
+	}
+	return errorStatus(errInternal)
+}
+
+// networkRequest describes a network to connect to or save. The connect form
+// and the JSON API both decode into it.
+type networkRequest struct {
+	SSID        string      `json:"ssid"`
+	Password    string      `json:"password,omitempty"` // The passphrase, or the password of an enterprise network.
+	Security    string      `json:"security,omitempty"` // The scan result wins for visible networks.
+	Hidden      bool        `json:"hidden,omitempty"`
+	EAP         *eapRequest `json:"eap,omitempty"` // Required when Security is eap.
+	IP          *ipSettings `json:"ip,omitempty"`  // Nil keeps the saved addressing, or the config.yaml default.
+	Priority    *int        `json:"priority,omitempty"`
+	Autoconnect *bool       `json:"autoconnect,omitempty"`
+}
+
+// eapRequest holds the 802.1X settings of an enterprise network. The
+// certificates are PEM or DER data; an empty one keeps the certificate
+// already saved for the network.
+type eapRequest struct {
+	Method            string `json:"method"`
+	Identity          string `json:"identity"`
+	AnonymousIdentity string `json:"anonymous_identity,omitempty"`
+	Phase2            string `json:"phase2,omitempty"`
+	CACert            string `json:"ca_cert,omitempty"`
+	ClientCert        string `json:"client_cert,omitempty"`
+	ClientKey         string `json:"client_key,omitempty"`
+	ClientKeyPassword string `json:"client_key_password,omitempty"`
+}
+
+// networkUpdate changes a saved network. Fields left out are kept.
+type networkUpdate struct {
+	Password    *string     `json:"password,omitempty"`
+	Hidden      *bool       `json:"hidden,omitempty"`
+	IP          *ipSettings `json:"ip,omitempty"`
+	Priority    *int        `json:"priority,omitempty"`
+	Autoconnect *bool       `json:"autoconnect,omitempty"`
+}
+
+// ipSettings is the addressing of a network as the API takes it.
+type ipSettings struct {
+	Mode    string   `json:"mode"`
+	Address string   `json:"address,omitempty"`
+	Gateway string   `json:"gateway,omitempty"`
+	DNS     []string `json:"dns,omitempty"`
+}
+
+// buildProfile turns a request into the profile to connect to or save, and
+// the certificates uploaded for it, which are not written yet. A saved
+// network keeps its settings unless the request changes them. The profile is
+// checked against the backend, so values it cannot express are refused
+// before the hotspot goes down.
+func (s *Server) buildProfile(req networkRequest) (profiles.Profile, map[string][]byte, error) {
+	if req.SSID == "" {
+		return profiles.Profile{}, nil, newServiceError(http.StatusBadRequest, "SSID cannot be empty.")
+	}
+	if len(req.SSID) > profiles.MaxSSIDLength {
+		return profiles.Profile{}, nil, newServiceError(http.StatusBadRequest, "SSID is too long.")
+	}
+	profile := profiles.New(req.SSID, req.Password)
+	if existing, err := s.profiles().Find(req.SSID); err == nil {
+		// An empty password keeps the saved credentials.
+		if req.Password != "" {
+			setPassphrase(&existing, req.Password)
+		}
+		profile = existing
+	}
+	if req.Security != "" && req.Security != profiles.SecurityEAP {
+		profile.Security = req.Security
+	}
+	if req.Hidden {
+		profile.Hidden = true
+	}
+	if security, ok := s.scannedSecurity(req.SSID); ok {
+		profile.Security = security
+	}
+	if profile.Security == profiles.SecurityOpen {
+		profile.PSK, profile.PMK = "", ""
+	}
+	var certs map[string][]byte
+	if req.Security == profiles.SecurityEAP {
+		var err error
+		if certs, err = s.applyEAP(req, &profile); err != nil {
+			return profile, nil, newServiceError(http.StatusUnprocessableEntity, "Invalid enterprise settings: %v", err)
+		}
+	} else {
+		profile.EAP = nil
+	}
+	if req.IP != nil {
+		ip := network.IPConfig(*req.IP)
+		if err := ip.Validate(); err != nil {
+			return profile, nil, newServiceError(http.StatusUnprocessableEntity, "Invalid IP settings: %v", err)
+		}
+		profile.SetIP(ip)
+	}
+	if req.Priority != nil {
+		profile.Priority = *req.Priority
+	}
+	if req.Autoconnect != nil {
+		profile.Autoconnect = *req.Autoconnect
+	}
+	return profile, certs, s.checkRender(profile)
+}
+
+// setPassphrase replaces the passphrase of a saved network. A passphrase
+// alone cannot tell WPA3 from WPA2, so a saved WPA3 type is kept for hidden
+// networks the scan does not see.
+func setPassphrase(p *profiles.Profile, password string) {
+	security := profiles.New(p.SSID, password).Security
+	p.PSK, p.PMK = password, ""
+	if password == "" || (p.Security != profiles.SecurityWPA3SAE && p.Security != profiles.SecurityWPA3Transition) {
+		p.Security = security
+	}
+}
+
+// applyEAP sets the enterprise settings of the request on the profile and
+// returns the checked certificates in the request, by kind, for the caller
+// to write once the settings are accepted. The password and certificates
+// already saved for the profile are kept when the request has none.
+func (s *Server) applyEAP(req networkRequest, profile *profiles.Profile) (map[string][]byte, error) {
+	if req.EAP == nil {
+		return nil, errors.New("no enterprise settings")
+	}
+	eap := &profiles.EAPSettings{
+		Method:            req.EAP.Method,
+		Identity:          strings.TrimSpace(req.EAP.Identity),
+		AnonymousIdentity: strings.TrimSpace(req.EAP.AnonymousIdentity),
+		Password:          req.Password,
+		Phase2:            req.EAP.Phase2,
+		ClientKeyPassword: req.EAP.ClientKeyPassword,
+	}
+	if profile.EAP != nil {
+		eap.CACert, eap.ClientCert, eap.ClientKey = profile.EAP.CACert, profile.EAP.ClientCert, profile.EAP.ClientKey
+		if eap.Password == "" {
+			eap.Password = profile.EAP.Password
+		}
+	}
+	certs := []struct {
+		data, kind string
+		path       *string
+	}{
+		{req.EAP.CACert, profiles.CertCA, &eap.CACert},
+		{req.EAP.ClientCert, profiles.CertClient, &eap.ClientCert},
+		{req.EAP.ClientKey, profiles.CertKey, &eap.ClientKey},
+	}
+	uploads := make(map[string][]byte)
+	for _, c := range certs {
+		if c.data == "" {
+			continue
+		}
+		data, err := profiles.CheckCert(c.kind, []byte(c.data))
+		if err != nil {
+			return nil, err
+		}
+		uploads[c.kind], *c.path = data, s.profiles().CertPath(profile.ID, c.kind)
+	}
+	if err := eap.Config().Validate(); err != nil {
+		return nil, err
+	}
+	profile.Security, profile.PSK, profile.PMK, profile.EAP = profiles.SecurityEAP, "", "", eap
+	return uploads, nil
+}
+
+// writeCerts stores the certificates uploaded for the profile. The returned
+// function restores the previous files, for when the profile is not kept.
+func (s *Server) writeCerts(profile profiles.Profile, certs map[string][]byte) (func(), error) {
+	undo, err := s.profiles().WriteCerts(profile.ID, certs)
+	if err != nil {
+		log.Printf("ERROR: Failed to store certificates for %s: %v", profile.SSID, err)
+		return nil, errInternal
+	}
+	return undo, nil
+}
+
+// checkRender renders the profile for the backend, which catches values it
+// cannot express. Rendering happens again when the profile is applied.
+func (s *Server) checkRender(profile profiles.Profile) error {
+	if _, err := s.Backend.Render(profile.ClientConfig()); err != nil {
+		log.Printf("ERROR: Failed to render %s profile: %v", s.Backend.Name(), err)
+		return newServiceError(http.StatusUnprocessableEntity, "This network cannot be configured: %v", err)
+	}
+	return nil
+}
+
+// connect starts a transactional connect to the requested network. The
+// profile is only saved once the connection has been verified, and uploaded
+// certificates are removed again if it fails.
+func (s *Server) connect(req networkRequest) (profiles.Profile, error) {
+	log.Printf("Received request to connect to SSID: %q", req.SSID)
+	profile, certs, err := s.buildProfile(req)
+	if err != nil {
+		return profile, err
+	}
+	release, err := s.State.Acquire("connect")
+	if err != nil {
+		return profile, newServiceError(http.StatusConflict, busyMessage)
+	}
+	undo, err := s.writeCerts(profile, certs)
+	if err != nil {
+		release()
+		return profile, err
+	}
+	if msg := s.checkCredentials(profile.ClientConfig()); msg != "" {
+		undo()
+		release()
+		return profile, newServiceError(http.StatusUnprocessableEntity, "%s", msg)
+	}
+	s.startConnect(profile, release, undo)
+	return profile, nil
+}
+
+// reconnect starts a transactional connect to a saved network.
+func (s *Server) reconnect(id string) (profiles.Profile, error) {
+	log.Printf("Received reconnect request for profile: %s", id)
+	profile, err := s.savedNetwork(id)
+	if err != nil {
+		return profile, err
+	}
+	release, err := s.State.Acquire("reconnect")
+	if err != nil {
+		return profile, newServiceError(http.StatusConflict, busyMessage)
+	}
+	s.startConnect(profile, release, nil)
+	return profile, nil
+}
+
+// savedNetworks returns the saved networks.
+func (s *Server) savedNetworks() ([]profiles.Profile, error) {
+	saved, err := s.profiles().List()
+	if err != nil {
+		log.Printf("ERROR: Failed to list saved networks: %v", err)
+		return nil, errInternal
+	}
+	return saved, nil
+}
+
+// savedNetwork returns the saved network with the given ID.
+func (s *Server) savedNetwork(id string) (profiles.Profile, error) {
+	profile, err := s.profiles().Get(id)
+	switch {
+	case errors.Is(err, profiles.ErrInvalidID), errors.Is(err, profiles.ErrNotFound):
+		return profile, newServiceError(http.StatusNotFound, "Could not find saved network profile.")
+	case err != nil:
+		log.Printf("ERROR: Could not read saved profile '%s': %v", id, err)
+		return profile, errInternal
+	}
+	return profile, nil
+}
+
+// createNetwork saves a network without connecting to it, so it can be
+// joined later, for example by auto-connect.
+func (s *Server) createNetwork(req networkRequest) (profiles.Profile, error) {
+	if _, err := s.profiles().Find(req.SSID); err == nil {
+		return profiles.Profile{}, newServiceError(http.StatusConflict, "A network named %s is already saved.", req.SSID)
+	}
+	profile, certs, err := s.buildProfile(req)
+	if err != nil {
+		return profile, err
+	}
+	undo, err := s.writeCerts(profile, certs)
+	if err != nil {
+		return profile, err
+	}
+	if err := s.saveNetwork(profile); err != nil {
+		undo()
+		return profile, err
+	}
+	return profile, nil
+}
+
+// updateNetwork changes a saved network.
+func (s *Server) updateNetwork(id string, update networkUpdate) (profiles.Profile, error) {
+	profile, err := s.savedNetwork(id)
+	if err != nil {
+		return profile, err
+	}
+	if update.Password != nil {
+		if profile.EAP != nil {
+			profile.EAP.Password = *update.Password
+		} else {
+			setPassphrase(&profile, *update.Password)
+		}
+	}
+	if update.Hidden != nil {
+		profile.Hidden = *update.Hidden
+	}
+	if update.IP != nil {
+		ip := network.IPConfig(*update.IP)
+		if err := ip.Validate(); err != nil {
+			return profile, newServiceError(http.StatusUnprocessableEntity, "Invalid IP settings: %v", err)
+		}
+		profile.SetIP(ip)
+	}
+	if update.Priority != nil {
+		profile.Priority = *update.Priority
+	}
+	if update.Autoconnect != nil {
+		profile.Autoconnect = *update.Autoconnect
+	}
+	if err := s.checkRender(profile); err != nil {
+		return profile, err
+	}
+	return profile, s.saveNetwork(profile)
+}
+
+// saveNetwork writes a profile to the store.
+func (s *Server) saveNetwork(profile profiles.Profile) error {
+	if err := s.profiles().Save(profile); err != nil {
+		log.Printf("ERROR: Failed to save network profile: %v", err)
+		return errInternal
+	}
+	return nil
+}
+
+// deleteNetwork removes a saved network and everything recorded about it.
+func (s *Server) deleteNetwork(id string) error {
+	err := s.profiles().Delete(id)
+	switch {
+	case errors.Is(err, profiles.ErrInvalidID), errors.Is(err, profiles.ErrNotFound):
+		return newServiceError(http.StatusNotFound, "Could not find saved network profile.")
+	case err != nil:
+		log.Printf("ERROR: Failed to delete network profile %s: %v", id, err)
+		return errInternal
+	}
+	if err := s.State.ForgetProfile(id); err != nil {
+		log.Printf("WARNING: Could not forget profile %s in the state file: %v", id, err)
+	}
+	log.Printf("Deleted saved network profile %s.", id)
+	return nil
+}
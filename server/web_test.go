@@ -0,0 +1,108 @@
+package server
+
+import (
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"pifigo/web"
+)
+
+// TestEmbeddedWebRoot verifies the portal is served from the binary when no
+// web_root is set, without loading anything from the internet.
+func TestEmbeddedWebRoot(t *testing.T) {
+	server := setupTestServer(t)
+	server.AppConfig.Paths.WebRoot = ""
+
+	rr := apiRequest(server, "GET", "/", "")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `href="/static/pifigo.css"`) {
+		t.Fatalf("Unexpected index: %d %s", rr.Code, rr.Body.String())
+	}
+	if external := regexp.MustCompile(`(src|href)="(https?:)?//`).FindString(rr.Body.String()); external != "" {
+		t.Errorf("Index loads an asset from the internet: %s", external)
+	}
+	if rr := apiRequest(server, "GET", "/static/pifigo.css", ""); rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/css") {
+		t.Errorf("Unexpected stylesheet: %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+
+	// The login page needs the stylesheet before anyone has logged in.
+	hash, _ := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	server.AppConfig.Admin.PasswordHash = string(hash)
+	if rr := apiRequest(server, "GET", "/static/pifigo.css", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected the stylesheet to be public, got %d", rr.Code)
+	}
+}
+
+// TestEmbeddedHTMX verifies the htmx the page loads is built into the
+// binary, since the portal is used without internet access.
+func TestEmbeddedHTMX(t *testing.T) {
+	index, err := fs.ReadFile(web.Files, "index.html")
+	if err != nil || !strings.Contains(string(index), `src="/static/htmx.min.js"`) {
+		t.Fatalf("Expected the index to load /static/htmx.min.js (err: %v)", err)
+	}
+	htmx, err := fs.ReadFile(web.Files, "static/htmx.min.js")
+	if err != nil || !strings.Contains(string(htmx), "htmx") {
+		t.Fatalf("static/htmx.min.js is missing from the web root; run 'go generate ./web' (err: %v)", err)
+	}
+}
+
+// TestWebRootOverride verifies paths.web_root replaces the built-in pages
+// unless it has no index.html.
+func TestWebRootOverride(t *testing.T) {
+	server := setupTestServer(t)
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("<html>custom</html>"), 0644)
+	server.AppConfig.Paths.WebRoot = dir
+
+	if rr := apiRequest(server, "GET", "/", ""); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "custom") {
+		t.Errorf("Expected the configured web root, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	// A web_root left over from an older install falls back to the built-in pages.
+	server.AppConfig.Paths.WebRoot = filepath.Join(dir, "missing")
+	if rr := apiRequest(server, "GET", "/static/htmx.min.js", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected the built-in pages for a stale web root, got %d", rr.Code)
+	}
+}
+
+// TestStylesheetCoversClasses verifies every class used by the portal page,
+// the login page and the HTML fragments has a rule in the stylesheet.
+func TestStylesheetCoversClasses(t *testing.T) {
+	css, err := fs.ReadFile(web.Files, "static/pifigo.css")
+	if err != nil {
+		t.Fatalf("Failed to read the stylesheet: %v", err)
+	}
+	index, err := fs.ReadFile(web.Files, "index.html")
+	if err != nil {
+		t.Fatalf("Failed to read the index: %v", err)
+	}
+	sources := map[string]string{"index.html": string(index)}
+	files, _ := filepath.Glob("*.go")
+	for _, name := range files {
+		if !strings.HasSuffix(name, "_test.go") {
+			data, _ := os.ReadFile(name)
+			sources[name] = string(data)
+		}
+	}
+
+	attr := regexp.MustCompile("class=[\"']([^\"'`]*)[\"']|className = '([^']*)'|classList\\.\\w+\\('([^']*)'")
+	action := regexp.MustCompile(`{{[^}]*}}`)
+	styledByHTMX := map[string]bool{"htmx-indicator": true}
+	escape := strings.NewReplacer(":", `\:`, "[", `\[`, "]", `\]`)
+	for name, src := range sources {
+		for _, m := range attr.FindAllStringSubmatch(src, -1) {
+			for _, class := range strings.Fields(action.ReplaceAllString(m[1]+" "+m[2]+" "+m[3], " ")) {
+				selector := regexp.MustCompile(regexp.QuoteMeta("."+escape.Replace(class)) + `[\s,:{>]`)
+				if !styledByHTMX[class] && !selector.Match(css) {
+					t.Errorf("%s uses class %q, which has no rule in web/static/pifigo.css", name, class)
+				}
+			}
+		}
+	}
+}
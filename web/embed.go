@@ -0,0 +1,14 @@
+// Package web holds the portal's pages and assets, built into the binary so
+// the portal works without internet access. paths.web_root overrides them.
+package web
+
+import "embed"
+
+// static/htmx.min.js is htmx 1.9.10, vendored. vendor-htmx.sh fetches the
+// pinned release again and checks it against its published SRI hash.
+//go:generate sh vendor-htmx.sh
+
+// Files is the web root built into the binary.
+//
+//go:embed index.html randao.svg static
+var Files embed.FS
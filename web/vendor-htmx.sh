@@ -0,0 +1,18 @@
+#!/bin/sh
+# Downloads the pinned htmx release into static/ and checks it against the
+# SRI hash htmx publishes for it. Run with 'go generate ./web'.
+set -eu
+
+version=1.9.10
+sri=sha384-D1Kt99CQMDuVetoL1lrYwg5t+9QdHe7NLX/SoJYkXDFfX37iInKRy5xLSi8nO7UC
+
+cd "$(dirname "$0")"
+curl -fsSL "https://unpkg.com/htmx.org@$version/dist/htmx.min.js" -o static/htmx.min.js.tmp
+got="sha384-$(openssl dgst -sha384 -binary static/htmx.min.js.tmp | openssl base64 -A)"
+if [ "$got" != "$sri" ]; then
+	rm -f static/htmx.min.js.tmp
+	echo "htmx $version does not match $sri (got $got)" >&2
+	exit 1
+fi
+mv static/htmx.min.js.tmp static/htmx.min.js
+echo "Vendored htmx $version in web/static/htmx.min.js."